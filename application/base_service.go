@@ -2,22 +2,50 @@ package application
 
 import (
 	"context"
+	"github.com/MingxuanGame/OsuBeatmapSync/base_service"
 	"github.com/rs/zerolog/log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 var logger = log.With().Str("module", "application").Logger()
 
+type hardContextKey struct{}
+
+// CreateSignalCancelContext returns the context of the run. The first interrupt signal cancels it to stop
+// starting new work, work already started uses HardContext to finish and save its state.
+// A second signal or the shutdown timeout cancels everything.
 func CreateSignalCancelContext() context.Context {
-	signalChan := make(chan os.Signal, 1)
+	signalChan := make(chan os.Signal, 2)
 	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
-	ctx, cancel := context.WithCancel(context.Background())
+	hard, cancelHard := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), hardContextKey{}, hard))
 	go func() {
 		<-signalChan
-		logger.Info().Msg("Received interrupt signal. Canceling tasks...")
+		timeout := 2 * time.Minute
+		if config := base_service.GlobalConfig(); config != nil {
+			timeout = config.General.ShutdownTimeoutDuration()
+		}
+		logger.Info().Msgf("Received interrupt signal. Finishing started tasks within %s, interrupt again to stop at once...", timeout)
 		cancel()
+		select {
+		case <-signalChan:
+			logger.Warn().Msg("Received second interrupt signal. Canceling all tasks...")
+		case <-time.After(timeout):
+			logger.Warn().Msg("Shutdown timeout exceeded. Canceling all tasks...")
+		}
+		cancelHard()
 	}()
 	return ctx
 }
+
+// HardContext returns the context for work that is already started, like uploads and downloads,
+// it is only canceled by a second interrupt signal or the shutdown timeout
+func HardContext(ctx context.Context) context.Context {
+	if hard, ok := ctx.Value(hardContextKey{}).(context.Context); ok {
+		return hard
+	}
+	return ctx
+}
@@ -0,0 +1,72 @@
+package application
+
+import (
+	"encoding/json"
+	"github.com/MingxuanGame/OsuBeatmapSync/utils"
+	"os"
+)
+
+const SyncDeadLetterFilename = "deadLetter.json"
+const MetadataDeadLetterFilename = "deadLetterMetadata.json"
+
+func ReadDeadLetters[T any](filename string) ([]utils.RetryState[T], error) {
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		logger.Trace().Msgf("File %s not found", filename)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var letters []utils.RetryState[T]
+	if len(data) != 0 {
+		err = json.Unmarshal(data, &letters)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return letters, nil
+}
+
+// SaveDeadLetters overwrites the dead-letter file, removing it if there is nothing left
+func SaveDeadLetters[T any](filename string, letters []utils.RetryState[T]) error {
+	if len(letters) == 0 {
+		err := os.Remove(filename)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	data, err := json.MarshalIndent(letters, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, data, 0644)
+}
+
+// AppendDeadLetters adds letters to the dead-letter file, an existing letter of the same item
+// is replaced and its error history is kept
+func AppendDeadLetters[T any, K comparable](filename string, letters []utils.RetryState[T], key func(T) K) error {
+	if len(letters) == 0 {
+		return nil
+	}
+	existed, err := ReadDeadLetters[T](filename)
+	if err != nil {
+		return err
+	}
+	index := make(map[K]int)
+	for i, letter := range existed {
+		index[key(letter.Item)] = i
+	}
+	for _, letter := range letters {
+		if i, ok := index[key(letter.Item)]; ok {
+			letter.Errors = append(existed[i].Errors, letter.Errors...)
+			existed[i] = letter
+			continue
+		}
+		index[key(letter.Item)] = len(existed)
+		existed = append(existed, letter)
+	}
+	logger.Warn().Msgf("Saved %d dead letter(s) to %s", len(letters), filename)
+	return SaveDeadLetters(filename, existed)
+}
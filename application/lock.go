@@ -0,0 +1,299 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "github.com/MingxuanGame/OsuBeatmapSync/model"
+	"github.com/MingxuanGame/OsuBeatmapSync/storage"
+	"os"
+	"os/user"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	// LockFilename is the lease lock file in the storage under the root
+	LockFilename = ".sync.lock"
+	// LocalLockFilename is the lock file of the state files in the working directory
+	LocalLockFilename = "sync.lock"
+
+	lockLease     = 5 * time.Minute
+	lockHeartbeat = time.Minute
+)
+
+// ErrLockLost is the cause of the lock context when the lease is taken over or cannot be renewed in time
+var ErrLockLost = errors.New("lock lost")
+
+type LockInfo struct {
+	Owner     string    `json:"owner"`
+	Command   string    `json:"command"`
+	Acquired  time.Time `json:"acquired"`
+	Heartbeat time.Time `json:"heartbeat"`
+	Expires   time.Time `json:"expires"`
+}
+
+func (info LockInfo) String() string {
+	return fmt.Sprintf("%s running %q since %s, last heartbeat %s, expires %s", info.Owner, info.Command,
+		info.Acquired.Local().Format(time.DateTime), info.Heartbeat.Local().Format(time.DateTime), info.Expires.Local().Format(time.DateTime))
+}
+
+func newLockInfo(command string) LockInfo {
+	username := "unknown"
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	now := time.Now()
+	return LockInfo{
+		Owner:     fmt.Sprintf("%s@%s (pid %d)", username, hostname, os.Getpid()),
+		Command:   command,
+		Acquired:  now,
+		Heartbeat: now,
+		Expires:   now.Add(lockLease),
+	}
+}
+
+// Lock is a lease on the working directory, and on the storage root if backend is set.
+// The lease is renewed in the background until it is released.
+type Lock struct {
+	backend storage.Backend
+	root    string
+
+	mux  sync.Mutex
+	info LockInfo
+	eTag string
+	err  error
+
+	cancel context.CancelCauseFunc
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// AcquireLocalLock locks the state files in the working directory, for runs that do not upload metadata
+func AcquireLocalLock(ctx context.Context, command string, force bool) (*Lock, context.Context, error) {
+	return AcquireLock(ctx, nil, "", command, force)
+}
+
+// AcquireLock locks the working directory and the storage root. An expired lock is taken over,
+// force takes over a lock that is not expired. The returned context is canceled when the lock is lost.
+func AcquireLock(ctx context.Context, backend storage.Backend, root, command string, force bool) (*Lock, context.Context, error) {
+	l := &Lock{
+		backend: backend,
+		root:    root,
+		info:    newLockInfo(command),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	err := l.acquireLocal(force)
+	if err != nil {
+		return nil, ctx, err
+	}
+	if backend != nil {
+		err = l.acquireRemote(force)
+		if err != nil {
+			_ = os.Remove(LocalLockFilename)
+			return nil, ctx, err
+		}
+	}
+	ctx, l.cancel = context.WithCancelCause(ctx)
+	go l.heartbeat()
+	return l, ctx, nil
+}
+
+func (l *Lock) data() []byte {
+	data, _ := json.MarshalIndent(l.info, "", "  ")
+	return data
+}
+
+func (l *Lock) acquireLocal(force bool) error {
+	for range 2 {
+		f, err := os.OpenFile(LocalLockFilename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = f.Write(l.data())
+			_ = f.Close()
+			return err
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		data, err := os.ReadFile(LocalLockFilename)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		var other LockInfo
+		if json.Unmarshal(data, &other) == nil && !force && time.Now().Before(other.Expires) {
+			return fmt.Errorf("working directory is locked by %s, use --force-unlock if it is not running", other)
+		}
+		logger.Warn().Msgf("Taking over the lock of the working directory: %s", other)
+		err = os.Remove(LocalLockFilename)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return fmt.Errorf("failed to lock the working directory")
+}
+
+func (l *Lock) path() string {
+	return path.Join(l.root, LockFilename)
+}
+
+func (l *Lock) acquireRemote(force bool) error {
+	for range 3 {
+		obj, err := l.backend.PutIf(l.path(), l.data(), "")
+		if err == nil {
+			l.eTag = obj.ETag
+			return nil
+		}
+		if GetErrorType(err) != ErrorConflict {
+			return err
+		}
+
+		obj, err = l.backend.Stat(l.path())
+		if err != nil {
+			return err
+		}
+		if obj == nil {
+			// released in the meantime
+			continue
+		}
+		data, err := storage.ReadAll(l.backend, l.path())
+		if GetErrorType(err) == ErrorNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var other LockInfo
+		if json.Unmarshal(data, &other) == nil && !force && time.Now().Before(other.Expires) {
+			return fmt.Errorf("%s is locked by %s, use --force-unlock if it is not running", l.root, other)
+		}
+		logger.Warn().Msgf("Taking over the lock of %s: %s", l.root, other)
+		// the eTag makes sure nobody else took it over first
+		obj, err = l.backend.PutIf(l.path(), l.data(), obj.ETag)
+		if err != nil {
+			if GetErrorType(err) == ErrorConflict || GetErrorType(err) == ErrorNotFound {
+				return fmt.Errorf("%s is locked by another run that took over the expired lock first", l.root)
+			}
+			return err
+		}
+		l.eTag = obj.ETag
+		return nil
+	}
+	return fmt.Errorf("failed to lock %s", l.root)
+}
+
+func (l *Lock) heartbeat() {
+	defer close(l.done)
+	ticker := time.NewTicker(lockHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+		err := l.renew()
+		if err == nil {
+			continue
+		}
+		l.mux.Lock()
+		expired := time.Now().After(l.info.Expires)
+		l.mux.Unlock()
+		if errors.Is(err, ErrLockLost) || expired {
+			logger.Error().Err(err).Msg("Lock lost, stopping")
+			l.mux.Lock()
+			l.err = ErrLockLost
+			l.mux.Unlock()
+			l.cancel(ErrLockLost)
+			return
+		}
+		logger.Warn().Err(err).Msg("Failed to renew lock, retrying")
+	}
+}
+
+func (l *Lock) renew() error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	// the local lock has no eTag, the owner is checked before it is written like the eTag in the storage
+	owned, err := l.ownsLocal()
+	if err != nil {
+		return err
+	}
+	if !owned {
+		return fmt.Errorf("%w: the working directory is locked by another run", ErrLockLost)
+	}
+	info := l.info
+	now := time.Now()
+	info.Heartbeat, info.Expires = now, now.Add(lockLease)
+	data, _ := json.MarshalIndent(info, "", "  ")
+	if l.backend != nil {
+		obj, err := l.backend.PutIf(l.path(), data, l.eTag)
+		if err != nil {
+			if GetErrorType(err) == ErrorConflict || GetErrorType(err) == ErrorNotFound {
+				return fmt.Errorf("%w: %w", ErrLockLost, err)
+			}
+			return err
+		}
+		l.eTag = obj.ETag
+	}
+	err = os.WriteFile(LocalLockFilename, data, 0644)
+	if err != nil {
+		return err
+	}
+	l.info = info
+	return nil
+}
+
+// ownsLocal reports whether the local lock file is still the one written by this lock,
+// it may be removed or taken over by --force-unlock
+func (l *Lock) ownsLocal() (bool, error) {
+	data, err := os.ReadFile(LocalLockFilename)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var current LockInfo
+	if json.Unmarshal(data, &current) != nil {
+		return false, nil
+	}
+	return current.Owner == l.info.Owner && current.Acquired.Equal(l.info.Acquired), nil
+}
+
+// Err returns ErrLockLost if the lock is lost, metadata must not be uploaded then
+func (l *Lock) Err() error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.err
+}
+
+// Release stops renewing and removes the lock files
+func (l *Lock) Release() {
+	close(l.stop)
+	<-l.done
+	l.cancel(nil)
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	// a lost lock in the storage belongs to someone else now
+	if l.backend != nil && l.err == nil {
+		err := l.backend.Delete(l.path(), l.eTag)
+		if err != nil && GetErrorType(err) != ErrorNotFound {
+			logger.Warn().Err(err).Msgf("Failed to release the lock of %s, it expires at %s", l.root, l.info.Expires.Local().Format(time.DateTime))
+		}
+	}
+	// the local lock may be taken over by --force-unlock too
+	if owned, err := l.ownsLocal(); err != nil || !owned {
+		return
+	}
+	err := os.Remove(LocalLockFilename)
+	if err != nil && !os.IsNotExist(err) {
+		logger.Warn().Err(err).Msg("Failed to remove the local lock")
+	}
+}
@@ -3,84 +3,57 @@ package application
 import (
 	"encoding/json"
 	. "github.com/MingxuanGame/OsuBeatmapSync/model"
-	. "github.com/MingxuanGame/OsuBeatmapSync/model/onedrive"
-	"github.com/MingxuanGame/OsuBeatmapSync/onedrive"
 	"github.com/MingxuanGame/OsuBeatmapSync/sql"
-	"github.com/rs/zerolog/log"
+	"github.com/MingxuanGame/OsuBeatmapSync/storage"
 	"os"
+	"path"
 )
 
 const MetadataTempFilename = "metadata.json"
 
-func getMetadataFromRemote(graph *onedrive.GraphClient, root string) (Metadata, error) {
+func getMetadataFromRemote(backend storage.Backend, root string) (Metadata, error) {
 	metadata := Metadata{
 		GameMode:    make(map[GameMode]MetadataGameMode),
 		Beatmaps:    make(map[int]BeatmapMetadata),
 		Beatmapsets: make(map[int]BeatmapsetMetadata),
 	}
-	item, err := graph.GetItem(root, "")
+	p := path.Join(root, sql.MetadataDBFilename)
+	metadataFile, err := backend.Stat(p)
 	if err != nil {
 		return Metadata{}, err
 	}
-	if item == nil {
-		log.Info().Msg("Root folder not found, creating...")
-		_, err = graph.CreateFolderRecursive(root)
-		if err != nil {
-			return Metadata{}, err
-		}
+	if metadataFile == nil {
+		logger.Info().Msg("No existed metadata file found")
+		return metadata, nil
 	}
-
-	files, err := graph.ListFiles(root, 200, "")
+	logger.Info().Msg("Found existed metadata file, downloading...")
+	data, err := storage.ReadAll(backend, p)
 	if err != nil {
 		return Metadata{}, err
 	}
-	var metadataFile DriveItem
-	if files == nil {
-		logger.Info().Msg("No existed metadata file found")
-		return metadata, nil
+	f, err := os.CreateTemp("", "beatmap-sync-")
+	if err != nil {
+		return Metadata{}, err
 	}
-	for _, file := range *files {
-		if file.Name == sql.MetadataDBFilename {
-			metadataFile = file
-			break
-		}
+	logger.Trace().Str("filename", f.Name()).Msg("Saving metadata to temp local database...")
+	_, err = f.Write(data)
+	if err != nil {
+		return Metadata{}, err
 	}
-	if metadataFile.Name != "" {
-		logger.Info().Msg("Found existed metadata file, downloading...")
-		data, err := graph.DownloadFile(metadataFile.Id)
-		if err != nil {
-			return Metadata{}, err
-		}
-		f, err := os.CreateTemp("", "beatmap-sync-")
-		if err != nil {
-			return Metadata{}, err
-		}
-		logger.Trace().Str("filename", f.Name()).Msg("Saving metadata to temp local database...")
-		_, err = f.Write(data)
-		if err != nil {
-			return Metadata{}, err
-		}
-		db, err := sql.OpenDatabase(f.Name())
-		if err != nil {
-			return Metadata{}, err
-		}
-		metadata, err = db.ReadMetadata()
-		if err != nil {
-			return Metadata{}, err
-		}
-		err = db.Close()
-		if err != nil {
-			return Metadata{}, err
-		}
-		_ = f.Close()
-		_ = os.Remove(f.Name())
-	} else {
-		metadata = Metadata{
-			GameMode:    make(map[GameMode]MetadataGameMode),
-			Beatmaps:    make(map[int]BeatmapMetadata),
-			Beatmapsets: make(map[int]BeatmapsetMetadata),
-		}
+	db, err := sql.OpenDatabase(f.Name())
+	if err != nil {
+		return Metadata{}, err
+	}
+	metadata, err = db.ReadMetadata()
+	if err != nil {
+		return Metadata{}, err
+	}
+	err = db.Close()
+	if err != nil {
+		return Metadata{}, err
 	}
+	_ = f.Close()
+	_ = os.Remove(f.Name())
 	return metadata, nil
 }
 
@@ -101,13 +74,13 @@ func ReadLocalMetadata(filename string) (Metadata, error, bool) {
 	return metadata, nil, true
 }
 
-func GetMetadata(graph *onedrive.GraphClient, root string) (Metadata, error) {
+func GetMetadata(backend storage.Backend, root string) (Metadata, error) {
 	metadata, err, ok := ReadLocalMetadata(MetadataTempFilename)
 	if err != nil {
 		return Metadata{}, err
 	}
 	if !ok {
-		metadata, err = getMetadataFromRemote(graph, root)
+		metadata, err = getMetadataFromRemote(backend, root)
 		if err != nil {
 			return Metadata{}, err
 		}
@@ -158,17 +131,23 @@ func SaveMetadataToLocalDB(metadata *Metadata) (string, error) {
 	return f.Name(), nil
 }
 
-func UploadMetadata(graph *onedrive.GraphClient, root string, metadata *Metadata) error {
+func UploadMetadata(backend storage.Backend, root string, metadata *Metadata) error {
 	filename, err := SaveMetadataToLocalDB(metadata)
 	if err != nil {
 		return err
 	}
 	logger.Info().Msg("Uploading metadata...")
-	data, err := os.ReadFile(filename)
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
 	if err != nil {
+		_ = f.Close()
 		return err
 	}
-	err = graph.UploadLargeFile(root, sql.MetadataDBFilename, data)
+	_, err = backend.Put(path.Join(root, sql.MetadataDBFilename), f, info.Size())
+	_ = f.Close()
 	if err != nil {
 		return err
 	}
@@ -2,12 +2,16 @@ package application
 
 import (
 	"context"
+	"fmt"
 	"github.com/MingxuanGame/OsuBeatmapSync/base_service"
 	. "github.com/MingxuanGame/OsuBeatmapSync/model"
 	"github.com/MingxuanGame/OsuBeatmapSync/onedrive"
+	"github.com/MingxuanGame/OsuBeatmapSync/storage"
 )
 
 func Login(config *Config, ctx context.Context) (*onedrive.GraphClient, error) {
+	// requests already sent, like uploads, are finished on the first interrupt signal
+	ctx = HardContext(ctx)
 	var client *onedrive.GraphClient
 	if config.OneDrive.Token.AccessToken == "" || config.OneDrive.Token.RefreshToken == "" {
 		logger.Info().Msg("No existed token found, login...")
@@ -41,3 +45,24 @@ func Login(config *Config, ctx context.Context) (*onedrive.GraphClient, error) {
 	logger.Info().Msg("Login successful...")
 	return client, nil
 }
+
+// OpenStorage opens the backend of the Storage config, logging in to OneDrive for the default backend
+func OpenStorage(config *Config, ctx context.Context) (storage.Backend, error) {
+	switch config.Storage.Type {
+	case "", "onedrive":
+		client, err := Login(config, ctx)
+		if err != nil {
+			return nil, err
+		}
+		return storage.NewOneDrive(client), nil
+	case "local":
+		return storage.NewLocal(config.Storage.Local.Dir, config.Storage.Local.BaseUrl)
+	case "s3":
+		// like the Graph client, requests already sent are finished on the first interrupt signal
+		return storage.NewS3(HardContext(ctx), config.Storage.S3)
+	case "webdav":
+		return storage.NewWebDAV(HardContext(ctx), config.Storage.WebDAV)
+	default:
+		return nil, fmt.Errorf("unknown storage type %q", config.Storage.Type)
+	}
+}
@@ -9,6 +9,47 @@ import (
 	"time"
 )
 
+// addBeatmap adds the difficulty from osu! API to its beatmapset
+func addBeatmap(info Beatmap, beatmapsets map[int]BeatmapsetMetadata) {
+	beatmapset, ok := beatmapsets[info.BeatmapsetId]
+	if !ok {
+		beatmapset = BeatmapsetMetadata{
+			BeatmapsetId: info.BeatmapsetId,
+			Beatmaps:     make(map[int]BeatmapMetadata),
+			LastUpdate:   0,
+		}
+	}
+	beatmap := BeatmapMetadata{
+		Beatmap:        info,
+		ApprovedDate:   utils.MustParseTime(info.ApprovedDate, time.DateTime).Unix(),
+		SubmitDate:     utils.MustParseTime(info.SubmitDate, time.DateTime).Unix(),
+		LastUpdate:     utils.MustParseTime(info.LastUpdate, time.DateTime).Unix(),
+		NoAudio:        utils.Itob(info.NoAudio),
+		CannotDownload: utils.Itob(info.CannotDownload),
+		HasStoryboard:  utils.Itob(info.HasStoryboard),
+		HasVideo:       utils.Itob(info.HasVideo),
+		Link:           make(map[string]string),
+		Path:           make(map[string]string),
+	}
+	if beatmap.HasVideo {
+		beatmapset.HasVideo = true
+	}
+	if beatmap.HasStoryboard {
+		beatmapset.HasStoryboard = true
+	}
+	if beatmap.CannotDownload {
+		beatmapset.CannotDownload = true
+	}
+	if beatmap.NoAudio {
+		beatmapset.NoAudio = true
+	}
+	if beatmapset.LastUpdate < beatmap.LastUpdate {
+		beatmapset.LastUpdate = beatmap.LastUpdate
+	}
+	beatmapset.Beatmaps[info.BeatmapId] = beatmap
+	beatmapsets[info.BeatmapsetId] = beatmapset
+}
+
 func GetNewBeatmapset(client *osu.LegacyOfficialClient, since time.Time, lastBeatmapsetInfo map[int]BeatmapsetMetadata) (time.Time, bool, error) {
 	beatmaps, err := client.GetBeatmapByTime(since)
 	if err != nil {
@@ -19,40 +60,7 @@ func GetNewBeatmapset(client *osu.LegacyOfficialClient, since time.Time, lastBea
 	}
 	lastTime := since
 	for _, info := range *beatmaps {
-		beatmapset, ok := lastBeatmapsetInfo[info.BeatmapsetId]
-		if !ok {
-			beatmapset = BeatmapsetMetadata{
-				BeatmapsetId: info.BeatmapsetId,
-				Beatmaps:     make(map[int]BeatmapMetadata),
-				LastUpdate:   0,
-			}
-		}
-		beatmap := BeatmapMetadata{
-			Beatmap:        info,
-			ApprovedDate:   utils.MustParseTime(info.ApprovedDate, time.DateTime).Unix(),
-			SubmitDate:     utils.MustParseTime(info.SubmitDate, time.DateTime).Unix(),
-			LastUpdate:     utils.MustParseTime(info.LastUpdate, time.DateTime).Unix(),
-			NoAudio:        utils.Itob(info.NoAudio),
-			CannotDownload: utils.Itob(info.CannotDownload),
-			HasStoryboard:  utils.Itob(info.HasStoryboard),
-			HasVideo:       utils.Itob(info.HasVideo),
-			Link:           make(map[string]string),
-			Path:           make(map[string]string),
-		}
-		if beatmap.HasVideo {
-			beatmapset.HasVideo = true
-		}
-		if beatmap.HasStoryboard {
-			beatmapset.HasStoryboard = true
-		}
-		if beatmap.CannotDownload {
-			beatmapset.CannotDownload = true
-		}
-		if beatmap.NoAudio {
-			beatmapset.NoAudio = true
-		}
-		beatmapset.Beatmaps[info.BeatmapId] = beatmap
-		lastBeatmapsetInfo[info.BeatmapsetId] = beatmapset
+		addBeatmap(info, lastBeatmapsetInfo)
 		currentTime, err := time.Parse(time.DateTime, info.ApprovedDate)
 		if err != nil {
 			continue
@@ -60,9 +68,6 @@ func GetNewBeatmapset(client *osu.LegacyOfficialClient, since time.Time, lastBea
 		if currentTime.After(lastTime) {
 			lastTime = currentTime
 		}
-		if beatmapset.LastUpdate < beatmap.LastUpdate {
-			beatmapset.LastUpdate = beatmap.LastUpdate
-		}
 	}
 	return lastTime, false, nil
 }
@@ -88,3 +93,28 @@ func GetAllNewBeatmapset(ctx context.Context, osuClient *osu.LegacyOfficialClien
 	}
 	return allSyncBeatmapset, nil
 }
+
+// GetBeatmapsetsById fetches the beatmapsets from osu! API, missing are the ids that osu! API does not know
+func GetBeatmapsetsById(ctx context.Context, osuClient *osu.LegacyOfficialClient, ids []int) (beatmapsets map[int]BeatmapsetMetadata, missing []int, err error) {
+	beatmapsets = make(map[int]BeatmapsetMetadata)
+	for i, id := range ids {
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		default:
+		}
+		beatmaps, err := osuClient.GetBeatmapBySetId(id)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(*beatmaps) == 0 {
+			missing = append(missing, id)
+			continue
+		}
+		for _, info := range *beatmaps {
+			addBeatmap(info, beatmapsets)
+		}
+		log.Debug().Msgf("  Fetched %d/%d", i+1, len(ids))
+	}
+	return beatmapsets, missing, nil
+}
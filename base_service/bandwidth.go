@@ -0,0 +1,47 @@
+package base_service
+
+import (
+	. "github.com/MingxuanGame/OsuBeatmapSync/model"
+	"github.com/MingxuanGame/OsuBeatmapSync/utils"
+	"sync/atomic"
+	"time"
+)
+
+// bandwidthThrottles follow the bandwidth limits of one config. SetGlobalConfig replaces them,
+// so a reloaded config applies to the transfers started after it.
+type bandwidthThrottles struct {
+	download *utils.Throttle
+	upload   *utils.Throttle
+}
+
+var throttles atomic.Pointer[bandwidthThrottles]
+
+func newThrottles(config GeneralConfig) *bandwidthThrottles {
+	return &bandwidthThrottles{
+		download: utils.NewThrottle(func() int64 {
+			download, _ := config.BandwidthLimits(time.Now())
+			return download
+		}),
+		upload: utils.NewThrottle(func() int64 {
+			_, upload := config.BandwidthLimits(time.Now())
+			return upload
+		}),
+	}
+}
+
+func currentThrottles() *bandwidthThrottles {
+	if t := throttles.Load(); t != nil {
+		return t
+	}
+	return newThrottles(GeneralConfig{})
+}
+
+// DownloadThrottle limits the downloads by the bandwidth limits of GlobalConfig
+func DownloadThrottle() *utils.Throttle {
+	return currentThrottles().download
+}
+
+// UploadThrottle limits the uploads by the bandwidth limits of GlobalConfig
+func UploadThrottle() *utils.Throttle {
+	return currentThrottles().upload
+}
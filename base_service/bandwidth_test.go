@@ -0,0 +1,44 @@
+package base_service
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+// TestReloadDuringTransfers replaces the config while transfers read the limits, run it with -race
+func TestReloadDuringTransfers(t *testing.T) {
+	old := GlobalConfig()
+	t.Cleanup(func() { SetGlobalConfig(*old) })
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 1000 {
+				_ = UploadThrottle().WaitN(context.Background(), 1)
+				_ = DownloadThrottle().WaitN(context.Background(), 1)
+				_ = GlobalConfig().General.ShutdownTimeoutDuration()
+			}
+		}()
+	}
+	for i := range 1000 {
+		config := *old
+		// limits high enough that no transfer waits
+		config.General.UploadLimit, config.General.DownloadLimit = int64(1<<40+i), int64(1<<40+i)
+		SetGlobalConfig(config)
+	}
+	wg.Wait()
+
+	config := *old
+	config.General.UploadLimit = 1 << 20
+	before := UploadThrottle()
+	SetGlobalConfig(config)
+	if UploadThrottle() == before {
+		t.Fatal("throttle is not rebuilt from the new config")
+	}
+	if GlobalConfig().General.UploadLimit != 1<<20 {
+		t.Fatal("new config is not published")
+	}
+}
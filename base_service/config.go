@@ -4,17 +4,31 @@ import (
 	. "github.com/MingxuanGame/OsuBeatmapSync/model"
 	"github.com/pelletier/go-toml/v2"
 	"os"
+	"sync/atomic"
 )
 
 const ConfigPath = "./config.toml"
 
-var GlobalConfig *Config
+// globalConfig is replaced as a whole when the daemon reloads the config, it is never changed in place
+var globalConfig atomic.Pointer[Config]
+
+// GlobalConfig returns the config of the run, nil before it is loaded. It must not be changed, use SetGlobalConfig.
+func GlobalConfig() *Config {
+	return globalConfig.Load()
+}
+
+// SetGlobalConfig publishes a copy of config and rebuilds the bandwidth throttles from it
+func SetGlobalConfig(config Config) {
+	globalConfig.Store(&config)
+	throttles.Store(newThrottles(config.General))
+}
 
 func LoadConfig() (Config, error) {
-	if GlobalConfig == nil {
+	config := GlobalConfig()
+	if config == nil {
 		return LoadConfigFromFile()
 	}
-	return *GlobalConfig, nil
+	return *config, nil
 }
 
 func LoadConfigFromFile() (Config, error) {
@@ -9,5 +9,5 @@ func init() {
 	} else {
 		LogLevel = zerolog.Level(config.General.LogLevel)
 	}
-	GlobalConfig = &config
+	SetGlobalConfig(config)
 }
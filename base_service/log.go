@@ -23,7 +23,7 @@ func CreateLog() {
 	if err != nil {
 		panic(err)
 	}
-	output := zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.DateTime, NoColor: false}
+	output := zerolog.ConsoleWriter{Out: Console, TimeFormat: time.DateTime, NoColor: false}
 	fileWriter := zerolog.ConsoleWriter{Out: file, TimeFormat: time.DateTime, NoColor: true}
 	output.FormatLevel = func(i interface{}) string {
 		return strings.ToUpper(fmt.Sprintf("| %-6s|", i))
@@ -0,0 +1,64 @@
+package base_service
+
+import (
+	"github.com/mattn/go-isatty"
+	"os"
+	"strings"
+	"sync"
+)
+
+// StatusWriter writes console logs and keeps a block of status lines below them on a TTY
+type StatusWriter struct {
+	mux    sync.Mutex
+	out    *os.File
+	status []string
+	tty    bool
+}
+
+var Console = NewStatusWriter(os.Stderr)
+
+func NewStatusWriter(out *os.File) *StatusWriter {
+	return &StatusWriter{
+		out: out,
+		tty: isatty.IsTerminal(out.Fd()) || isatty.IsCygwinTerminal(out.Fd()),
+	}
+}
+
+func (w *StatusWriter) IsTerminal() bool {
+	return w.tty
+}
+
+func (w *StatusWriter) Write(p []byte) (int, error) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.clear()
+	n, err := w.out.Write(p)
+	w.draw()
+	return n, err
+}
+
+// SetStatus replaces the status lines, nil removes them
+func (w *StatusWriter) SetStatus(lines []string) {
+	if !w.tty {
+		return
+	}
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.clear()
+	w.status = lines
+	w.draw()
+}
+
+func (w *StatusWriter) clear() {
+	if len(w.status) == 0 {
+		return
+	}
+	_, _ = w.out.WriteString(strings.Repeat("\033[1A\033[2K", len(w.status)))
+}
+
+func (w *StatusWriter) draw() {
+	if len(w.status) == 0 {
+		return
+	}
+	_, _ = w.out.WriteString(strings.Join(w.status, "\n") + "\n")
+}
@@ -15,7 +15,16 @@ func GenerateConfig() error {
 		return fmt.Errorf("config file already exists")
 	}
 	config := Config{
-		General: GeneralConfig{MaxConcurrent: 20, UploadMultiple: 2, LogLevel: int8(zerolog.InfoLevel)},
+		General: GeneralConfig{
+			MaxConcurrent:   20,
+			LogLevel:        int8(zerolog.InfoLevel),
+			MaxAttempts:     5,
+			RetryBaseDelay:  30,
+			RetryMaxDelay:   1800,
+			MemoryBudget:    1024,
+			ShutdownTimeout: 120,
+			Priority:        []string{"status", "newest"},
+		},
 		OneDrive: OneDrive{
 			ClientId:     "your_client_id",
 			ClientSecret: "your_client_secret",
@@ -26,22 +35,31 @@ func GenerateConfig() error {
 			Sayobot: struct {
 				Server string `toml:"server"`
 			}{Server: "auto"},
-			EnableSayobot:  true,
-			EnableNerinyan: true,
-			EnableCatboy:   true,
-			EnableOfficial: true,
-			ProcessTypes:   []string{},
+			EnableSayobot:    true,
+			EnableNerinyan:   true,
+			EnableCatboy:     true,
+			EnableOfficial:   true,
+			ProcessTypes:     []string{},
+			MinSavingPercent: 5,
 		},
 		Path: OneDrivePath{
+			Template:      DefaultPathTemplate,
 			Root:          "your_root",
 			StdPath:       "std",
 			TaikoPath:     "taiko",
 			CatchPath:     "catch",
 			ManiaPath:     "mania",
+			MultiPath:     "multi",
+			MultiMode:     "majority",
 			RankedPath:    "ranked",
 			LovedPath:     "loved",
 			QualifiedPath: "qualified",
-		}}
+		},
+		Storage: StorageConfig{
+			Type: "onedrive",
+			S3:   S3Storage{Region: "us-east-1", LinkExpiry: 168},
+		},
+	}
 	content, err := toml.Marshal(config)
 	if err != nil {
 		return err
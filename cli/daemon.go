@@ -0,0 +1,259 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"github.com/MingxuanGame/OsuBeatmapSync/application"
+	"github.com/MingxuanGame/OsuBeatmapSync/base_service"
+	. "github.com/MingxuanGame/OsuBeatmapSync/model"
+	"github.com/MingxuanGame/OsuBeatmapSync/osu"
+	downloader "github.com/MingxuanGame/OsuBeatmapSync/osu/download"
+	"github.com/MingxuanGame/OsuBeatmapSync/storage"
+	"github.com/robfig/cron/v3"
+	"github.com/rs/zerolog"
+	"os"
+	"time"
+)
+
+const configCheckInterval = 10 * time.Second
+
+// daemon keeps the clients and metadata alive between sync cycles
+type daemon struct {
+	// parent is the context of the daemon, ctx is canceled when the lock of the root is lost
+	parent      context.Context
+	ctx         context.Context
+	lock        *application.Lock
+	forceUnlock bool
+	config      Config
+	configTime  time.Time
+	backend     storage.Backend
+	osuClient   *osu.LegacyOfficialClient
+	downloaders []downloader.BeatmapDownloader
+	metadata    Metadata
+	// since is only used by the first cycle, later cycles continue from the metadata
+	since time.Time
+}
+
+type intervalSchedule time.Duration
+
+func (i intervalSchedule) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(i))
+}
+
+func configModTime() time.Time {
+	info, err := os.Stat(base_service.ConfigPath)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+func (d *daemon) login() error {
+	backend, err := application.OpenStorage(&d.config, d.parent)
+	if err != nil {
+		return err
+	}
+	d.backend = backend
+	// login saves the new token into the config file, it is not a change made by the user
+	d.configTime = configModTime()
+	return nil
+}
+
+func (d *daemon) init() error {
+	var err error
+	d.config, err = base_service.LoadConfig()
+	if err != nil {
+		return err
+	}
+	_, err = d.config.Path.PathTemplate()
+	if err != nil {
+		return err
+	}
+	err = d.config.General.CheckBandwidthSchedule()
+	if err != nil {
+		return err
+	}
+	d.configTime = configModTime()
+	err = d.login()
+	if err != nil {
+		return err
+	}
+	d.lock, d.ctx, err = application.AcquireLock(d.parent, d.backend, d.config.Path.Root, "sync --daemon", d.forceUnlock)
+	if err != nil {
+		return err
+	}
+	d.osuClient = osu.NewLegacyOfficialClient(d.config.Osu.V1ApiKey)
+	d.downloaders, err = newDownloaders(&d.config, d.ctx)
+	if err != nil {
+		return err
+	}
+	d.metadata, err = application.GetMetadata(d.backend, d.config.Path.Root)
+	return err
+}
+
+// reloadConfig applies a changed config file, a broken file is ignored and the old config is kept
+func (d *daemon) reloadConfig() {
+	config, err := base_service.LoadConfigFromFile()
+	if err == nil {
+		_, err = config.Path.PathTemplate()
+	}
+	if err == nil {
+		err = config.General.CheckBandwidthSchedule()
+	}
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to reload config, keep using the old one")
+		d.configTime = configModTime()
+		return
+	}
+	logger.Info().Msg("Config changed, reloading...")
+	old := d.config
+	d.config = config
+	d.configTime = configModTime()
+	base_service.LogLevel = zerolog.Level(config.General.LogLevel)
+	zerolog.SetGlobalLevel(base_service.LogLevel)
+
+	// the lock and metadata live in the storage, it is only changed by a restart
+	if config.Storage != old.Storage {
+		logger.Warn().Msg("Storage changed, restart the daemon to use it")
+		d.config.Storage = old.Storage
+	} else if _, ok := d.backend.(*storage.OneDrive); ok && (config.OneDrive.ClientId != old.OneDrive.ClientId ||
+		config.OneDrive.ClientSecret != old.OneDrive.ClientSecret ||
+		config.OneDrive.Tenant != old.OneDrive.Tenant) {
+		err = d.login()
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to login with the new config")
+		}
+	}
+	if config.Path.Root != old.Path.Root {
+		d.changeRoot(old.Path.Root)
+	}
+	d.osuClient = osu.NewLegacyOfficialClient(config.Osu.V1ApiKey)
+	downloaders, err := newDownloaders(&d.config, d.ctx)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to create downloaders with the new config, keep using the old ones")
+	} else {
+		d.downloaders = downloaders
+	}
+	// published once it is final, with the storage and root that are really used
+	base_service.SetGlobalConfig(d.config)
+}
+
+// changeRoot moves the lock and metadata to the new root, the old root is kept if the new one cannot be used
+func (d *daemon) changeRoot(oldRoot string) {
+	root := d.config.Path.Root
+	lock, ctx, err := application.AcquireLock(d.parent, d.backend, root, "sync --daemon", d.forceUnlock)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to lock the new root, keep using the old one")
+		d.config.Path.Root = oldRoot
+		return
+	}
+	metadata, err := application.GetMetadata(d.backend, root)
+	if err != nil {
+		lock.Release()
+		logger.Error().Err(err).Msg("Failed to get metadata of the new root, keep using the old one")
+		d.config.Path.Root = oldRoot
+		return
+	}
+	d.lock.Release()
+	d.lock, d.ctx, d.metadata = lock, ctx, metadata
+}
+
+func (d *daemon) cycle() error {
+	var needSyncBeatmaps []BeatmapsetMetadata
+	var err error
+	if d.since.IsZero() {
+		needSyncBeatmaps, err = fetchNeedSyncBeatmaps(&d.metadata, d.osuClient, d.ctx, time.Now())
+	} else {
+		// pick up the list left by an interrupted run
+		needSyncBeatmaps, err = getNeedSyncBeatmaps(&d.metadata, d.osuClient, d.ctx, d.since)
+		d.since = time.Time{}
+	}
+	if err != nil {
+		return err
+	}
+	logger.Info().Msgf("Need sync: %d", len(needSyncBeatmaps))
+	if len(needSyncBeatmaps) == 0 {
+		return nil
+	}
+	finished, deadLetters := syncAllBeatmapset(&d.config, &d.metadata, d.backend, d.downloaders, needSyncBeatmaps, d.ctx)
+	err = application.AppendDeadLetters(application.SyncDeadLetterFilename, deadLetters, beatmapsetKey)
+	if err != nil {
+		return err
+	}
+	if !finished {
+		return saveNeedSync("needSync.json", needSyncBeatmaps, &d.metadata, deadLetters)
+	}
+	err = os.Remove("needSync.json")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return uploadMetadata(d.lock, d.backend, d.config.Path.Root, &d.metadata)
+}
+
+// wait sleeps until next, reloading the config when it changes. It returns false when the daemon is stopped.
+func (d *daemon) wait(next time.Time) bool {
+	ticker := time.NewTicker(configCheckInterval)
+	defer ticker.Stop()
+	timer := time.NewTimer(time.Until(next))
+	defer timer.Stop()
+	for {
+		select {
+		case <-d.ctx.Done():
+			return false
+		case <-timer.C:
+			return true
+		case <-ticker.C:
+			if modTime := configModTime(); modTime.After(d.configTime) {
+				d.reloadConfig()
+			}
+		}
+	}
+}
+
+// SyncDaemon syncs beatmaps on every interval, or on a cron schedule if cronExpr is set
+func SyncDaemon(ctx context.Context, interval time.Duration, cronExpr string, since time.Time, forceUnlock bool) error {
+	var schedule cron.Schedule = intervalSchedule(interval)
+	if cronExpr != "" {
+		var err error
+		schedule, err = cron.ParseStandard(cronExpr)
+		if err != nil {
+			return fmt.Errorf("invalid cron expression %q: %w", cronExpr, err)
+		}
+	} else if interval <= 0 {
+		return fmt.Errorf("interval must be positive")
+	}
+
+	d := &daemon{parent: ctx, ctx: ctx, since: since, forceUnlock: forceUnlock}
+	err := d.init()
+	if d.lock != nil {
+		defer func() { d.lock.Release() }()
+	}
+	if err != nil {
+		return err
+	}
+	logger.Info().Msg("Sync daemon started")
+	for {
+		start := time.Now()
+		logger.Info().Msg("Start sync cycle...")
+		err := d.cycle()
+		if err != nil {
+			logger.Error().Err(err).Msg("Sync cycle failed")
+		} else {
+			logger.Info().Msgf("Sync cycle finished in %s", time.Since(start).Round(time.Second))
+		}
+		if d.ctx.Err() != nil {
+			break
+		}
+		next := schedule.Next(time.Now())
+		logger.Info().Msgf("Next sync at %s", next.Format(time.DateTime))
+		if !d.wait(next) {
+			break
+		}
+	}
+	logger.Info().Msg("Sync daemon stopped")
+	err = application.SaveMetadataToLocal(&d.metadata)
+	if err != nil {
+		return err
+	}
+	return d.lock.Err()
+}
@@ -0,0 +1,115 @@
+package cli
+
+import (
+	"context"
+	"github.com/MingxuanGame/OsuBeatmapSync/application"
+	"github.com/MingxuanGame/OsuBeatmapSync/base_service"
+	"github.com/MingxuanGame/OsuBeatmapSync/osu/sync"
+	"maps"
+	"slices"
+	gosync "sync"
+	"sync/atomic"
+)
+
+// migrateSaveInterval is the number of migrated beatmapsets between saves of the local metadata
+const migrateSaveInterval = 100
+
+// MigrateLibrary moves the files on OneDrive to the paths of the current config.
+// The metadata is saved locally while migrating, so running it again resumes an interrupted migration.
+func MigrateLibrary(ctx context.Context, fromRoot string, forceUnlock bool) error {
+	config, err := base_service.LoadConfig()
+	if err != nil {
+		return err
+	}
+	backend, err := application.OpenStorage(&config, ctx)
+	if err != nil {
+		return err
+	}
+	lock, ctx, err := application.AcquireLock(ctx, backend, config.Path.Root, "library migrate", forceUnlock)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+	if fromRoot == "" {
+		fromRoot = config.Path.Root
+	}
+	metadata, err := application.GetMetadata(backend, fromRoot)
+	if err != nil {
+		return err
+	}
+	s, err := sync.NewSyncer(ctx, &metadata, backend, &config)
+	if err != nil {
+		return err
+	}
+
+	var needMigrate []int
+	for _, sid := range slices.Sorted(maps.Keys(metadata.Beatmapsets)) {
+		if s.NeedMigrate(metadata.Beatmapsets[sid]) {
+			needMigrate = append(needMigrate, sid)
+		}
+	}
+	logger.Info().Msgf("Need migrate: %d of %d", len(needMigrate), len(metadata.Beatmapsets))
+	if len(needMigrate) == 0 {
+		return nil
+	}
+	s.Stats.AddTotal(len(needMigrate))
+	defer startProgress("Migrate", s.Stats)()
+
+	var mux gosync.Mutex
+	var failed, migrated atomic.Int64
+	var wg gosync.WaitGroup
+	sem := make(chan struct{}, max(config.General.MaxConcurrent, 1))
+	save := func() {
+		mux.Lock()
+		defer mux.Unlock()
+		err := application.SaveMetadataToLocal(&metadata)
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to save metadata")
+		}
+	}
+feed:
+	for _, sid := range needMigrate {
+		select {
+		case <-ctx.Done():
+			break feed
+		case sem <- struct{}{}:
+		}
+		mux.Lock()
+		beatmapset := metadata.Beatmapsets[sid]
+		mux.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			result, err := s.Migrate(beatmapset)
+			if err != nil {
+				failed.Add(1)
+				s.Stats.Fail()
+				logger.Error().Err(err).Int("sid", sid).Msgf("Failed to migrate %s", beatmapset.String())
+				return
+			}
+			mux.Lock()
+			metadata.Beatmapsets[sid] = result
+			for bid, beatmap := range result.Beatmaps {
+				metadata.Beatmaps[bid] = beatmap
+			}
+			mux.Unlock()
+			s.Stats.Done()
+			if migrated.Add(1)%migrateSaveInterval == 0 {
+				save()
+			}
+		}()
+	}
+	wg.Wait()
+	save()
+
+	if ctx.Err() != nil {
+		logger.Warn().Msgf("Migration interrupted after %d beatmapset(s), run it again to continue", migrated.Load())
+		return nil
+	}
+	logger.Info().Msgf("Migrated: %d, failed: %d", migrated.Load(), failed.Load())
+	if failed.Load() > 0 {
+		logger.Warn().Msg("Failed beatmapsets keep their old paths, run it again to retry them")
+	}
+	return uploadMetadata(lock, backend, config.Path.Root, &metadata)
+}
@@ -7,10 +7,10 @@ import (
 	"github.com/MingxuanGame/OsuBeatmapSync/application"
 	"github.com/MingxuanGame/OsuBeatmapSync/base_service"
 	. "github.com/MingxuanGame/OsuBeatmapSync/metadata"
+	"github.com/MingxuanGame/OsuBeatmapSync/metrics"
 	. "github.com/MingxuanGame/OsuBeatmapSync/model"
-	. "github.com/MingxuanGame/OsuBeatmapSync/model/onedrive"
-	"github.com/MingxuanGame/OsuBeatmapSync/onedrive"
 	"github.com/MingxuanGame/OsuBeatmapSync/osu"
+	"github.com/MingxuanGame/OsuBeatmapSync/storage"
 	"github.com/MingxuanGame/OsuBeatmapSync/utils"
 	"os"
 	"strconv"
@@ -20,20 +20,20 @@ import (
 
 const needMakeListFilename = "needMakeList.json"
 
-func getAllFile(graph *onedrive.GraphClient, root string) ([]DriveItem, error) {
+func getAllFile(backend storage.Backend, root string) ([]storage.Object, error) {
 	logger.Trace().Str("root", root).Msg("Try to get all files from online")
-	allFiles, err := graph.ListAllFiles(root, 200)
+	allFiles, err := backend.List(root)
 	if err != nil {
 		return nil, err
 	}
 	return allFiles, nil
 }
 
-func removeExisted(metadata *Metadata, needMakeList []DriveItem) []DriveItem {
+func removeExisted(template *PathTemplate, metadata *Metadata, needMakeList []storage.Object) []storage.Object {
 	logger.Trace().Msg("Remove existed files")
-	var newNeedMakeList []DriveItem
+	var newNeedMakeList []storage.Object
 	for _, file := range needMakeList {
-		_, _, beatmapsetId := utils.ParseFilename(file.Name)
+		beatmapsetId, _ := ParseItem(template, file)
 		if _, ok := metadata.Beatmapsets[beatmapsetId]; !ok {
 			newNeedMakeList = append(newNeedMakeList, file)
 		}
@@ -41,9 +41,9 @@ func removeExisted(metadata *Metadata, needMakeList []DriveItem) []DriveItem {
 	return newNeedMakeList
 }
 
-func readLocalNeedMakeList(filename string) ([]DriveItem, error, bool) {
+func readLocalNeedMakeList(filename string) ([]storage.Object, error, bool) {
 	logger.Trace().Msgf("Try to read local %s", needMakeListFilename)
-	var needMakeList []DriveItem
+	var needMakeList []storage.Object
 	savedData, err := os.ReadFile(filename)
 	if os.IsNotExist(err) {
 		logger.Trace().Msgf("File %s not found", filename)
@@ -58,26 +58,37 @@ func readLocalNeedMakeList(filename string) ([]DriveItem, error, bool) {
 			return nil, err, false
 		}
 	}
+	// lists saved by old versions have no paths
+	for _, file := range needMakeList {
+		if file.Path == "" {
+			logger.Warn().Msgf("%s is saved by an old version, listing the files again", filename)
+			return nil, nil, false
+		}
+	}
 	return needMakeList, nil, true
 }
 
-func getNeedMakeList(graph *onedrive.GraphClient, root string, metadata *Metadata) ([]DriveItem, error) {
+func getNeedMakeList(backend storage.Backend, root string, template *PathTemplate, metadata *Metadata) ([]storage.Object, error) {
 	logger.Trace().Msg("Try to get need make list")
 	needMakeList, err, ok := readLocalNeedMakeList(needMakeListFilename)
 	if err != nil {
 		return nil, err
 	}
 	if !ok {
-		allFiles, err := getAllFile(graph, root)
+		allFiles, err := getAllFile(backend, root)
 		if err != nil {
 			return nil, err
 		}
 		logger.Info().Msgf("Total: %d", len(allFiles))
 		for _, file := range allFiles {
-			if file.IsFolder() || !strings.HasSuffix(file.Name, ".osz") {
+			if !strings.HasSuffix(file.Name, ".osz") {
+				continue
+			}
+			beatmapsetId, _ := ParseItem(template, file)
+			if beatmapsetId == 0 {
+				logger.Warn().Msgf("Cannot parse beatmapset id from %s, skip", file.Path)
 				continue
 			}
-			_, _, beatmapsetId := utils.ParseFilename(file.Name)
 			if _, ok := metadata.Beatmapsets[beatmapsetId]; !ok {
 				needMakeList = append(needMakeList, file)
 			}
@@ -91,61 +102,104 @@ func getNeedMakeList(graph *onedrive.GraphClient, root string, metadata *Metadat
 			return nil, err
 		}
 	}
-	return removeExisted(metadata, needMakeList), nil
+	return removeExisted(template, metadata, needMakeList), nil
 }
 
-func makeMetadata(g *Generator, needMakeList []DriveItem, ctx context.Context) error {
+// makeMetadata generates the metadata of the files, finished is false if it is interrupted.
+// The metadata and dead letters are saved locally either way.
+func makeMetadata(g *Generator, needMakeList []storage.Object, ctx context.Context) (finished bool, err error) {
 	logger.Info().Msgf("Need to made: %d", len(needMakeList))
 	if len(needMakeList) == 0 {
-		return nil
+		return true, nil
 	}
 	logger.Info().Msg("Start generating...")
+	defer startProgress("Metadata", g.Stats)()
+	metrics.WatchStats("metadata", g.Stats)
+	defer func() {
+		if err == nil {
+			err = application.AppendDeadLetters(application.MetadataDeadLetterFilename, g.DeadLetters, func(item storage.Object) string {
+				return item.Path
+			})
+		}
+	}()
 	g.GenerateExistedFileMetadata(needMakeList)
 	metadata := g.Metadata
-	err := application.SaveMetadataToLocal(metadata)
+	err = application.SaveMetadataToLocal(metadata)
 	if err != nil {
-		return err
+		return false, err
 	}
 	logger.Info().Msgf("Generated: %d", len(metadata.Beatmapsets))
-	for {
-		select {
-		case <-ctx.Done():
-			os.Exit(0)
-		default:
-		}
-		if len(g.Failed) == 0 {
-			break
+	for len(g.Failed) > 0 {
+		if ctx.Err() != nil {
+			return false, nil
 		}
+		wait := time.Until(g.NextRetry())
 		logger.Warn().Msgf("Failed: %d", len(g.Failed))
-		time.Sleep(time.Minute)
-		g.GenerateExistedFileMetadata(g.Failed)
-		err := application.SaveMetadataToLocal(metadata)
+		if wait > 0 {
+			logger.Info().Msgf("Retry in %s...", wait.Round(time.Second))
+			select {
+			case <-ctx.Done():
+				return false, nil
+			case <-time.After(wait):
+			}
+		}
+		g.ReGenerate()
+		err = application.SaveMetadataToLocal(metadata)
 		if err != nil {
-			return err
+			return false, err
 		}
 	}
-	return nil
+	if ctx.Err() != nil {
+		return false, nil
+	}
+	if len(g.DeadLetters) > 0 {
+		logger.Warn().Msgf("Dead letters: %d", len(g.DeadLetters))
+		for _, letter := range g.DeadLetters {
+			logger.Warn().Msgf("  %s (%d attempt(s))", letter.Item.Name, letter.Attempts)
+		}
+	}
+	return true, nil
 }
 
-func MakeMetadata(ctx context.Context, tasks, worker int, start bool) error {
+func MakeMetadata(ctx context.Context, tasks, worker int, start, forceUnlock bool) error {
 	config, err := base_service.LoadConfig()
 	if err != nil {
 		return err
 	}
 
-	client, err := application.Login(&config, ctx)
+	template, err := config.Path.PathTemplate()
+	if err != nil {
+		return err
+	}
+	err = config.General.CheckBandwidthSchedule()
+	if err != nil {
+		return err
+	}
+
+	backend, err := application.OpenStorage(&config, ctx)
+	if err != nil {
+		return err
+	}
+	// only a run that uploads metadata locks the root, the workers of split tasks run side by side
+	var lock *application.Lock
+	if worker == 0 && tasks <= 1 {
+		lock, ctx, err = application.AcquireLock(ctx, backend, config.Path.Root, "metadata make", forceUnlock)
+	} else {
+		lock, ctx, err = application.AcquireLocalLock(ctx, "metadata make", forceUnlock)
+	}
 	if err != nil {
 		return err
 	}
+	defer lock.Release()
 
 	osuClient := osu.NewLegacyOfficialClient(config.Osu.V1ApiKey)
 	logger.Info().Msg("Start making metadata...")
 	root := config.Path.Root
-	metadata, err := application.GetMetadata(client, root)
+	metadata, err := application.GetMetadata(backend, root)
 	if err != nil {
 		return err
 	}
-	needMakeList, err := getNeedMakeList(client, root, &metadata)
+	needMakeList, err := getNeedMakeList(backend, root, template, &metadata)
 	if err != nil {
 		return err
 	}
@@ -166,14 +220,18 @@ func MakeMetadata(ctx context.Context, tasks, worker int, start bool) error {
 			worker = 1
 		}
 	}
-	generator := NewGenerator(osuClient, client, ctx, config.General.MaxConcurrent, &metadata)
+	generator := NewGenerator(osuClient, backend, ctx, &config.General, template, &metadata)
 	if worker == 0 {
 		if len(needMakeList) > 0 {
-			err := makeMetadata(generator, needMakeList, ctx)
+			finished, err := makeMetadata(generator, needMakeList, ctx)
 			if err != nil {
 				return err
 			}
-			err = application.UploadMetadata(client, root, &metadata)
+			if !finished {
+				logger.Warn().Msg("Making metadata interrupted, run it again to continue")
+				return nil
+			}
+			err = uploadMetadata(lock, backend, root, &metadata)
 			if err != nil {
 				return err
 			}
@@ -186,20 +244,24 @@ func MakeMetadata(ctx context.Context, tasks, worker int, start bool) error {
 		if err != nil {
 			return err
 		}
-		needMakeList = removeExisted(&metadata, needMakeList)
+		needMakeList = removeExisted(template, &metadata, needMakeList)
 		if !ok {
 			return fmt.Errorf("no needMakeList file")
 		}
-		err = makeMetadata(generator, needMakeList, ctx)
+		finished, err := makeMetadata(generator, needMakeList, ctx)
 		if err != nil {
 			return err
 		}
+		if !finished {
+			logger.Warn().Msg("Making metadata interrupted, run it again to continue")
+			return nil
+		}
 	}
 	_ = os.Remove("allFiles.json")
 	return nil
 }
 
-func MergeMetadata(ctx context.Context, isUpload bool, files []string) error {
+func MergeMetadata(ctx context.Context, isUpload bool, files []string, forceUnlock bool) error {
 	var mergedMetadata Metadata
 	for _, file := range files {
 		currMetadata, err, ok := application.ReadLocalMetadata(file)
@@ -250,13 +312,26 @@ func MergeMetadata(ctx context.Context, isUpload bool, files []string) error {
 			return err
 		}
 
-		client, err := application.Login(&config, ctx)
-		err = application.UploadMetadata(client, config.Path.Root, &mergedMetadata)
+		backend, err := application.OpenStorage(&config, ctx)
+		if err != nil {
+			return err
+		}
+		lock, _, err := application.AcquireLock(ctx, backend, config.Path.Root, "metadata merge --upload", forceUnlock)
+		if err != nil {
+			return err
+		}
+		defer lock.Release()
+		err = uploadMetadata(lock, backend, config.Path.Root, &mergedMetadata)
 		if err != nil {
 			return err
 		}
 	} else {
-		err := application.SaveMetadataToLocal(&mergedMetadata)
+		lock, _, err := application.AcquireLocalLock(ctx, "metadata merge", forceUnlock)
+		if err != nil {
+			return err
+		}
+		defer lock.Release()
+		err = application.SaveMetadataToLocal(&mergedMetadata)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,93 @@
+package cli
+
+import (
+	"fmt"
+	"github.com/MingxuanGame/OsuBeatmapSync/base_service"
+	"github.com/MingxuanGame/OsuBeatmapSync/stats"
+	"slices"
+	"strings"
+	"time"
+)
+
+const progressInterval = time.Second
+const summaryInterval = 30 * time.Second
+
+// startProgress keeps a live status block under the logs on a TTY, or logs a summary periodically otherwise.
+// The returned function stops it.
+func startProgress(name string, s *stats.Stats) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	tty := base_service.Console.IsTerminal()
+	interval := summaryInterval
+	if tty {
+		interval = progressInterval
+	}
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		last := s.Snapshot()
+		for {
+			select {
+			case <-done:
+				base_service.Console.SetStatus(nil)
+				return
+			case <-ticker.C:
+			}
+			current := s.Snapshot()
+			lines := formatProgress(name, last, current)
+			if tty {
+				base_service.Console.SetStatus(lines)
+			} else {
+				for _, line := range lines {
+					logger.Info().Msg(line)
+				}
+			}
+			last = current
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func formatSpeed(bytes int64, elapsed time.Duration) string {
+	if elapsed <= 0 {
+		return "0.00 MB/s"
+	}
+	return fmt.Sprintf("%.2f MB/s", float64(bytes)/float64(1<<20)/elapsed.Seconds())
+}
+
+func formatProgress(name string, last, current stats.Snapshot) []string {
+	elapsed := current.Time.Sub(last.Time)
+	eta := "unknown"
+	if d := current.ETA(); d > 0 {
+		eta = d.Round(time.Second).String()
+	}
+	lines := []string{fmt.Sprintf("%s: %d/%d done, %d failed, %d remaining, ETA %s",
+		name, current.Done, current.Total, current.Failed, current.Remaining(), eta)}
+
+	if len(current.Downloaded) > 0 || current.Uploaded > 0 {
+		var mirrors []string
+		for mirror := range current.Downloaded {
+			mirrors = append(mirrors, mirror)
+		}
+		slices.Sort(mirrors)
+		var speeds []string
+		for _, mirror := range mirrors {
+			speeds = append(speeds, fmt.Sprintf("%s %s", mirror, formatSpeed(current.Downloaded[mirror]-last.Downloaded[mirror], elapsed)))
+		}
+		lines = append(lines, fmt.Sprintf("Download: %s | Upload: %s",
+			strings.Join(speeds, ", "), formatSpeed(current.Uploaded-last.Uploaded, elapsed)))
+	}
+
+	if len(current.Stages) > 0 {
+		var depths []string
+		for _, stage := range current.Stages {
+			depths = append(depths, fmt.Sprintf("%s %d", stage, current.Depth[stage]))
+		}
+		lines = append(lines, "Queue: "+strings.Join(depths, ", "))
+	}
+	return lines
+}
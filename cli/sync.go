@@ -6,47 +6,130 @@ import (
 	"fmt"
 	"github.com/MingxuanGame/OsuBeatmapSync/application"
 	"github.com/MingxuanGame/OsuBeatmapSync/base_service"
+	"github.com/MingxuanGame/OsuBeatmapSync/metrics"
 	. "github.com/MingxuanGame/OsuBeatmapSync/model"
-	"github.com/MingxuanGame/OsuBeatmapSync/onedrive"
 	"github.com/MingxuanGame/OsuBeatmapSync/osu"
 	downloader "github.com/MingxuanGame/OsuBeatmapSync/osu/download"
 	"github.com/MingxuanGame/OsuBeatmapSync/osu/sync"
+	"github.com/MingxuanGame/OsuBeatmapSync/storage"
 	"github.com/MingxuanGame/OsuBeatmapSync/utils"
+	"github.com/MingxuanGame/OsuBeatmapSync/webhook"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
+	"unicode"
 )
 
-func syncAllBeatmapset(config *Config, metadata *Metadata, graph *onedrive.GraphClient, downloaders []downloader.BeatmapDownloader, needSyncBeatmaps []BeatmapsetMetadata, ctx context.Context) bool {
+func syncAllBeatmapset(config *Config, metadata *Metadata, backend storage.Backend, downloaders []downloader.BeatmapDownloader, needSyncBeatmaps []BeatmapsetMetadata, ctx context.Context) (finished bool, deadLetters []utils.RetryState[BeatmapsetMetadata]) {
 
-	s := sync.NewSyncer(ctx, metadata, graph, config)
+	s, err := sync.NewSyncer(ctx, metadata, backend, config)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to create syncer")
+		return false, nil
+	}
+	defer startProgress("Sync", s.Stats)()
+	metrics.WatchStats("sync", s.Stats)
+
+	notifier := webhook.NewNotifier(config.Webhooks)
+	defer notifier.Close()
+	s.Notifier = notifier
+	notifier.Emit(webhook.Event{Type: webhook.RunStarted, Run: "sync", Summary: &webhook.Summary{Total: int64(len(needSyncBeatmaps))}})
+	defer func() {
+		snapshot := s.Stats.Snapshot()
+		event := webhook.Event{Type: webhook.RunFinished, Run: "sync", Summary: &webhook.Summary{
+			Total:       int64(len(needSyncBeatmaps)),
+			Done:        snapshot.Done,
+			Failed:      snapshot.Failed,
+			DeadLetters: len(deadLetters),
+			Finished:    finished,
+			Duration:    snapshot.Time.Sub(snapshot.Started).Seconds(),
+		}}
+		if fatal := s.FatalError(); fatal != nil {
+			event.Error = fatal.Error()
+		}
+		notifier.Emit(event)
+	}()
+	priority, err := config.General.SyncPriority()
+	if err != nil {
+		logger.Error().Err(err).Msg("Invalid sync priority")
+		return false, nil
+	}
+	priority.Sort(needSyncBeatmaps)
 	s.SyncNewBeatmap(downloaders, needSyncBeatmaps)
 
-	err := application.SaveMetadataToLocal(s.Metadata)
+	err = application.SaveMetadataToLocal(s.Metadata)
 	if err != nil {
-		return false
+		return false, s.DeadLetters
 	}
 	for {
 		select {
 		case <-ctx.Done():
-			return false
+			return false, s.DeadLetters
 		default:
 		}
 
+		if fatal := s.FatalError(); fatal != nil {
+			logger.Error().Err(fatal).Msg("Sync stopped because of a fatal error")
+			return false, s.DeadLetters
+		}
 		if len(s.Failed) == 0 {
 			break
 		}
+		wait := time.Until(s.NextRetry())
 		logger.Info().Msgf("Failed: %d", len(s.Failed))
-		logger.Info().Msg("Retry in 1 minute...")
-		time.Sleep(time.Minute)
+		if wait > 0 {
+			logger.Info().Msgf("Retry in %s...", wait.Round(time.Second))
+			select {
+			case <-ctx.Done():
+				return false, s.DeadLetters
+			case <-time.After(wait):
+			}
+		}
 		s.ReSync(downloaders)
 		err := application.SaveMetadataToLocal(s.Metadata)
 		if err != nil {
 			logger.Error().Err(err).Msg("Failed to save metadata")
-			return false
+			return false, s.DeadLetters
+		}
+	}
+	if len(s.DeadLetters) > 0 {
+		logger.Warn().Msgf("Dead letters: %d", len(s.DeadLetters))
+		for _, letter := range s.DeadLetters {
+			logger.Warn().Int("sid", letter.Item.BeatmapsetId).Msgf("  %s (%d attempt(s))", letter.Item.String(), letter.Attempts)
 		}
 	}
-	return true
+	return true, s.DeadLetters
+}
+
+func beatmapsetKey(beatmapset BeatmapsetMetadata) int {
+	return beatmapset.BeatmapsetId
+}
+
+// saveNeedSync saves the beatmapsets of the list that are not synced yet,
+// dead letters are left out because they are kept in the dead-letter file
+func saveNeedSync(filename string, needSync []BeatmapsetMetadata, metadata *Metadata, deadLetters []utils.RetryState[BeatmapsetMetadata]) error {
+	dead := make(map[int]bool, len(deadLetters))
+	for _, letter := range deadLetters {
+		dead[letter.Item.BeatmapsetId] = true
+	}
+	remaining := make([]BeatmapsetMetadata, 0)
+	for _, info := range needSync {
+		if dead[info.BeatmapsetId] {
+			continue
+		}
+		if synced, ok := metadata.Beatmapsets[info.BeatmapsetId]; ok && info.Equal(synced) {
+			continue
+		}
+		remaining = append(remaining, info)
+	}
+	logger.Info().Msgf("Saving %d remaining beatmapset(s) to %s", len(remaining), filename)
+	data, err := json.Marshal(remaining)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, data, 0644)
 }
 
 func getNeedSyncBeatmapsLocal(filename string, metadata *Metadata) ([]BeatmapsetMetadata, error, bool) {
@@ -83,7 +166,12 @@ func getNeedSyncBeatmaps(metadata *Metadata, osuClient *osu.LegacyOfficialClient
 	if ok {
 		return needSyncBeatmaps, nil
 	}
+	return fetchNeedSyncBeatmaps(metadata, osuClient, ctx, since)
+}
 
+// fetchNeedSyncBeatmaps asks osu! API for beatmapsets changed since the oldest game mode update time
+func fetchNeedSyncBeatmaps(metadata *Metadata, osuClient *osu.LegacyOfficialClient, ctx context.Context, since time.Time) ([]BeatmapsetMetadata, error) {
+	var needSyncBeatmaps []BeatmapsetMetadata
 	lastTime := since
 	for _, mode := range metadata.GameMode {
 		modeTime := time.Unix(mode.UpdateTime, 0)
@@ -111,18 +199,37 @@ func getNeedSyncBeatmaps(metadata *Metadata, osuClient *osu.LegacyOfficialClient
 	return needSyncBeatmaps, nil
 }
 
-func SyncBeatmaps(ctx context.Context, tasks, worker int, start bool, since time.Time) error {
+func SyncBeatmaps(ctx context.Context, tasks, worker int, start bool, since time.Time, forceUnlock bool) error {
 	config, err := base_service.LoadConfig()
 	if err != nil {
 		return err
 	}
+	_, err = config.Path.PathTemplate()
+	if err != nil {
+		return err
+	}
+	priority, err := config.General.SyncPriority()
+	if err != nil {
+		return err
+	}
 
 	osuClient := osu.NewLegacyOfficialClient(config.Osu.V1ApiKey)
-	client, err := application.Login(&config, ctx)
+	backend, err := application.OpenStorage(&config, ctx)
+	if err != nil {
+		return err
+	}
+	// only a run that uploads metadata locks the root, the workers of split tasks run side by side
+	var lock *application.Lock
+	if worker == 0 && tasks <= 1 {
+		lock, ctx, err = application.AcquireLock(ctx, backend, config.Path.Root, "sync", forceUnlock)
+	} else {
+		lock, ctx, err = application.AcquireLocalLock(ctx, "sync", forceUnlock)
+	}
 	if err != nil {
 		return err
 	}
-	metadata, err := application.GetMetadata(client, config.Path.Root)
+	defer lock.Release()
+	metadata, err := application.GetMetadata(backend, config.Path.Root)
 	if err != nil {
 		return err
 	}
@@ -141,8 +248,9 @@ func SyncBeatmaps(ctx context.Context, tasks, worker int, start bool, since time
 			}
 		}
 		logger.Info().Msgf("Need sync: %d", len(needSyncBeatmaps))
+		priority.Sort(needSyncBeatmaps)
 		if tasks > 1 {
-			taskList := utils.SplitSlice(needSyncBeatmaps, tasks)
+			taskList := utils.DealSlice(needSyncBeatmaps, tasks)
 			for i, task := range taskList {
 				taskJson, err := json.Marshal(task)
 				if err != nil {
@@ -166,6 +274,56 @@ func SyncBeatmaps(ctx context.Context, tasks, worker int, start bool, since time
 		}
 	}
 
+	downloaders, err := newDownloaders(&config, ctx)
+	if err != nil {
+		return err
+	}
+	logger.Info().Msg("Start Syncing...")
+	if worker == 0 {
+		finished, deadLetters := syncAllBeatmapset(&config, &metadata, backend, downloaders, needSyncBeatmaps, ctx)
+		err := application.AppendDeadLetters(application.SyncDeadLetterFilename, deadLetters, beatmapsetKey)
+		if err != nil {
+			return err
+		}
+		if !finished {
+			logger.Warn().Msg("Sync interrupted, run it again to continue")
+			return saveNeedSync("needSync.json", needSyncBeatmaps, &metadata, deadLetters)
+		}
+		err = uploadMetadata(lock, backend, config.Path.Root, &metadata)
+		if err != nil {
+			return err
+		}
+		err = os.Remove("needSync.json")
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else if start {
+		logger.Info().Msgf("Current worker: %d", worker)
+		needSyncBeatmaps, err, ok := getNeedSyncBeatmapsLocal("needSync"+strconv.Itoa(worker)+".json", &metadata)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("no needSync file")
+		}
+		finished, deadLetters := syncAllBeatmapset(&config, &metadata, backend, downloaders, needSyncBeatmaps, ctx)
+		err = application.AppendDeadLetters(application.SyncDeadLetterFilename, deadLetters, beatmapsetKey)
+		if err != nil {
+			return err
+		}
+		if !finished {
+			logger.Warn().Msg("Sync interrupted, run it again to continue")
+			return saveNeedSync("needSync"+strconv.Itoa(worker)+".json", needSyncBeatmaps, &metadata, deadLetters)
+		}
+	}
+
+	logger.Info().Msg("Sync finished...")
+	return nil
+}
+
+func newDownloaders(config *Config, ctx context.Context) ([]downloader.BeatmapDownloader, error) {
+	// downloads already started are finished on the first interrupt signal
+	ctx = application.HardContext(ctx)
 	var downloaders []downloader.BeatmapDownloader
 	if config.Osu.EnableSayobot {
 		downloaders = append(downloaders, downloader.NewSayobotDownloader(config.Osu.Sayobot.Server, ctx))
@@ -179,7 +337,7 @@ func SyncBeatmaps(ctx context.Context, tasks, worker int, start bool, since time
 	if config.Osu.EnableOfficial {
 		d, err := downloader.NewOfficialDownloader(ctx, config.Osu.OfficialDownloader.AccessToken, config.Osu.OfficialDownloader.RefreshToken)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		downloaders = append(downloaders, d)
 
@@ -192,38 +350,172 @@ func SyncBeatmaps(ctx context.Context, tasks, worker int, start bool, since time
 			logger.Info().Msgf("  %s", _downloader.Name())
 		}
 	}
-	logger.Info().Msg("Start Syncing...")
-	if worker == 0 {
-		finished := syncAllBeatmapset(&config, &metadata, client, downloaders, needSyncBeatmaps, ctx)
-		if finished {
-			err := application.UploadMetadata(client, config.Path.Root, &metadata)
+	return downloaders, nil
+}
+
+// RetryDeadLetters re-queues the beatmapsets in the dead-letter file with a fresh attempt count
+func RetryDeadLetters(ctx context.Context, forceUnlock bool) error {
+	letters, err := application.ReadDeadLetters[BeatmapsetMetadata](application.SyncDeadLetterFilename)
+	if err != nil {
+		return err
+	}
+	if len(letters) == 0 {
+		logger.Info().Msg("No dead letters to retry")
+		return nil
+	}
+	config, err := base_service.LoadConfig()
+	if err != nil {
+		return err
+	}
+	backend, err := application.OpenStorage(&config, ctx)
+	if err != nil {
+		return err
+	}
+	lock, ctx, err := application.AcquireLock(ctx, backend, config.Path.Root, "sync retry-dead", forceUnlock)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+	metadata, err := application.GetMetadata(backend, config.Path.Root)
+	if err != nil {
+		return err
+	}
+	downloaders, err := newDownloaders(&config, ctx)
+	if err != nil {
+		return err
+	}
+
+	history := make(map[int][]utils.FailureRecord)
+	var needSyncBeatmaps []BeatmapsetMetadata
+	for _, letter := range letters {
+		history[letter.Item.BeatmapsetId] = letter.Errors
+		needSyncBeatmaps = append(needSyncBeatmaps, letter.Item)
+	}
+	logger.Info().Msgf("Retry dead letters: %d", len(needSyncBeatmaps))
+	finished, deadLetters := syncAllBeatmapset(&config, &metadata, backend, downloaders, needSyncBeatmaps, ctx)
+	if !finished {
+		return application.AppendDeadLetters(application.SyncDeadLetterFilename, deadLetters, beatmapsetKey)
+	}
+	for i, letter := range deadLetters {
+		deadLetters[i].Errors = append(history[letter.Item.BeatmapsetId], letter.Errors...)
+	}
+	err = application.SaveDeadLetters(application.SyncDeadLetterFilename, deadLetters)
+	if err != nil {
+		return err
+	}
+	err = uploadMetadata(lock, backend, config.Path.Root, &metadata)
+	if err != nil {
+		return err
+	}
+	logger.Info().Msgf("Recovered: %d, still dead: %d", len(letters)-len(deadLetters), len(deadLetters))
+	return nil
+}
+
+// ReadIdsFile reads beatmapset ids separated by whitespace or commas, lines starting with # are ignored
+func ReadIdsFile(filename string) ([]int, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, field := range strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r)
+		}) {
+			id, err := strconv.Atoi(field)
 			if err != nil {
-				return err
+				return nil, fmt.Errorf("invalid beatmapset id %q in %s", field, filename)
 			}
+			ids = append(ids, id)
 		}
-	} else if start {
-		logger.Info().Msgf("Current worker: %d", worker)
-		needSyncBeatmaps, err, ok := getNeedSyncBeatmapsLocal("needSync"+strconv.Itoa(worker)+".json", &metadata)
-		if err != nil {
-			return err
-		}
+	}
+	return ids, nil
+}
+
+// SyncBeatmapsById syncs the given beatmapsets, skipping the unchanged ones unless force is set
+func SyncBeatmapsById(ctx context.Context, ids []int, force, forceUnlock bool) error {
+	slices.Sort(ids)
+	ids = slices.Compact(ids)
+	if len(ids) == 0 {
+		return fmt.Errorf("no beatmapset id specified")
+	}
+	config, err := base_service.LoadConfig()
+	if err != nil {
+		return err
+	}
+	_, err = config.Path.PathTemplate()
+	if err != nil {
+		return err
+	}
+	_, err = config.General.SyncPriority()
+	if err != nil {
+		return err
+	}
+
+	osuClient := osu.NewLegacyOfficialClient(config.Osu.V1ApiKey)
+	backend, err := application.OpenStorage(&config, ctx)
+	if err != nil {
+		return err
+	}
+	lock, ctx, err := application.AcquireLock(ctx, backend, config.Path.Root, "sync --ids", forceUnlock)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+	metadata, err := application.GetMetadata(backend, config.Path.Root)
+	if err != nil {
+		return err
+	}
+
+	logger.Info().Msgf("Getting %d beatmapset(s)", len(ids))
+	beatmapsets, missing, err := application.GetBeatmapsetsById(ctx, osuClient, ids)
+	if err != nil {
+		return err
+	}
+	for _, id := range missing {
+		logger.Warn().Int("sid", id).Msg("Beatmapset is not found on osu!, skip")
+	}
+	var needSyncBeatmaps []BeatmapsetMetadata
+	for _, id := range ids {
+		info, ok := beatmapsets[id]
 		if !ok {
-			return fmt.Errorf("no needSync file")
+			continue
 		}
-		finished := syncAllBeatmapset(&config, &metadata, client, downloaders, needSyncBeatmaps, ctx)
-		if !finished {
-			saveNeedSync, err := json.Marshal(needSyncBeatmaps)
-			if err != nil {
-				return err
-			}
-			err = os.WriteFile("needSync"+strconv.Itoa(worker)+".json", saveNeedSync, 0644)
-			if err != nil {
-				return err
-			}
-			return nil
+		if existed, ok := metadata.Beatmapsets[id]; ok && !force && info.Equal(existed) {
+			logger.Info().Int("sid", id).Msgf("Beatmapset %s is unchanged, skip (use --force to sync anyway)", info.String())
+			continue
 		}
+		needSyncBeatmaps = append(needSyncBeatmaps, info)
+	}
+	logger.Info().Msgf("Need sync: %d", len(needSyncBeatmaps))
+	if len(needSyncBeatmaps) == 0 {
+		return nil
 	}
 
-	logger.Info().Msg("Sync finished...")
-	return nil
+	downloaders, err := newDownloaders(&config, ctx)
+	if err != nil {
+		return err
+	}
+	finished, deadLetters := syncAllBeatmapset(&config, &metadata, backend, downloaders, needSyncBeatmaps, ctx)
+	err = application.AppendDeadLetters(application.SyncDeadLetterFilename, deadLetters, beatmapsetKey)
+	if err != nil {
+		return err
+	}
+	if !finished {
+		return nil
+	}
+	return uploadMetadata(lock, backend, config.Path.Root, &metadata)
+}
+
+// uploadMetadata uploads the metadata unless the lock is lost, another run may own the root then
+func uploadMetadata(lock *application.Lock, backend storage.Backend, root string, metadata *Metadata) error {
+	err := lock.Err()
+	if err != nil {
+		return fmt.Errorf("metadata is not uploaded: %w", err)
+	}
+	return application.UploadMetadata(backend, root, metadata)
 }
@@ -8,6 +8,7 @@ import (
 	"github.com/MingxuanGame/OsuBeatmapSync/application"
 	"github.com/MingxuanGame/OsuBeatmapSync/base_service"
 	cli2 "github.com/MingxuanGame/OsuBeatmapSync/cli"
+	"github.com/MingxuanGame/OsuBeatmapSync/metrics"
 	"github.com/MingxuanGame/OsuBeatmapSync/onedrive/quickxorhash"
 	"github.com/MingxuanGame/OsuBeatmapSync/utils/beatmap_processing"
 	"github.com/urfave/cli/v3"
@@ -16,6 +17,16 @@ import (
 	"time"
 )
 
+var metricsAddrFlag = &cli.StringFlag{Name: "metrics-addr", Usage: "serve Prometheus metrics on the address, like :9100"}
+
+var forceUnlockFlag = &cli.BoolFlag{Name: "force-unlock", Usage: "take over the lock of another run, only when it is not running anymore"}
+
+func serveMetrics(ctx context.Context, cmd *cli.Command) {
+	if addr := cmd.String("metrics-addr"); addr != "" {
+		metrics.Serve(ctx, addr)
+	}
+}
+
 func main() {
 	base_service.CreateLog()
 	defer func(logFile *os.File) {
@@ -110,9 +121,12 @@ func main() {
 							&cli.BoolFlag{Name: "start", Aliases: []string{"s"}, Value: false, Usage: "when execute sub-task, start worker"},
 							&cli.IntFlag{Name: "tasks", Aliases: []string{"t"}, Value: 1, Usage: "split tasks into n files"},
 							&cli.IntFlag{Name: "worker", Aliases: []string{"w"}, Value: 0, Usage: "execute sub-task from n file"},
+							metricsAddrFlag,
+							forceUnlockFlag,
 						},
 						Action: func(ctx context.Context, cmd *cli.Command) error {
-							return cli2.MakeMetadata(ctx, int(cmd.Int("tasks")), int(cmd.Int("worker")), cmd.Bool("start"))
+							serveMetrics(ctx, cmd)
+							return cli2.MakeMetadata(ctx, int(cmd.Int("tasks")), int(cmd.Int("worker")), cmd.Bool("start"), cmd.Bool("force-unlock"))
 						},
 					},
 					{
@@ -120,9 +134,10 @@ func main() {
 						Usage: "merge metadata files",
 						Flags: []cli.Flag{
 							&cli.BoolFlag{Name: "upload", Aliases: []string{"u"}, Value: false, Usage: "upload merged metadata to OneDrive"},
+							forceUnlockFlag,
 						},
 						Action: func(ctx context.Context, cmd *cli.Command) error {
-							return cli2.MergeMetadata(ctx, cmd.Bool("upload"), cmd.Args().Slice())
+							return cli2.MergeMetadata(ctx, cmd.Bool("upload"), cmd.Args().Slice(), cmd.Bool("force-unlock"))
 						},
 					},
 				},
@@ -130,7 +145,9 @@ func main() {
 				Name:  "sync",
 				Usage: "sync all beatmaps",
 				Flags: []cli.Flag{
-					//&cli.BoolFlag{Name: "force", Aliases: []string{"f"}, Value: false},
+					&cli.BoolFlag{Name: "force", Aliases: []string{"f"}, Value: false, Usage: "with --ids or --ids-file, sync beatmapsets even if they are unchanged"},
+					&cli.IntSliceFlag{Name: "ids", Usage: "sync only the beatmapsets with the ids, like 123,456"},
+					&cli.StringFlag{Name: "ids-file", Usage: "sync only the beatmapsets with the ids in the file, one or more per line"},
 					&cli.BoolFlag{Name: "start", Aliases: []string{"s"}, Value: false, Usage: "when execute sub-task, start worker"},
 					&cli.IntFlag{Name: "tasks", Aliases: []string{"t"}, Value: 1, Usage: "split tasks into n files"},
 					&cli.IntFlag{Name: "worker", Aliases: []string{"w"}, Value: 0, Usage: "execute sub-task from n file"},
@@ -138,14 +155,73 @@ func main() {
 						Timezone: time.Local,
 						Layouts:  []string{time.DateTime, time.DateOnly, time.RFC3339},
 					}, Usage: "sync beatmaps since the specified time", Value: time.Now()},
+					&cli.BoolFlag{Name: "daemon", Aliases: []string{"d"}, Value: false, Usage: "keep running and sync on a schedule"},
+					&cli.DurationFlag{Name: "interval", Aliases: []string{"i"}, Value: 30 * time.Minute, Usage: "time between syncs in daemon mode"},
+					&cli.StringFlag{Name: "cron", Usage: "cron expression for syncs in daemon mode, overrides interval"},
+					metricsAddrFlag,
+					forceUnlockFlag,
 				},
 				Action: func(ctx context.Context, cmd *cli.Command) error {
-					err := cli2.SyncBeatmaps(ctx, int(cmd.Int("tasks")), int(cmd.Int("worker")), cmd.Bool("start"), cmd.Timestamp("since"))
+					serveMetrics(ctx, cmd)
+					if cmd.IsSet("ids") || cmd.IsSet("ids-file") {
+						if cmd.Bool("daemon") || cmd.Int("tasks") > 1 || cmd.Int("worker") != 0 {
+							return fmt.Errorf("--ids and --ids-file cannot be used with daemon, tasks or worker")
+						}
+						var ids []int
+						for _, id := range cmd.IntSlice("ids") {
+							ids = append(ids, int(id))
+						}
+						if file := cmd.String("ids-file"); file != "" {
+							fileIds, err := cli2.ReadIdsFile(file)
+							if err != nil {
+								return err
+							}
+							ids = append(ids, fileIds...)
+						}
+						return cli2.SyncBeatmapsById(ctx, ids, cmd.Bool("force"), cmd.Bool("force-unlock"))
+					}
+					if cmd.Bool("force") {
+						return fmt.Errorf("--force needs --ids or --ids-file")
+					}
+					if cmd.Bool("daemon") {
+						if cmd.Int("tasks") > 1 || cmd.Int("worker") != 0 {
+							return fmt.Errorf("daemon mode cannot be used with tasks or worker")
+						}
+						return cli2.SyncDaemon(ctx, cmd.Duration("interval"), cmd.String("cron"), cmd.Timestamp("since"), cmd.Bool("force-unlock"))
+					}
+					err := cli2.SyncBeatmaps(ctx, int(cmd.Int("tasks")), int(cmd.Int("worker")), cmd.Bool("start"), cmd.Timestamp("since"), cmd.Bool("force-unlock"))
 					if err != nil {
 						return err
 					}
 					return nil
 				},
+				Commands: []*cli.Command{
+					{
+						Name:  "retry-dead",
+						Usage: "re-queue beatmapsets in the dead-letter file",
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+							serveMetrics(ctx, cmd)
+							return cli2.RetryDeadLetters(ctx, cmd.Bool("force-unlock"))
+						},
+					},
+				},
+			},
+			{
+				Name:  "library",
+				Usage: "manage beatmap files on OneDrive",
+				Commands: []*cli.Command{
+					{
+						Name:  "migrate",
+						Usage: "move files to the paths of the current config",
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "from-root", Usage: "read metadata from the old root when root is changed"},
+							forceUnlockFlag,
+						},
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+							return cli2.MigrateLibrary(ctx, cmd.String("from-root"), cmd.Bool("force-unlock"))
+						},
+					},
+				},
 			},
 			{
 				Name:  "tool",
@@ -189,14 +265,18 @@ func main() {
 									process = append(process, beatmap_processing.NewNoBackgroundProcessor())
 								}
 								for _, typ := range process {
-									processed, err := beatmap_processing.Process(typ, data)
+									result, err := beatmap_processing.ProcessWithResult(typ, data)
+									if err != nil {
+										fmt.Println(err)
+										continue
+									}
 									filename := fmt.Sprintf("%s [%s].osz", strings.TrimSuffix(arg, ".osz"), typ)
-									err = os.WriteFile(filename, processed, 0666)
+									err = os.WriteFile(filename, result.Data, 0666)
 									if err != nil {
 										fmt.Println(err)
 										continue
 									}
-									fmt.Printf("Processed: %s\n", filename)
+									fmt.Printf("Processed: %s (removed %d file(s), saved %d bytes)\n", filename, result.Removed, result.Saved)
 								}
 							}
 							return nil
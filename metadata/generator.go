@@ -2,59 +2,88 @@ package metadata
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/MingxuanGame/OsuBeatmapSync/metrics"
 	. "github.com/MingxuanGame/OsuBeatmapSync/model"
-	. "github.com/MingxuanGame/OsuBeatmapSync/model/onedrive"
-	"github.com/MingxuanGame/OsuBeatmapSync/onedrive"
 	"github.com/MingxuanGame/OsuBeatmapSync/osu"
+	"github.com/MingxuanGame/OsuBeatmapSync/stats"
+	"github.com/MingxuanGame/OsuBeatmapSync/storage"
 	"github.com/MingxuanGame/OsuBeatmapSync/utils"
 	"github.com/rs/zerolog/log"
-	"strings"
+	"strconv"
 	"sync"
+	"time"
 )
 
 type Generator struct {
-	client *osu.LegacyOfficialClient
-	ctx    context.Context
-	graph  *onedrive.GraphClient
+	client  *osu.LegacyOfficialClient
+	ctx     context.Context
+	backend storage.Backend
+	// template parses the beatmapset id and the variant type from the path of a file
+	template *PathTemplate
 
-	Failed   []DriveItem
-	Metadata *Metadata
+	Failed []storage.Object
+	// DeadLetters are files that failed for good or ran out of attempts, they are not retried
+	DeadLetters []utils.RetryState[storage.Object]
+	Metadata    *Metadata
+	Stats       *stats.Stats
 
-	sem chan struct{}
-	mux sync.RWMutex
+	sem   chan struct{}
+	mux   sync.RWMutex
+	retry *utils.RetryTracker[string, storage.Object]
 }
 
 var logger = log.With().Str("module", "metadata").Logger()
 
-func NewGenerator(client *osu.LegacyOfficialClient, graph *onedrive.GraphClient, ctx context.Context, maxConcurrency int, metadata *Metadata) *Generator {
+const stageGenerate = "generate"
+
+// linkBatchSize is the number of files whose links are made together, the most one Graph $batch accepts
+const linkBatchSize = 20
+
+func NewGenerator(client *osu.LegacyOfficialClient, backend storage.Backend, ctx context.Context, config *GeneralConfig, template *PathTemplate, metadata *Metadata) *Generator {
+	maxAttempts, baseDelay, maxDelay := config.RetryPolicy()
 	return &Generator{
 		client:   client,
 		ctx:      ctx,
-		graph:    graph,
-		sem:      make(chan struct{}, maxConcurrency),
+		backend:  backend,
+		template: template,
+		sem:      make(chan struct{}, config.MaxConcurrent),
 		Metadata: metadata,
+		retry:    utils.NewRetryTracker[string, storage.Object](maxAttempts, baseDelay, maxDelay),
+		Stats:    stats.New(stageGenerate),
 	}
 }
 
-func (g *Generator) generateSingle(item DriveItem) (typ string, beatmaps []BeatmapMetadata, err error) {
-	filename := item.Name
+// ParseItem returns the beatmapset id and the variant type of a file, the id is 0 if it cannot be parsed.
+// Files that do not match the template are parsed with the default layout.
+func ParseItem(template *PathTemplate, item storage.Object) (beatmapsetId int, typ string) {
+	if values, ok := template.Parse(item.Path); ok {
+		beatmapsetId, _ = strconv.Atoi(values["sid"])
+		return beatmapsetId, values["type"]
+	}
+	_, _, beatmapsetId = utils.ParseFilename(item.Name)
+	fileStruct, _ := ParseFilenameStruct(item.Path)
+	if fileStruct != nil {
+		typ = fileStruct.Type
+	}
+	return
+}
+
+func (g *Generator) generateSingle(item storage.Object, link string) (typ string, beatmaps []BeatmapMetadata, err error) {
 	var result []BeatmapMetadata
-	_, _, beatmapsetId := utils.ParseFilename(filename)
-	apiData, err := g.client.GetBeatmapBySetId(beatmapsetId)
-	if err != nil {
-		return "", nil, err
+	beatmapsetId, beatmapType := ParseItem(g.template, item)
+	if beatmapType == "" {
+		beatmapType = "full"
 	}
-	path := item.ParentReference.Path + "/" + item.Name
-	fileStruct, err := ParseFilenameStruct(path)
+	apiData, err := g.client.GetBeatmapBySetId(beatmapsetId)
 	if err != nil {
 		return "", nil, err
 	}
-	beatmapType := fileStruct.Type
-	link, err := g.graph.MakeShareLink(item.Id)
-	if err != nil {
-		return "", nil, err
+	if len(*apiData) == 0 {
+		return "", nil, NewRequestError(ErrorNotFound, "osu", "", 0, fmt.Errorf("beatmapset %d not found", beatmapsetId))
 	}
+	path := item.Path
 	for _, data := range *apiData {
 		metadata := BeatmapMetadata{
 			Beatmap:        data,
@@ -72,101 +101,162 @@ func (g *Generator) generateSingle(item DriveItem) (typ string, beatmaps []Beatm
 	return beatmapType, result, nil
 }
 
-func (g *Generator) GenerateExistedFileMetadata(files []DriveItem) {
-	g.Failed = make([]DriveItem, 0)
+func (g *Generator) fail(file storage.Object, err error) {
+	if errors.Is(err, context.Canceled) {
+		g.mux.Lock()
+		g.Failed = append(g.Failed, file)
+		g.mux.Unlock()
+		return
+	}
+	metrics.Failures.WithLabelValues("metadata", GetErrorType(err).String()).Inc()
+	retry, state := g.retry.Fail(file.Path, file, GetErrorType(err).String(), err, GetErrorType(err) == ErrorNotFound)
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	if !retry {
+		g.Stats.Fail()
+		g.DeadLetters = append(g.DeadLetters, state)
+		logger.Error().Err(err).Msgf("Failed to make metadata: %s after %d attempt(s), giving up", file.Name, state.Attempts)
+		return
+	}
+	g.Failed = append(g.Failed, file)
+	logger.Warn().Err(err).Msgf("Failed to make metadata: %s (attempt %d)", file.Name, state.Attempts)
+}
+
+// NextRetry returns the earliest time one of the failed files may be retried
+func (g *Generator) NextRetry() time.Time {
+	var next time.Time
+	for _, file := range g.Failed {
+		retryTime := g.retry.NextRetry(file.Path)
+		if next.IsZero() || retryTime.Before(next) {
+			next = retryTime
+		}
+	}
+	return next
+}
+
+// ReGenerate retries the failed files whose backoff has expired
+func (g *Generator) ReGenerate() {
+	var due, waiting []storage.Object
+	now := time.Now()
+	for _, file := range g.Failed {
+		if g.retry.NextRetry(file.Path).After(now) {
+			waiting = append(waiting, file)
+		} else {
+			due = append(due, file)
+		}
+	}
+	g.Failed = waiting
+	g.generate(due)
+}
+
+func (g *Generator) GenerateExistedFileMetadata(files []storage.Object) {
+	g.Failed = make([]storage.Object, 0)
+	g.Stats.AddTotal(len(files))
+	g.generate(files)
+}
+
+func (g *Generator) generate(files []storage.Object) {
 	var wg sync.WaitGroup
-	for _, file := range files {
+feed:
+	for start := 0; start < len(files); start += linkBatchSize {
 		select {
 		case <-g.ctx.Done():
+			// the started tasks are waited for, so the metadata is complete when it is saved
 			logger.Info().Msg("Context canceled, stopping task creation.")
-			return
+			break feed
 		default:
 		}
 
-		g.sem <- struct{}{}
-		wg.Add(1)
-
-		go func(file DriveItem, wg *sync.WaitGroup) {
-			defer wg.Done()
-			defer func() {
-				if r := recover(); r != nil {
-					g.Failed = append(g.Failed, file)
-					if strings.Contains(fmt.Sprint(r), "context canceled") {
-						return
-					}
-					logger.Warn().Err(r.(error)).Msgf("Failed to make metadata: %s", file.Name)
-				}
-			}()
-			defer func() { <-g.sem }()
-
-			typ, beatmapMetadata, err := g.generateSingle(file)
-			if err != nil {
-				panic(err)
-			}
-
-			g.mux.Lock()
-			beatmaps := make(map[int]BeatmapMetadata)
-			beatmapsetId := beatmapMetadata[0].BeatmapsetId
-			beatmapset, ok := g.Metadata.Beatmapsets[beatmapsetId]
-			if !ok {
-				beatmapset = BeatmapsetMetadata{
-					Beatmaps:      make(map[int]BeatmapMetadata),
-					BeatmapsetId:  beatmapsetId,
-					Link:          beatmapMetadata[0].Link,
-					Path:          beatmapMetadata[0].Path,
-					HasStoryboard: beatmapMetadata[0].HasStoryboard,
-					HasVideo:      beatmapMetadata[0].HasVideo,
-				}
+		// the links of a group are made together, a backend with batch requests makes them in one round trip
+		group := files[start:min(start+linkBatchSize, len(files))]
+		links, errs := storage.LinkAll(g.backend, group)
+		for i, file := range group {
+			if errs[i] != nil {
+				g.fail(file, errs[i])
+				continue
 			}
-
-			for _, b := range beatmapMetadata {
-				// in beatmaps
-				origin, ok := g.Metadata.Beatmaps[b.BeatmapId]
-				if !ok {
-					origin = b
-				}
-				origin.Link[typ] = b.Link[typ]
-				origin.Path[typ] = b.Path[typ]
-				beatmaps[b.BeatmapId] = origin
-
-				// in game mode
-				gameModeUpdateTime, ok := g.Metadata.GameMode[b.GameMode]
-				if !ok {
-					g.Metadata.GameMode[b.GameMode] = MetadataGameMode{
-						UpdateTime: b.LastUpdate,
-					}
-				} else {
-					if gameModeUpdateTime.UpdateTime < b.LastUpdate {
-						gameModeUpdateTime.UpdateTime = b.LastUpdate
-						g.Metadata.GameMode[b.GameMode] = gameModeUpdateTime
-					}
-				}
-
-				// in beatmapset
-				origin, ok = beatmapset.Beatmaps[b.BeatmapId]
-				if !ok {
-					origin = b
-				}
-				origin.Link[typ] = b.Link[typ]
-				origin.Path[typ] = b.Path[typ]
-				if b.LastUpdate > beatmapset.LastUpdate {
-					beatmapset.LastUpdate = b.LastUpdate
-				}
-				if b.HasStoryboard {
-					beatmapset.HasStoryboard = true
-				}
-				if b.HasVideo {
-					beatmapset.HasVideo = true
-				}
-				beatmapset.Beatmaps[b.BeatmapId] = origin
-				g.Metadata.Beatmaps[b.BeatmapId] = origin
-			}
-			g.Metadata.Beatmapsets[beatmapsetId] = beatmapset
-			logger.Info().Msgf("Generated: %s", file.Name)
-			g.mux.Unlock()
-		}(file, &wg)
+			g.sem <- struct{}{}
+			g.Stats.Enter(stageGenerate)
+			wg.Add(1)
+			go g.generateFile(file, links[i], &wg)
+		}
 	}
 
 	wg.Wait()
 	return
 }
+
+func (g *Generator) generateFile(file storage.Object, link string, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer func() { <-g.sem }()
+	defer g.Stats.Leave(stageGenerate)
+
+	typ, beatmapMetadata, err := g.generateSingle(file, link)
+	if err != nil {
+		g.fail(file, err)
+		return
+	}
+	g.retry.Forget(file.Path)
+	g.Stats.Done()
+
+	g.mux.Lock()
+	beatmaps := make(map[int]BeatmapMetadata)
+	beatmapsetId := beatmapMetadata[0].BeatmapsetId
+	beatmapset, ok := g.Metadata.Beatmapsets[beatmapsetId]
+	if !ok {
+		beatmapset = BeatmapsetMetadata{
+			Beatmaps:      make(map[int]BeatmapMetadata),
+			BeatmapsetId:  beatmapsetId,
+			Link:          beatmapMetadata[0].Link,
+			Path:          beatmapMetadata[0].Path,
+			HasStoryboard: beatmapMetadata[0].HasStoryboard,
+			HasVideo:      beatmapMetadata[0].HasVideo,
+		}
+	}
+
+	for _, b := range beatmapMetadata {
+		// in beatmaps
+		origin, ok := g.Metadata.Beatmaps[b.BeatmapId]
+		if !ok {
+			origin = b
+		}
+		origin.Link[typ] = b.Link[typ]
+		origin.Path[typ] = b.Path[typ]
+		beatmaps[b.BeatmapId] = origin
+
+		// in game mode
+		gameModeUpdateTime, ok := g.Metadata.GameMode[b.GameMode]
+		if !ok {
+			g.Metadata.GameMode[b.GameMode] = MetadataGameMode{
+				UpdateTime: b.LastUpdate,
+			}
+		} else {
+			if gameModeUpdateTime.UpdateTime < b.LastUpdate {
+				gameModeUpdateTime.UpdateTime = b.LastUpdate
+				g.Metadata.GameMode[b.GameMode] = gameModeUpdateTime
+			}
+		}
+
+		// in beatmapset
+		origin, ok = beatmapset.Beatmaps[b.BeatmapId]
+		if !ok {
+			origin = b
+		}
+		origin.Link[typ] = b.Link[typ]
+		origin.Path[typ] = b.Path[typ]
+		if b.LastUpdate > beatmapset.LastUpdate {
+			beatmapset.LastUpdate = b.LastUpdate
+		}
+		if b.HasStoryboard {
+			beatmapset.HasStoryboard = true
+		}
+		if b.HasVideo {
+			beatmapset.HasVideo = true
+		}
+		beatmapset.Beatmaps[b.BeatmapId] = origin
+		g.Metadata.Beatmaps[b.BeatmapId] = origin
+	}
+	g.Metadata.Beatmapsets[beatmapsetId] = beatmapset
+	logger.Info().Msgf("Generated: %s", file.Name)
+	g.mux.Unlock()
+}
@@ -0,0 +1,127 @@
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	. "github.com/MingxuanGame/OsuBeatmapSync/model"
+	"github.com/MingxuanGame/OsuBeatmapSync/osu"
+	"github.com/MingxuanGame/OsuBeatmapSync/osu/download"
+	osusync "github.com/MingxuanGame/OsuBeatmapSync/osu/sync"
+	"github.com/MingxuanGame/OsuBeatmapSync/storage"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+type fakeDownloader struct{}
+
+func (fakeDownloader) Name() string {
+	return "fake"
+}
+
+func (fakeDownloader) DownloadBeatmapset(beatmapsetId int) ([]byte, error) {
+	return []byte("beatmapset " + strconv.Itoa(beatmapsetId)), nil
+}
+
+// fakeOsuApi serves the beatmaps to the v1 API, every request of the default transport goes to it
+func fakeOsuApi(t *testing.T, beatmaps map[int][]Beatmap) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sid, _ := strconv.Atoi(r.URL.Query().Get("s"))
+		_ = json.NewEncoder(w).Encode(beatmaps[sid])
+	}))
+	t.Cleanup(srv.Close)
+	target, _ := url.Parse(srv.URL)
+	transport := http.DefaultTransport
+	http.DefaultTransport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		req.URL.Scheme, req.URL.Host = target.Scheme, target.Host
+		return transport.RoundTrip(req)
+	})
+	t.Cleanup(func() { http.DefaultTransport = transport })
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func newMetadata() *Metadata {
+	return &Metadata{
+		GameMode:    make(map[GameMode]MetadataGameMode),
+		Beatmaps:    make(map[int]BeatmapMetadata),
+		Beatmapsets: make(map[int]BeatmapsetMetadata),
+	}
+}
+
+// TestGenerateSyncedFiles syncs beatmapsets to a local storage and makes the metadata again from the files,
+// like metadata make does after the metadata file is lost
+func TestGenerateSyncedFiles(t *testing.T) {
+	beatmaps := map[int][]Beatmap{
+		1: {
+			{BeatmapId: 10, BeatmapsetId: 1, Artist: "Artist", Title: "Title", Status: StatusRanked, GameMode: GameModeOsu},
+			{BeatmapId: 11, BeatmapsetId: 1, Artist: "Artist", Title: "Title", Status: StatusRanked, GameMode: GameModeOsu},
+		},
+		2: {
+			{BeatmapId: 20, BeatmapsetId: 2, Artist: "Other", Title: "Song", Status: StatusLoved, GameMode: GameModeMania},
+		},
+	}
+	fakeOsuApi(t, beatmaps)
+	backend, err := storage.NewLocal(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{}
+	config.Path.Root = "Beatmaps"
+	config.Path.StdPath, config.Path.TaikoPath, config.Path.CatchPath, config.Path.ManiaPath = "osu", "taiko", "catch", "mania"
+	config.Path.RankedPath, config.Path.LovedPath, config.Path.QualifiedPath = "Ranked", "Loved", "Qualified"
+	config.General.MaxConcurrent = 2
+
+	synced := newMetadata()
+	s, err := osusync.NewSyncer(context.Background(), synced, backend, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var beatmapsets []BeatmapsetMetadata
+	for sid, data := range beatmaps {
+		beatmapset := BeatmapsetMetadata{BeatmapsetId: sid, Beatmaps: make(map[int]BeatmapMetadata)}
+		for _, beatmap := range data {
+			beatmapset.Beatmaps[beatmap.BeatmapId] = BeatmapMetadata{Beatmap: beatmap}
+		}
+		beatmapsets = append(beatmapsets, beatmapset)
+	}
+	s.SyncNewBeatmap([]download.BeatmapDownloader{fakeDownloader{}}, beatmapsets)
+	if len(s.Failed) > 0 || len(s.DeadLetters) > 0 {
+		t.Fatalf("%d beatmapset(s) failed to sync", len(s.Failed)+len(s.DeadLetters))
+	}
+
+	files, err := backend.List(config.Path.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template, err := config.Path.PathTemplate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated := newMetadata()
+	g := NewGenerator(osu.NewLegacyOfficialClient("key"), backend, context.Background(), &config.General, template, generated)
+	g.GenerateExistedFileMetadata(files)
+	if len(g.Failed) > 0 || len(g.DeadLetters) > 0 {
+		t.Fatalf("%d file(s) failed", len(g.Failed)+len(g.DeadLetters))
+	}
+
+	if len(generated.Beatmapsets) != len(synced.Beatmapsets) || len(generated.Beatmaps) != len(synced.Beatmaps) {
+		t.Fatalf("generated %d beatmapset(s) and %d beatmap(s), synced %d and %d",
+			len(generated.Beatmapsets), len(generated.Beatmaps), len(synced.Beatmapsets), len(synced.Beatmaps))
+	}
+	for bid, beatmap := range synced.Beatmaps {
+		got := generated.Beatmaps[bid]
+		if got.Path["full"] != beatmap.Path["full"] || got.Link["full"] != beatmap.Link["full"] {
+			t.Errorf("beatmap %d: generated %s (%s), synced %s (%s)", bid, got.Path["full"], got.Link["full"], beatmap.Path["full"], beatmap.Link["full"])
+		}
+		if got.GameMode != beatmap.GameMode || got.Status != beatmap.Status {
+			t.Errorf("beatmap %d: generated mode %d status %d, synced %d %d", bid, got.GameMode, got.Status, beatmap.GameMode, beatmap.Status)
+		}
+	}
+}
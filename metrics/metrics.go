@@ -0,0 +1,136 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"github.com/MingxuanGame/OsuBeatmapSync/stats"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const namespace = "osu_beatmap_sync"
+
+var logger = log.With().Str("module", "metrics").Logger()
+
+var registry = prometheus.NewRegistry()
+
+var (
+	Downloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "downloads_total",
+		Help:      "Beatmapset downloads by mirror and result.",
+	}, []string{"mirror", "result"})
+	DownloadBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "download_bytes_total",
+		Help:      "Bytes downloaded by mirror.",
+	}, []string{"mirror"})
+	UploadBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upload_bytes_total",
+		Help:      "Bytes uploaded to OneDrive.",
+	})
+	UploadSessions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upload_sessions_total",
+		Help:      "OneDrive upload sessions created.",
+	})
+	ChunkRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upload_chunk_retries_total",
+		Help:      "Retried upload chunks by reason.",
+	}, []string{"reason"})
+	RateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_total",
+		Help:      "HTTP 429 responses by API.",
+	}, []string{"api"})
+	Failures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "failures_total",
+		Help:      "Failed items by stage and error type.",
+	}, []string{"stage", "type"})
+	NewestBeatmap = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "newest_beatmap_timestamp_seconds",
+		Help:      "Last update time of the newest synced beatmap by game mode.",
+	}, []string{"mode"})
+)
+
+var statsCollector = &runCollector{
+	queueDepth: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "queue_depth"),
+		"Items queued or running in each stage of the current run.", []string{"run", "stage"}, nil),
+	items: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "items"),
+		"Items of the current run by state.", []string{"run", "state"}, nil),
+}
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		Downloads, DownloadBytes, UploadBytes, UploadSessions, ChunkRetries,
+		RateLimited, Failures, NewestBeatmap, statsCollector,
+	)
+}
+
+type watchedStats struct {
+	run   string
+	stats *stats.Stats
+}
+
+// runCollector reads the counters of the current run, which is replaced on every run
+type runCollector struct {
+	current    atomic.Pointer[watchedStats]
+	queueDepth *prometheus.Desc
+	items      *prometheus.Desc
+}
+
+func (c *runCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.queueDepth
+	ch <- c.items
+}
+
+func (c *runCollector) Collect(ch chan<- prometheus.Metric) {
+	current := c.current.Load()
+	if current == nil {
+		return
+	}
+	snapshot := current.stats.Snapshot()
+	for stage, depth := range snapshot.Depth {
+		ch <- prometheus.MustNewConstMetric(c.queueDepth, prometheus.GaugeValue, float64(depth), current.run, stage)
+	}
+	ch <- prometheus.MustNewConstMetric(c.items, prometheus.GaugeValue, float64(snapshot.Total), current.run, "total")
+	ch <- prometheus.MustNewConstMetric(c.items, prometheus.GaugeValue, float64(snapshot.Done), current.run, "done")
+	ch <- prometheus.MustNewConstMetric(c.items, prometheus.GaugeValue, float64(snapshot.Failed), current.run, "failed")
+	ch <- prometheus.MustNewConstMetric(c.items, prometheus.GaugeValue, float64(snapshot.Remaining()), current.run, "remaining")
+}
+
+// WatchStats exports the queue depth and item counts of the run
+func WatchStats(run string, s *stats.Stats) {
+	statsCollector.current.Store(&watchedStats{run: run, stats: s})
+}
+
+// Serve serves the metrics on addr until ctx is done
+func Serve(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		logger.Info().Msgf("Serving metrics on %s/metrics", addr)
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error().Err(err).Msg("Failed to serve metrics")
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+}
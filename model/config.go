@@ -1,16 +1,193 @@
 package model
 
+import (
+	"fmt"
+	"runtime"
+	"time"
+)
+
 type GeneralConfig struct {
 	MaxConcurrent  int  `toml:"max_concurrent"`
-	UploadMultiple int  `toml:"upload_multiple"`
 	LogLevel       int8 `toml:"log_level"`
+	MaxAttempts    int  `toml:"max_attempts"`
+	RetryBaseDelay int  `toml:"retry_base_delay"` // seconds
+	RetryMaxDelay  int  `toml:"retry_max_delay"`  // seconds
+
+	DownloadWorkers int `toml:"download_workers"`
+	ProcessWorkers  int `toml:"process_workers"`
+	UploadWorkers   int `toml:"upload_workers"`
+	MemoryBudget    int `toml:"memory_budget"` // MB
+	// Deprecated: UploadMultiple is ignored since the sync pipeline, use UploadWorkers
+	UploadMultiple int `toml:"upload_multiple,omitempty"`
+
+	// ShutdownTimeout is how long started work may run after the first interrupt signal, in seconds
+	ShutdownTimeout int `toml:"shutdown_timeout"`
+
+	// Priority is the order beatmapsets are synced in, see NewSyncPriority
+	Priority []string `toml:"priority"`
+
+	DownloadLimit int64 `toml:"download_limit"` // bytes per second, 0 for no limit
+	UploadLimit   int64 `toml:"upload_limit"`   // bytes per second, 0 for no limit
+	// BandwidthSchedule overrides the limits in time windows of the day, the first matching window is used
+	BandwidthSchedule []BandwidthWindow `toml:"BandwidthSchedule,omitempty"`
+}
+
+type BandwidthWindow struct {
+	Start         string `toml:"start"` // local time like 09:00
+	End           string `toml:"end"`   // local time like 18:00, before Start for a window over midnight
+	DownloadLimit int64  `toml:"download_limit"`
+	UploadLimit   int64  `toml:"upload_limit"`
+}
+
+// contains reports whether the time of day of now is in the window
+func (w BandwidthWindow) contains(now time.Time) (bool, error) {
+	start, err := time.Parse("15:04", w.Start)
+	if err != nil {
+		return false, fmt.Errorf("invalid start %q of bandwidth window: %w", w.Start, err)
+	}
+	end, err := time.Parse("15:04", w.End)
+	if err != nil {
+		return false, fmt.Errorf("invalid end %q of bandwidth window: %w", w.End, err)
+	}
+	minute := now.Hour()*60 + now.Minute()
+	startMinute, endMinute := start.Hour()*60+start.Minute(), end.Hour()*60+end.Minute()
+	if startMinute <= endMinute {
+		return minute >= startMinute && minute < endMinute, nil
+	}
+	return minute >= startMinute || minute < endMinute, nil
+}
+
+// CheckBandwidthSchedule returns an error if a window of BandwidthSchedule has an invalid time
+func (c GeneralConfig) CheckBandwidthSchedule() error {
+	for _, window := range c.BandwidthSchedule {
+		if _, err := window.contains(time.Now()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BandwidthLimits returns the download and upload limits in bytes per second at now, 0 for no limit
+func (c GeneralConfig) BandwidthLimits(now time.Time) (download, upload int64) {
+	for _, window := range c.BandwidthSchedule {
+		if ok, err := window.contains(now); err == nil && ok {
+			return window.DownloadLimit, window.UploadLimit
+		}
+	}
+	return c.DownloadLimit, c.UploadLimit
+}
+
+// SyncPriority returns the parsed Priority
+func (c GeneralConfig) SyncPriority() (SyncPriority, error) {
+	return NewSyncPriority(c.Priority)
+}
+
+// Workers returns the size of each sync pipeline worker pool, falling back to max_concurrent
+func (c GeneralConfig) Workers() (download, process, upload int) {
+	download, process, upload = c.MaxConcurrent, runtime.NumCPU(), c.MaxConcurrent
+	if c.DownloadWorkers > 0 {
+		download = c.DownloadWorkers
+	}
+	if c.ProcessWorkers > 0 {
+		process = c.ProcessWorkers
+	}
+	if c.UploadWorkers > 0 {
+		upload = c.UploadWorkers
+	}
+	return max(download, 1), max(process, 1), max(upload, 1)
+}
+
+// MemoryBudgetBytes returns the limit of beatmap data held in memory by the sync pipeline
+func (c GeneralConfig) MemoryBudgetBytes() int64 {
+	if c.MemoryBudget > 0 {
+		return int64(c.MemoryBudget) << 20
+	}
+	return 1 << 30
+}
+
+// ShutdownTimeoutDuration returns ShutdownTimeout, falling back to 2 minutes for old config files
+func (c GeneralConfig) ShutdownTimeoutDuration() time.Duration {
+	if c.ShutdownTimeout > 0 {
+		return time.Duration(c.ShutdownTimeout) * time.Second
+	}
+	return 2 * time.Minute
+}
+
+// RetryPolicy returns the retry settings, falling back to defaults for old config files
+func (c GeneralConfig) RetryPolicy() (maxAttempts int, baseDelay, maxDelay time.Duration) {
+	maxAttempts, baseDelay, maxDelay = 5, 30*time.Second, 30*time.Minute
+	if c.MaxAttempts > 0 {
+		maxAttempts = c.MaxAttempts
+	}
+	if c.RetryBaseDelay > 0 {
+		baseDelay = time.Duration(c.RetryBaseDelay) * time.Second
+	}
+	if c.RetryMaxDelay > 0 {
+		maxDelay = time.Duration(c.RetryMaxDelay) * time.Second
+	}
+	return
 }
 
 type Config struct {
 	OneDrive OneDrive
 	Osu      Osu
 	Path     OneDrivePath
+	Storage  StorageConfig
 	General  GeneralConfig
+	Webhooks []Webhook `toml:"Webhook,omitempty"`
+}
+
+type StorageConfig struct {
+	// Type is where the files are stored: "onedrive" (default), "local", "s3" or "webdav"
+	Type  string `toml:"type"`
+	Local struct {
+		Dir string `toml:"dir"`
+		// BaseUrl is the url Dir is served at, used for the download links. Links are file:// urls if it is empty.
+		BaseUrl string `toml:"base_url"`
+	}
+	S3     S3Storage
+	WebDAV WebDAVStorage
+}
+
+// WebDAVStorage is a WebDAV server, like Nextcloud
+type WebDAVStorage struct {
+	// Url is the collection the paths are relative to, like https://cloud.example.com/remote.php/dav/files/user
+	Url      string `toml:"url"`
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+	// PublicUrl is the url the collection is shared at, used for the download links. Links are Url joined with the path if it is empty.
+	PublicUrl string `toml:"public_url"`
+}
+
+// S3Storage is an S3-compatible bucket, like AWS S3, MinIO, Cloudflare R2 or Backblaze B2
+type S3Storage struct {
+	Endpoint  string `toml:"endpoint"` // host and port without scheme, like s3.us-east-1.amazonaws.com or localhost:9000
+	Insecure  bool   `toml:"insecure"` // http instead of https
+	Region    string `toml:"region"`
+	Bucket    string `toml:"bucket"`
+	AccessKey string `toml:"access_key"`
+	SecretKey string `toml:"secret_key"`
+	// PathStyle puts the bucket in the path instead of the host name, needed by MinIO without a domain
+	PathStyle bool `toml:"path_style"`
+	// PublicUrl is the url of a public bucket, used for the download links. Presigned links are used if it is empty.
+	PublicUrl string `toml:"public_url"`
+	// LinkExpiry is how long presigned links are valid in hours, at most 168
+	LinkExpiry int `toml:"link_expiry"`
+}
+
+// LinkExpiryDuration returns LinkExpiry, falling back to the longest expiry of presigned links
+func (s S3Storage) LinkExpiryDuration() time.Duration {
+	if s.LinkExpiry > 0 && s.LinkExpiry < 168 {
+		return time.Duration(s.LinkExpiry) * time.Hour
+	}
+	return 168 * time.Hour
+}
+
+type Webhook struct {
+	Url    string   `toml:"url"`
+	Format string   `toml:"format"`  // json, discord or telegram
+	Events []string `toml:"events"`  // empty for all events
+	ChatId string   `toml:"chat_id"` // telegram only
 }
 
 type OneDrive struct {
@@ -28,6 +205,11 @@ type Token struct {
 }
 
 type OneDrivePath struct {
+	// Template is the layout of the files, see DefaultPathTemplate
+	Template string `toml:"template"`
+	// UnicodeFilename uses the original artist and title in the filenames when they are present
+	UnicodeFilename bool `toml:"unicode_filename"`
+
 	// Level 1
 	Root string `toml:"root"`
 
@@ -36,6 +218,10 @@ type OneDrivePath struct {
 	TaikoPath string `toml:"taiko"`
 	CatchPath string `toml:"catch"`
 	ManiaPath string `toml:"mania"`
+	// MultiPath is used for beatmapsets with difficulties in several modes when MultiMode is "multi"
+	MultiPath string `toml:"multi"`
+	// MultiMode is where beatmapsets with difficulties in several modes go: "majority" (default), "multi" or "all"
+	MultiMode string `toml:"multi_mode"`
 
 	// Level 3
 	RankedPath    string `toml:"ranked"`
@@ -43,6 +229,14 @@ type OneDrivePath struct {
 	QualifiedPath string `toml:"qualified"`
 }
 
+// PathTemplate returns the parsed Template, falling back to DefaultPathTemplate for old config files
+func (p OneDrivePath) PathTemplate() (*PathTemplate, error) {
+	if p.Template == "" {
+		return NewPathTemplate(DefaultPathTemplate)
+	}
+	return NewPathTemplate(p.Template)
+}
+
 type Osu struct {
 	V1ApiKey string `toml:"v1_api_key"`
 	Sayobot  struct {
@@ -57,4 +251,7 @@ type Osu struct {
 	EnableCatboy   bool     `toml:"enable_catboy"`
 	EnableOfficial bool     `toml:"enable_official"`
 	ProcessTypes   []string `toml:"process_types"`
+	// MinSavingPercent skips a processed variant saving less than this percentage of the full size,
+	// a variant that removes nothing is always skipped
+	MinSavingPercent float64 `toml:"min_saving_percent"`
 }
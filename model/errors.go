@@ -0,0 +1,116 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type ErrorType int
+
+//goland:noinspection ALL
+const (
+	ErrorUnknown ErrorType = iota
+	ErrorNotFound
+	ErrorUnavailable // DMCA takedown or download disabled
+	ErrorRateLimited
+	ErrorServer
+	ErrorAuthExpired
+	ErrorCorrupt
+	ErrorConflict // the item exists or was changed by someone else
+)
+
+func (t ErrorType) String() string {
+	switch t {
+	case ErrorNotFound:
+		return "not_found"
+	case ErrorUnavailable:
+		return "unavailable"
+	case ErrorRateLimited:
+		return "rate_limited"
+	case ErrorServer:
+		return "server_error"
+	case ErrorAuthExpired:
+		return "auth_expired"
+	case ErrorCorrupt:
+		return "corrupt"
+	case ErrorConflict:
+		return "conflict"
+	default:
+		return "unknown"
+	}
+}
+
+// RequestError is returned by beatmap downloaders, the osu! API client and the Graph client
+type RequestError struct {
+	Type       ErrorType
+	Source     string
+	URL        string
+	StatusCode int
+	RetryAfter time.Duration
+	Err        error
+}
+
+func NewRequestError(typ ErrorType, source, url string, statusCode int, err error) *RequestError {
+	return &RequestError{
+		Type:       typ,
+		Source:     source,
+		URL:        url,
+		StatusCode: statusCode,
+		Err:        err,
+	}
+}
+
+func (e *RequestError) Error() string {
+	msg := fmt.Sprintf("%s: %s", e.Source, e.Type)
+	if e.StatusCode != 0 {
+		msg += fmt.Sprintf(" (status %d)", e.StatusCode)
+	}
+	if e.URL != "" {
+		msg += " " + e.URL
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorTypeFromStatus maps an HTTP status code to an ErrorType
+func ErrorTypeFromStatus(statusCode int) ErrorType {
+	switch {
+	case statusCode == http.StatusNotFound || statusCode == http.StatusGone:
+		return ErrorNotFound
+	case statusCode == http.StatusUnauthorized:
+		return ErrorAuthExpired
+	case statusCode == http.StatusForbidden || statusCode == http.StatusUnavailableForLegalReasons:
+		return ErrorUnavailable
+	case statusCode == http.StatusTooManyRequests:
+		return ErrorRateLimited
+	case statusCode == http.StatusConflict || statusCode == http.StatusPreconditionFailed:
+		return ErrorConflict
+	case statusCode >= 500:
+		return ErrorServer
+	default:
+		return ErrorUnknown
+	}
+}
+
+// GetErrorType returns the ErrorType of err, or ErrorUnknown if err is not a RequestError
+func GetErrorType(err error) ErrorType {
+	var requestError *RequestError
+	if errors.As(err, &requestError) {
+		return requestError.Type
+	}
+	return ErrorUnknown
+}
+
+// IsPermanentError reports whether retrying the same request can never succeed
+func IsPermanentError(err error) bool {
+	typ := GetErrorType(err)
+	return typ == ErrorNotFound || typ == ErrorUnavailable
+}
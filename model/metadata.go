@@ -70,6 +70,19 @@ func (b BeatmapsetMetadata) Equal(other BeatmapsetMetadata) bool {
 	return true
 }
 
+// Primary returns the difficulty with the lowest id, so the choice does not depend on the map order
+func (b BeatmapsetMetadata) Primary() BeatmapMetadata {
+	var primary BeatmapMetadata
+	first := true
+	for _, beatmap := range b.Beatmaps {
+		if first || beatmap.BeatmapId < primary.BeatmapId {
+			primary = beatmap
+			first = false
+		}
+	}
+	return primary
+}
+
 func (b BeatmapsetMetadata) String() string {
 	var beatmap BeatmapMetadata
 	for _, v := range b.Beatmaps {
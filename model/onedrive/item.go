@@ -4,30 +4,43 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"github.com/MingxuanGame/OsuBeatmapSync/onedrive/quickxorhash"
+	"strings"
 )
 
 type DriveItem struct {
-	Id   string `json:"id"`
-	Name string `json:"name"`
-	Size int64  `json:"size"`
-	File *struct {
-		MIMEType string `json:"mimeType"`
-		Hashes   struct {
-			SHA1Hash     string `json:"sha1Hash,omitempty"`
-			CRC32Hash    string `json:"crc32Hash,omitempty"`
-			QuickXorHash string `json:"quickXorHash,omitempty"`
-		} `json:"hashes,omitempty"`
-	} `json:"file"`
-	Folder *struct {
-		ChildCount int `json:"childCount"`
-	} `json:"folder"`
+	Id     string       `json:"id"`
+	Name   string       `json:"name"`
+	Size   int64        `json:"size"`
+	ETag   string       `json:"eTag"`
+	File   *FileFacet   `json:"file"`
+	Folder *FolderFacet `json:"folder"`
 	Shared struct {
 		Scope string `json:"scope"`
 	} `json:"shared"`
 	ParentReference struct {
+		Id   string `json:"id"`
 		Name string `json:"name"`
 		Path string `json:"path"`
 	} `json:"parentReference"`
+	// Deleted is only set in delta responses, for items that are deleted
+	Deleted *struct {
+		State string `json:"state"`
+	} `json:"deleted,omitempty"`
+	// Root is set for the root folder of the drive
+	Root *struct{} `json:"root,omitempty"`
+}
+
+type FileFacet struct {
+	MIMEType string `json:"mimeType"`
+	Hashes   struct {
+		SHA1Hash     string `json:"sha1Hash,omitempty"`
+		CRC32Hash    string `json:"crc32Hash,omitempty"`
+		QuickXorHash string `json:"quickXorHash,omitempty"`
+	} `json:"hashes,omitempty"`
+}
+
+type FolderFacet struct {
+	ChildCount int `json:"childCount"`
 }
 
 type ShareLink struct {
@@ -35,6 +48,19 @@ type ShareLink struct {
 	WebUrl string `json:"webUrl"`
 }
 
+// TrimDriveRoot returns the path relative to the drive root, without the "/drive/root:" prefix of parent references
+func TrimDriveRoot(p string) string {
+	if i := strings.Index(p, "root:"); i >= 0 {
+		p = p[i+len("root:"):]
+	}
+	return strings.Trim(p, "/")
+}
+
+// Path returns the path of the item relative to the drive root
+func (item DriveItem) Path() string {
+	return TrimDriveRoot(item.ParentReference.Path + "/" + item.Name)
+}
+
 func (item DriveItem) IsFile() bool {
 	return item.File != nil
 }
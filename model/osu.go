@@ -13,6 +13,27 @@ const (
 	StatusLoved
 )
 
+func (s BeatmapStatus) String() string {
+	switch s {
+	case StatusGraveyard:
+		return "graveyard"
+	case StatusWIP:
+		return "wip"
+	case StatusPending:
+		return "pending"
+	case StatusRanked:
+		return "ranked"
+	case StatusApproved:
+		return "approved"
+	case StatusQualified:
+		return "qualified"
+	case StatusLoved:
+		return "loved"
+	default:
+		return "unknown"
+	}
+}
+
 type GameMode int
 
 //goland:noinspection ALL
@@ -23,6 +44,21 @@ const (
 	GameModeMania
 )
 
+func (m GameMode) String() string {
+	switch m {
+	case GameModeOsu:
+		return "osu"
+	case GameModeTaiko:
+		return "taiko"
+	case GameModeCtb:
+		return "fruits"
+	case GameModeMania:
+		return "mania"
+	default:
+		return "unknown"
+	}
+}
+
 type GenreId int
 
 //goland:noinspection ALL
@@ -43,6 +79,30 @@ const (
 	GenreJazz
 )
 
+var genreNames = map[GenreId]string{
+	GenreAny:         "any",
+	GenreUnspecified: "unspecified",
+	GenreVideoGame:   "video_game",
+	GenreAnime:       "anime",
+	GenreRock:        "rock",
+	GenrePop:         "pop",
+	GenreOther:       "other",
+	GenreNovelty:     "novelty",
+	GenreHipHop:      "hip_hop",
+	GenreElectronic:  "electronic",
+	GenreMetal:       "metal",
+	GenreClassical:   "classical",
+	GenreFolk:        "folk",
+	GenreJazz:        "jazz",
+}
+
+func (g GenreId) String() string {
+	if name, ok := genreNames[g]; ok {
+		return name
+	}
+	return "unknown"
+}
+
 type LanguageId int
 
 //goland:noinspection ALL
@@ -64,6 +124,31 @@ const (
 	LangOther
 )
 
+var languageNames = map[LanguageId]string{
+	LangAny:          "any",
+	LangUnspecified:  "unspecified",
+	LangEnglish:      "english",
+	LangJapanese:     "japanese",
+	LangChinese:      "chinese",
+	LangInstrumental: "instrumental",
+	LangKorean:       "korean",
+	LangFrench:       "french",
+	LangGerman:       "german",
+	LangSwedish:      "swedish",
+	LangSpanish:      "spanish",
+	LangItalian:      "italian",
+	LangRussian:      "russian",
+	LangPolish:       "polish",
+	LangOther:        "other",
+}
+
+func (l LanguageId) String() string {
+	if name, ok := languageNames[l]; ok {
+		return name
+	}
+	return "unknown"
+}
+
 type Beatmap struct {
 	Status       BeatmapStatus `json:"approved,string"`
 	SubmitDate   string        `json:"submit_date"`
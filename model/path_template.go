@@ -0,0 +1,232 @@
+package model
+
+import (
+	"fmt"
+	"github.com/MingxuanGame/OsuBeatmapSync/utils"
+	"golang.org/x/text/unicode/norm"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultPathTemplate = "{root}/{mode}/{status}/{type}/{sid} {artist} - {title}.osz"
+
+const defaultBucketSize = 1000
+
+// templateVariables are the variables of a path template and the patterns to parse them back
+var templateVariables = map[string]string{
+	"root":     `.+?`,
+	"mode":     `[^/]+`,
+	"status":   `[^/]+`,
+	"type":     `[^/]+`,
+	"sid":      `\d+`,
+	"artist":   `[^/]+?`,
+	"title":    `[^/]+`,
+	"creator":  `[^/]+?`,
+	"year":     `[^/]+`,
+	"keys":     `[^/]+`,
+	"genre":    `[^/]+`,
+	"language": `[^/]+`,
+	"bucket":   `\d+`,
+}
+
+// PathTemplate builds the path of a beatmapset file from variables like {sid}, and parses the paths it built back
+type PathTemplate struct {
+	raw   string
+	parts []templatePart
+	re    *regexp.Regexp
+}
+
+type templatePart struct {
+	literal string
+	// name is empty for a literal part
+	name string
+	// size is the bucket size of {bucket:size}
+	size int
+}
+
+type PathValues struct {
+	Root       string
+	Mode       string
+	Status     string
+	Type       string
+	Beatmapset BeatmapsetMetadata
+	// Unicode uses the original artist and title instead of the romanised ones when they are present
+	Unicode bool
+}
+
+func NewPathTemplate(template string) (*PathTemplate, error) {
+	t := &PathTemplate{raw: template}
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	captured := make(map[string]bool)
+	rest := template
+	for rest != "" {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			start = len(rest)
+		}
+		if start > 0 {
+			t.parts = append(t.parts, templatePart{literal: rest[:start]})
+			pattern.WriteString(regexp.QuoteMeta(rest[:start]))
+			rest = rest[start:]
+			continue
+		}
+		end := strings.IndexByte(rest, '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed variable in path template %q", template)
+		}
+		name, arg, hasArg := strings.Cut(rest[1:end], ":")
+		rest = rest[end+1:]
+		variablePattern, ok := templateVariables[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown variable {%s} in path template %q", name, template)
+		}
+		part := templatePart{name: name}
+		if name == "bucket" {
+			part.size = defaultBucketSize
+			if hasArg {
+				size, err := strconv.Atoi(arg)
+				if err != nil || size <= 0 {
+					return nil, fmt.Errorf("invalid bucket size %q in path template %q", arg, template)
+				}
+				part.size = size
+			}
+		} else if hasArg {
+			return nil, fmt.Errorf("variable {%s} takes no argument in path template %q", name, template)
+		}
+		t.parts = append(t.parts, part)
+		if name == "root" && !captured[name] && strings.HasPrefix(rest, "/") {
+			// an empty root leaves no separator, Execute cleans it from the path
+			captured[name] = true
+			t.parts = append(t.parts, templatePart{literal: "/"})
+			rest = rest[1:]
+			pattern.WriteString("(?:(?P<root>" + variablePattern + ")/)?")
+			continue
+		}
+		if captured[name] {
+			pattern.WriteString("(?:" + variablePattern + ")")
+		} else {
+			captured[name] = true
+			pattern.WriteString("(?P<" + name + ">" + variablePattern + ")")
+		}
+	}
+	pattern.WriteString("$")
+	if !captured["sid"] || !captured["type"] {
+		return nil, fmt.Errorf("path template %q must contain {sid} and {type}", template)
+	}
+	var err error
+	t.re, err = regexp.Compile(pattern.String())
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *PathTemplate) String() string {
+	return t.raw
+}
+
+// Execute returns the path of the file relative to the drive root
+func (t *PathTemplate) Execute(values PathValues) string {
+	beatmapset := values.Beatmapset
+	beatmap := beatmapset.Primary()
+	var result strings.Builder
+	for _, part := range t.parts {
+		switch part.name {
+		case "":
+			result.WriteString(part.literal)
+		case "root":
+			result.WriteString(strings.Trim(values.Root, "/"))
+		case "mode":
+			result.WriteString(values.Mode)
+		case "status":
+			result.WriteString(values.Status)
+		case "type":
+			result.WriteString(values.Type)
+		case "sid":
+			result.WriteString(strconv.Itoa(beatmapset.BeatmapsetId))
+		case "artist":
+			artist := beatmap.Artist
+			if values.Unicode && beatmap.ArtistUnicode != "" {
+				artist = beatmap.ArtistUnicode
+			}
+			result.WriteString(utils.NormalizeFileName(artist))
+		case "title":
+			title := beatmap.Title
+			if values.Unicode && beatmap.TitleUnicode != "" {
+				title = beatmap.TitleUnicode
+			}
+			result.WriteString(utils.NormalizeFileName(title))
+		case "creator":
+			result.WriteString(utils.NormalizeFileName(beatmap.Creator))
+		case "year":
+			result.WriteString(beatmapsetYear(beatmap))
+		case "keys":
+			result.WriteString(keyCount(beatmapset))
+		case "genre":
+			result.WriteString(beatmap.GenreId.String())
+		case "language":
+			result.WriteString(beatmap.LanguageId.String())
+		case "bucket":
+			result.WriteString(strconv.Itoa(beatmapset.BeatmapsetId / part.size * part.size))
+		}
+	}
+	return strings.Trim(path.Clean(result.String()), "/")
+}
+
+// Parse returns the variables in a path built by the template, the path is relative to the drive root
+func (t *PathTemplate) Parse(p string) (map[string]string, bool) {
+	match := t.re.FindStringSubmatch(norm.NFC.String(p))
+	if match == nil {
+		return nil, false
+	}
+	result := make(map[string]string)
+	for i, name := range t.re.SubexpNames() {
+		if i != 0 && name != "" {
+			result[name] = match[i]
+		}
+	}
+	return result, true
+}
+
+// beatmapsetYear is the year the beatmapset was approved, or submitted if it is not approved
+func beatmapsetYear(beatmap BeatmapMetadata) string {
+	for _, date := range []int64{beatmap.ApprovedDate, beatmap.SubmitDate} {
+		if date > 0 {
+			return strconv.Itoa(time.Unix(date, 0).UTC().Year())
+		}
+	}
+	// metadata made from existing files only has the dates from the API
+	for _, date := range []string{beatmap.Beatmap.ApprovedDate, beatmap.Beatmap.SubmitDate} {
+		if t, err := time.Parse(time.DateTime, date); err == nil {
+			return strconv.Itoa(t.Year())
+		}
+	}
+	return "unknown"
+}
+
+// keyCount is like "4K" or "4K+7K" for the osu!mania difficulties, "none" if there is no osu!mania difficulty
+func keyCount(beatmapset BeatmapsetMetadata) string {
+	var keys []int
+	for _, beatmap := range beatmapset.Beatmaps {
+		if beatmap.GameMode != GameModeMania {
+			continue
+		}
+		if key := int(beatmap.CS); !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return "none"
+	}
+	slices.Sort(keys)
+	result := make([]string, len(keys))
+	for i, key := range keys {
+		result[i] = strconv.Itoa(key) + "K"
+	}
+	return strings.Join(result, "+")
+}
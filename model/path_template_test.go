@@ -0,0 +1,175 @@
+package model
+
+import (
+	"golang.org/x/text/unicode/norm"
+	"maps"
+	"testing"
+)
+
+func testBeatmapset(artist, title, artistUnicode, titleUnicode string) BeatmapsetMetadata {
+	return BeatmapsetMetadata{
+		BeatmapsetId: 1234567,
+		Beatmaps: map[int]BeatmapMetadata{
+			1: {Beatmap: Beatmap{
+				BeatmapId:     1,
+				BeatmapsetId:  1234567,
+				Artist:        artist,
+				Title:         title,
+				ArtistUnicode: artistUnicode,
+				TitleUnicode:  titleUnicode,
+				Creator:       "Mapper",
+				GameMode:      GameModeOsu,
+			}},
+		},
+	}
+}
+
+func TestPathTemplateRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		values   PathValues
+		path     string
+		want     map[string]string
+	}{
+		{
+			name:     "default",
+			template: DefaultPathTemplate,
+			values:   PathValues{Root: "Beatmaps", Mode: "osu", Status: "Ranked", Type: "full", Beatmapset: testBeatmapset("Artist", "Title", "", "")},
+			path:     "Beatmaps/osu/Ranked/full/1234567 Artist - Title.osz",
+			want:     map[string]string{"root": "Beatmaps", "sid": "1234567", "artist": "Artist", "title": "Title"},
+		},
+		{
+			name:     "nested root",
+			template: DefaultPathTemplate,
+			values:   PathValues{Root: "/Games/osu/", Mode: "osu", Status: "Loved", Type: "mini", Beatmapset: testBeatmapset("Artist", "Title", "", "")},
+			path:     "Games/osu/osu/Loved/mini/1234567 Artist - Title.osz",
+			want:     map[string]string{"root": "Games/osu", "mode": "osu", "status": "Loved", "type": "mini"},
+		},
+		{
+			name:     "empty root",
+			template: DefaultPathTemplate,
+			values:   PathValues{Mode: "osu", Status: "Ranked", Type: "full", Beatmapset: testBeatmapset("Artist", "Title", "", "")},
+			path:     "osu/Ranked/full/1234567 Artist - Title.osz",
+			want:     map[string]string{"root": "", "mode": "osu", "sid": "1234567", "title": "Title"},
+		},
+		{
+			name:     "separators in title",
+			template: DefaultPathTemplate,
+			values:   PathValues{Root: "Beatmaps", Mode: "osu", Status: "Ranked", Type: "full", Beatmapset: testBeatmapset("AC/DC", "Back - In/Black: Live?", "", "")},
+			path:     "Beatmaps/osu/Ranked/full/1234567 AC_DC - Back - In_Black_ Live_.osz",
+			want:     map[string]string{"artist": "AC_DC", "title": "Back - In_Black_ Live_", "type": "full"},
+		},
+		{
+			name:     "unicode",
+			template: DefaultPathTemplate,
+			values:   PathValues{Root: "Beatmaps", Mode: "osu", Status: "Ranked", Type: "full", Beatmapset: testBeatmapset("YOASOBI", "Yoru ni Kakeru", "YOASOBI", "夜に駆ける"), Unicode: true},
+			path:     "Beatmaps/osu/Ranked/full/1234567 YOASOBI - 夜に駆ける.osz",
+			want:     map[string]string{"artist": "YOASOBI", "title": "夜に駆ける"},
+		},
+		{
+			// decomposed characters are composed, a path typed either way parses the same
+			name:     "unicode decomposed",
+			template: DefaultPathTemplate,
+			values:   PathValues{Root: "Beatmaps", Mode: "osu", Status: "Ranked", Type: "full", Beatmapset: testBeatmapset("Beyonce", "Cafe", "Beyonce\u0301", "Cafe\u0301"), Unicode: true},
+			path:     "Beatmaps/osu/Ranked/full/1234567 Beyonc\u00e9 - Caf\u00e9.osz",
+			want:     map[string]string{"artist": "Beyonc\u00e9", "title": "Caf\u00e9"},
+		},
+		{
+			name:     "unicode fallback",
+			template: DefaultPathTemplate,
+			values:   PathValues{Root: "Beatmaps", Mode: "osu", Status: "Ranked", Type: "full", Beatmapset: testBeatmapset("Artist", "Title", "", ""), Unicode: true},
+			path:     "Beatmaps/osu/Ranked/full/1234567 Artist - Title.osz",
+			want:     map[string]string{"artist": "Artist", "title": "Title"},
+		},
+		{
+			name:     "no root",
+			template: "{mode}/{type}/{creator}/{sid}.osz",
+			values:   PathValues{Root: "Beatmaps", Mode: "taiko", Type: "full", Beatmapset: testBeatmapset("Artist", "Title", "", "")},
+			path:     "taiko/full/Mapper/1234567.osz",
+			want:     map[string]string{"mode": "taiko", "type": "full", "creator": "Mapper", "sid": "1234567"},
+		},
+		{
+			name:     "bucket",
+			template: "{root}/{bucket:10000}/{sid}/{type}.osz",
+			values:   PathValues{Root: "Beatmaps", Type: "no_video", Beatmapset: testBeatmapset("Artist", "Title", "", "")},
+			path:     "Beatmaps/1230000/1234567/no_video.osz",
+			want:     map[string]string{"root": "Beatmaps", "bucket": "1230000", "sid": "1234567", "type": "no_video"},
+		},
+		{
+			name:     "variable used twice",
+			template: "{root}/{type}/{sid}/{sid} {title} ({type}).osz",
+			values:   PathValues{Root: "Beatmaps", Type: "full", Beatmapset: testBeatmapset("Artist", "Title (TV Size)", "", "")},
+			path:     "Beatmaps/full/1234567/1234567 Title (TV Size) (full).osz",
+			want:     map[string]string{"sid": "1234567", "type": "full", "title": "Title (TV Size)"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			template, err := NewPathTemplate(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := template.Execute(tt.values)
+			if p != tt.path {
+				t.Fatalf("executed %q, want %q", p, tt.path)
+			}
+			values, ok := template.Parse(p)
+			if !ok {
+				t.Fatalf("cannot parse %q", p)
+			}
+			for name, want := range tt.want {
+				if values[name] != want {
+					t.Errorf("parsed {%s} %q, want %q", name, values[name], want)
+				}
+			}
+			// a path listed with decomposed characters parses to the same values
+			decomposed, ok := template.Parse(norm.NFD.String(p))
+			if !ok || !maps.Equal(decomposed, values) {
+				t.Errorf("parsed the decomposed path to %v, want %v", decomposed, values)
+			}
+		})
+	}
+}
+
+func TestPathTemplateParse(t *testing.T) {
+	template, err := NewPathTemplate(DefaultPathTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		ok   bool
+	}{
+		{"Beatmaps/osu/Ranked/full/1 A - B.osz", true},
+		{"osu/Ranked/full/1 A - B.osz", true},
+		{"Beatmaps/osu/Ranked/full/A - B.osz", false},
+		{"Beatmaps/osu/Ranked/full/1 A - B.zip", false},
+		{"Ranked/full/1 A - B.osz", false},
+	}
+	for _, tt := range tests {
+		if _, ok := template.Parse(tt.path); ok != tt.ok {
+			t.Errorf("parse %q: got %t, want %t", tt.path, ok, tt.ok)
+		}
+	}
+}
+
+func TestNewPathTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		ok       bool
+	}{
+		{DefaultPathTemplate, true},
+		{"{sid}/{type}.osz", true},
+		{"{root}/{sid}.osz", false},
+		{"{root}/{sid}/{type", false},
+		{"{root}/{unknown}/{sid}/{type}.osz", false},
+		{"{bucket:0}/{sid}/{type}.osz", false},
+		{"{sid:3}/{type}.osz", false},
+	}
+	for _, tt := range tests {
+		if _, err := NewPathTemplate(tt.template); (err == nil) != tt.ok {
+			t.Errorf("%q: got error %v, want ok %t", tt.template, err, tt.ok)
+		}
+	}
+}
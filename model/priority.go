@@ -0,0 +1,113 @@
+package model
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// statusPriority is the order of the "status" priority, fresh content first
+var statusPriority = map[BeatmapStatus]int{
+	StatusQualified: 0,
+	StatusRanked:    1,
+	StatusApproved:  2,
+	StatusLoved:     3,
+}
+
+// SyncPriority is the order beatmapsets are synced in, made of the keys in order of importance
+type SyncPriority []func(a, b BeatmapsetMetadata) int
+
+// NewSyncPriority parses the priority keys:
+// "newest" and "oldest" by the approved date, "status" for qualified, ranked, approved and then loved,
+// "smallest" and "largest" by the estimated file size, "mode:<osu|taiko|fruits|mania>" for beatmapsets with the mode first
+func NewSyncPriority(keys []string) (SyncPriority, error) {
+	var p SyncPriority
+	for _, key := range keys {
+		switch key {
+		case "newest":
+			p = append(p, func(a, b BeatmapsetMetadata) int { return cmp.Compare(approvedTime(b), approvedTime(a)) })
+		case "oldest":
+			p = append(p, func(a, b BeatmapsetMetadata) int { return cmp.Compare(approvedTime(a), approvedTime(b)) })
+		case "status":
+			p = append(p, func(a, b BeatmapsetMetadata) int { return cmp.Compare(statusRank(a), statusRank(b)) })
+		case "smallest":
+			p = append(p, func(a, b BeatmapsetMetadata) int { return cmp.Compare(a.EstimatedSize(), b.EstimatedSize()) })
+		case "largest":
+			p = append(p, func(a, b BeatmapsetMetadata) int { return cmp.Compare(b.EstimatedSize(), a.EstimatedSize()) })
+		default:
+			name, ok := strings.CutPrefix(key, "mode:")
+			if !ok {
+				return nil, fmt.Errorf("unknown sync priority %q", key)
+			}
+			mode, ok := parseGameMode(name)
+			if !ok {
+				return nil, fmt.Errorf("unknown game mode %q in sync priority %q", name, key)
+			}
+			p = append(p, func(a, b BeatmapsetMetadata) int { return cmp.Compare(modeRank(a, mode), modeRank(b, mode)) })
+		}
+	}
+	return p, nil
+}
+
+// Sort sorts the beatmapsets by the priority, the lower beatmapset id first on a tie.
+// The beatmapsets are kept in their order if there is no priority.
+func (p SyncPriority) Sort(beatmapsets []BeatmapsetMetadata) {
+	if len(p) == 0 {
+		return
+	}
+	slices.SortStableFunc(beatmapsets, func(a, b BeatmapsetMetadata) int {
+		for _, compare := range p {
+			if c := compare(a, b); c != 0 {
+				return c
+			}
+		}
+		return cmp.Compare(a.BeatmapsetId, b.BeatmapsetId)
+	})
+}
+
+// EstimatedSize is a rough size of the beatmapset file in bytes, the audio of about 192 kbps makes most of it
+func (b BeatmapsetMetadata) EstimatedSize() int64 {
+	primary := b.Primary()
+	size := int64(primary.TotalLength)*24<<10 + int64(len(b.Beatmaps))*50<<10
+	if b.HasVideo {
+		size += 20 << 20
+	}
+	if b.HasStoryboard {
+		size += 2 << 20
+	}
+	return size
+}
+
+func approvedTime(b BeatmapsetMetadata) int64 {
+	primary := b.Primary()
+	if primary.ApprovedDate > 0 {
+		return primary.ApprovedDate
+	}
+	return primary.SubmitDate
+}
+
+func statusRank(b BeatmapsetMetadata) int {
+	if rank, ok := statusPriority[b.Primary().Status]; ok {
+		return rank
+	}
+	return len(statusPriority)
+}
+
+func modeRank(b BeatmapsetMetadata, mode GameMode) int {
+	for _, beatmap := range b.Beatmaps {
+		if beatmap.GameMode == mode {
+			return 0
+		}
+	}
+	return 1
+}
+
+func parseGameMode(name string) (GameMode, bool) {
+	for _, mode := range []GameMode{GameModeOsu, GameModeTaiko, GameModeCtb, GameModeMania} {
+		if mode.String() == name {
+			return mode, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,250 @@
+package onedrive
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/MingxuanGame/OsuBeatmapSync/metrics"
+	. "github.com/MingxuanGame/OsuBeatmapSync/model"
+	. "github.com/MingxuanGame/OsuBeatmapSync/model/onedrive"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxBatchSize is the most requests Graph accepts in one $batch
+const maxBatchSize = 20
+
+const itemSelect = "select=id,name,size,eTag,file,folder,shared,parentReference"
+
+type BatchReq struct {
+	Id      string            `json:"id"`
+	Method  string            `json:"method"`
+	Url     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+	// DependsOn are the ids of requests that must succeed before this one is run
+	DependsOn []string `json:"dependsOn,omitempty"`
+}
+
+type BatchResp struct {
+	Id      string            `json:"id"`
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	Body    json.RawMessage   `json:"body"`
+}
+
+// Err returns the error of a failed response, or nil
+func (resp *BatchResp) Err(req BatchReq) error {
+	if resp.Status < 400 {
+		return nil
+	}
+	source := req.Method + " " + req.Url
+	var errMsg ErrorResponse
+	if json.Unmarshal(resp.Body, &errMsg) == nil && errMsg.Error.Message != "" {
+		typ := ErrorTypeFromStatus(resp.Status)
+		if errMsg.Error.Code == "InvalidAuthenticationToken" {
+			typ = ErrorAuthExpired
+		}
+		return NewRequestError(typ, "onedrive", source, resp.Status, fmt.Errorf("status: %d, error: %s", resp.Status, errMsg.Error.Message))
+	}
+	if resp.Status == http.StatusFailedDependency {
+		return NewRequestError(ErrorUnknown, "onedrive", source, resp.Status, fmt.Errorf("request it depends on failed"))
+	}
+	return NewRequestError(ErrorTypeFromStatus(resp.Status), "onedrive", source, resp.Status, fmt.Errorf("status code: %d", resp.Status))
+}
+
+// batch sends one $batch request
+func (client *GraphClient) batch(reqs []BatchReq) ([]BatchResp, error) {
+	req, err := client.NewRequestJson("POST", "/$batch", struct {
+		Requests []BatchReq `json:"requests"`
+	}{
+		Requests: reqs,
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	data, err := client.ReadData(resp)
+	if err != nil {
+		return nil, err
+	}
+	var response struct {
+		Responses []BatchResp `json:"responses"`
+	}
+	err = json.Unmarshal(data, &response)
+	if err != nil {
+		return nil, err
+	}
+	return response.Responses, nil
+}
+
+// BatchDo sends the requests in batches of maxBatchSize and returns the responses in the order of reqs.
+// A request must come after the requests it depends on. Dependencies in an earlier batch have finished
+// when the request is sent, so a request whose dependency failed gets a 424 without being sent.
+// Requests that are rate limited are sent again after the Retry-After of the responses.
+func (client *GraphClient) BatchDo(reqs []BatchReq) ([]BatchResp, error) {
+	results := make(map[string]BatchResp, len(reqs))
+	pending := reqs
+	for attempt := 0; ; attempt++ {
+		for start := 0; start < len(pending); start += maxBatchSize {
+			batch := pending[start:min(start+maxBatchSize, len(pending))]
+			send := make([]BatchReq, 0, len(batch))
+			for _, req := range batch {
+				var deps []string
+				failed := false
+				for _, dep := range req.DependsOn {
+					if resp, ok := results[dep]; ok {
+						failed = failed || resp.Status >= 400
+						continue
+					}
+					deps = append(deps, dep)
+				}
+				if failed {
+					results[req.Id] = BatchResp{Id: req.Id, Status: http.StatusFailedDependency}
+					continue
+				}
+				req.DependsOn = deps
+				send = append(send, req)
+			}
+			if len(send) == 0 {
+				continue
+			}
+			responses, err := client.batch(send)
+			if err != nil {
+				return nil, err
+			}
+			for _, resp := range responses {
+				results[resp.Id] = resp
+			}
+		}
+
+		// the rate limited requests and the ones that failed because of them
+		limited := make(map[string]struct{})
+		var retryAfter time.Duration
+		pending = nil
+		for _, req := range reqs {
+			resp := results[req.Id]
+			retry := resp.Status == http.StatusTooManyRequests
+			if resp.Status == http.StatusFailedDependency {
+				for _, dep := range req.DependsOn {
+					if _, ok := limited[dep]; ok {
+						retry = true
+					}
+				}
+			}
+			if !retry {
+				continue
+			}
+			limited[req.Id] = struct{}{}
+			pending = append(pending, req)
+			if seconds, err := strconv.Atoi(resp.Headers["Retry-After"]); err == nil {
+				retryAfter = max(retryAfter, time.Duration(seconds)*time.Second)
+			}
+		}
+		if len(pending) == 0 || attempt >= maxRateLimitRetry {
+			break
+		}
+		metrics.RateLimited.WithLabelValues("onedrive").Inc()
+		if retryAfter == 0 {
+			retryAfter = time.Second << attempt
+		}
+		logger.Info().Str("api", "onedrive").Msgf("%d batched request(s) rate limited, sleeping for %s.", len(pending), retryAfter)
+		select {
+		case <-client.ctx.Done():
+			return nil, client.ctx.Err()
+		case <-time.After(retryAfter):
+		}
+		for _, req := range pending {
+			delete(results, req.Id)
+		}
+	}
+
+	responses := make([]BatchResp, len(reqs))
+	for i, req := range reqs {
+		resp, ok := results[req.Id]
+		if !ok {
+			return nil, fmt.Errorf("no response for batched request %s", req.Id)
+		}
+		responses[i] = resp
+	}
+	return responses, nil
+}
+
+// escapeItemPath escapes every segment of a path relative to the drive root
+func escapeItemPath(p string) string {
+	segments := strings.Split(strings.Trim(p, "/"), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// GetItems looks up the items at the paths like GetItem, an item is nil if it does not exist
+func (client *GraphClient) GetItems(paths []string) ([]*DriveItem, []error) {
+	reqs := make([]BatchReq, len(paths))
+	for i, p := range paths {
+		reqs[i] = BatchReq{Id: strconv.Itoa(i), Method: "GET", Url: "/me/drive/root:/" + escapeItemPath(p) + ":/?" + itemSelect}
+	}
+	items := make([]*DriveItem, len(paths))
+	errs := make([]error, len(paths))
+	responses, err := client.BatchDo(reqs)
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return items, errs
+	}
+	for i, resp := range responses {
+		if resp.Status == http.StatusNotFound {
+			continue
+		}
+		if errs[i] = resp.Err(reqs[i]); errs[i] != nil {
+			continue
+		}
+		var item DriveItem
+		errs[i] = json.Unmarshal(resp.Body, &item)
+		if errs[i] == nil {
+			items[i] = &item
+		}
+	}
+	return items, errs
+}
+
+// MakeShareLinks makes the links like MakeShareLink. An item is addressed by its id, or by its path if the id is empty.
+func (client *GraphClient) MakeShareLinks(ids, paths []string) ([]string, []error) {
+	reqs := make([]BatchReq, len(ids))
+	for i, id := range ids {
+		u := "/me/drive/items/" + id + "/createLink"
+		if id == "" {
+			u = "/me/drive/root:/" + escapeItemPath(paths[i]) + ":/createLink"
+		}
+		reqs[i] = BatchReq{
+			Id:      strconv.Itoa(i),
+			Method:  "POST",
+			Url:     u,
+			Headers: map[string]string{"Content-Type": "application/json"},
+			Body:    json.RawMessage(`{"type":"view","scope":"anonymous"}`),
+		}
+	}
+	links := make([]string, len(ids))
+	errs := make([]error, len(ids))
+	responses, err := client.BatchDo(reqs)
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return links, errs
+	}
+	for i, resp := range responses {
+		if errs[i] = resp.Err(reqs[i]); errs[i] != nil {
+			continue
+		}
+		links[i], errs[i] = downloadLink(resp.Body)
+	}
+	return links, errs
+}
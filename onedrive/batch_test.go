@@ -0,0 +1,214 @@
+package onedrive
+
+import (
+	"encoding/json"
+	"fmt"
+	. "github.com/MingxuanGame/OsuBeatmapSync/model"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBatch serves $batch, a request whose dependency in the same batch failed gets a 424 like Graph does
+type fakeBatch struct {
+	mux sync.Mutex
+	// batches are the requests of every $batch in order
+	batches [][]BatchReq
+	respond func(req BatchReq, attempt int) BatchResp
+	// attempts is how many times each request was sent
+	attempts map[string]int
+}
+
+func newFakeBatch(t *testing.T, respond func(req BatchReq, attempt int) BatchResp) (*fakeBatch, *GraphClient) {
+	f := &fakeBatch{respond: respond, attempts: make(map[string]int)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mux.Lock()
+		defer f.mux.Unlock()
+		var body struct {
+			Requests []BatchReq `json:"requests"`
+		}
+		if r.Method != "POST" || r.URL.Path != "/v1.0/$batch" || json.NewDecoder(r.Body).Decode(&body) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if len(body.Requests) > maxBatchSize {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":{"code":"BadRequest","message":"too many requests in the batch"}}`))
+			return
+		}
+		f.batches = append(f.batches, body.Requests)
+		status := make(map[string]int)
+		var responses []BatchResp
+		for _, req := range body.Requests {
+			resp := BatchResp{Id: req.Id, Status: http.StatusFailedDependency}
+			failed := false
+			for _, dep := range req.DependsOn {
+				s, ok := status[dep]
+				if !ok {
+					// Graph rejects the whole batch for a dependency outside of it
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				failed = failed || s >= 400
+			}
+			if !failed {
+				f.attempts[req.Id]++
+				resp = f.respond(req, f.attempts[req.Id])
+				resp.Id = req.Id
+			}
+			status[req.Id] = resp.Status
+			responses = append(responses, resp)
+		}
+		// the responses of a batch are not in the order of the requests
+		slices.Reverse(responses)
+		_ = json.NewEncoder(w).Encode(map[string]any{"responses": responses})
+	}))
+	t.Cleanup(srv.Close)
+	return f, (&fakeGraph{srv: srv}).client()
+}
+
+func okResp(req BatchReq) BatchResp {
+	return BatchResp{Status: http.StatusOK, Body: json.RawMessage(`{"id":"` + req.Id + `"}`)}
+}
+
+func batchReqs(n int) []BatchReq {
+	reqs := make([]BatchReq, n)
+	for i := range reqs {
+		reqs[i] = BatchReq{Id: strconv.Itoa(i), Method: "GET", Url: "/me/drive/items/" + strconv.Itoa(i)}
+	}
+	return reqs
+}
+
+func TestBatchDoSplits(t *testing.T) {
+	f, client := newFakeBatch(t, func(req BatchReq, _ int) BatchResp {
+		return okResp(req)
+	})
+	reqs := batchReqs(45)
+	responses, err := client.BatchDo(reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sizes []int
+	for _, batch := range f.batches {
+		sizes = append(sizes, len(batch))
+	}
+	if !slices.Equal(sizes, []int{20, 20, 5}) {
+		t.Fatalf("sent batches of %v", sizes)
+	}
+	for i, resp := range responses {
+		if resp.Id != reqs[i].Id || string(resp.Body) != `{"id":"`+reqs[i].Id+`"}` {
+			t.Fatalf("response %d is %s %s", i, resp.Id, resp.Body)
+		}
+	}
+}
+
+func TestBatchDoDependsOn(t *testing.T) {
+	f, client := newFakeBatch(t, func(req BatchReq, _ int) BatchResp {
+		if req.Id == "19" || req.Id == "22" {
+			return BatchResp{Status: http.StatusConflict, Body: json.RawMessage(`{"error":{"code":"nameAlreadyExists","message":"exists"}}`)}
+		}
+		return okResp(req)
+	})
+	reqs := batchReqs(25)
+	// 19 in the first batch fails, 20 depends on it across the boundary
+	reqs[20].DependsOn = []string{"19"}
+	// 18 in the first batch succeeds, 21 is sent without the dependency Graph cannot see
+	reqs[21].DependsOn = []string{"18"}
+	// 22 fails in the same batch as 23, Graph answers 23
+	reqs[23].DependsOn = []string{"22"}
+	// 24 depends on one of each
+	reqs[24].DependsOn = []string{"21", "20"}
+	responses, err := client.BatchDo(reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]int{19: http.StatusConflict, 20: http.StatusFailedDependency, 21: http.StatusOK, 22: http.StatusConflict, 23: http.StatusFailedDependency, 24: http.StatusFailedDependency}
+	for i, status := range want {
+		if responses[i].Status != status {
+			t.Errorf("request %d: status %d, want %d", i, responses[i].Status, status)
+		}
+	}
+	if len(f.batches) != 2 {
+		t.Fatalf("sent %d batches", len(f.batches))
+	}
+	var sent []string
+	for _, req := range f.batches[1] {
+		sent = append(sent, req.Id)
+		if req.Id == "21" && len(req.DependsOn) != 0 {
+			t.Errorf("21 is sent depending on %v", req.DependsOn)
+		}
+		if req.Id == "23" && !slices.Equal(req.DependsOn, []string{"22"}) {
+			t.Errorf("23 is sent depending on %v", req.DependsOn)
+		}
+	}
+	if !slices.Equal(sent, []string{"21", "22", "23"}) {
+		t.Fatalf("second batch sent %v, the ones with a failed dependency are not sent", sent)
+	}
+	if err := responses[20].Err(reqs[20]); err == nil || GetErrorType(err) != ErrorUnknown {
+		t.Fatalf("error of a failed dependency %v", err)
+	}
+}
+
+func TestBatchDoRetriesRateLimited(t *testing.T) {
+	f, client := newFakeBatch(t, func(req BatchReq, attempt int) BatchResp {
+		if req.Id == "1" && attempt == 1 {
+			return BatchResp{Status: http.StatusTooManyRequests, Headers: map[string]string{"Retry-After": "1"}}
+		}
+		return okResp(req)
+	})
+	reqs := batchReqs(3)
+	// 2 fails with 1 in the first attempt and is sent again with it
+	reqs[2].DependsOn = []string{"1"}
+	start := time.Now()
+	responses, err := client.BatchDo(reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Fatalf("sent again after %s, before the Retry-After", elapsed)
+	}
+	for i, resp := range responses {
+		if resp.Status != http.StatusOK {
+			t.Errorf("request %d: status %d", i, resp.Status)
+		}
+	}
+	if len(f.batches) != 2 {
+		t.Fatalf("sent %d batches, want one retry", len(f.batches))
+	}
+	var retried []string
+	for _, req := range f.batches[1] {
+		retried = append(retried, fmt.Sprintf("%s%v", req.Id, req.DependsOn))
+	}
+	if !slices.Equal(retried, []string{"1[]", "2[1]"}) {
+		t.Fatalf("retried %v, want the limited request and its dependent", retried)
+	}
+	if f.attempts["0"] != 1 {
+		t.Fatalf("request 0 is sent %d times", f.attempts["0"])
+	}
+}
+
+func TestGetItems(t *testing.T) {
+	_, client := newFakeBatch(t, func(req BatchReq, _ int) BatchResp {
+		switch req.Url {
+		case "/me/drive/root:/Beatmaps/a%20b.osz:/?" + itemSelect:
+			return BatchResp{Status: http.StatusOK, Body: json.RawMessage(`{"id":"item","name":"a b.osz"}`)}
+		case "/me/drive/root:/Beatmaps/missing.osz:/?" + itemSelect:
+			return BatchResp{Status: http.StatusNotFound, Body: json.RawMessage(`{"error":{"code":"itemNotFound","message":"not found"}}`)}
+		}
+		return BatchResp{Status: http.StatusInternalServerError}
+	})
+	items, errs := client.GetItems([]string{"Beatmaps/a b.osz", "Beatmaps/missing.osz", "other"})
+	if items[0] == nil || items[0].Id != "item" || errs[0] != nil {
+		t.Fatalf("got %+v, %v", items[0], errs[0])
+	}
+	if items[1] != nil || errs[1] != nil {
+		t.Fatalf("missing item is %+v, %v", items[1], errs[1])
+	}
+	if items[2] != nil || GetErrorType(errs[2]) != ErrorServer {
+		t.Fatalf("failed lookup is %+v, %v", items[2], errs[2])
+	}
+}
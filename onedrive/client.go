@@ -7,14 +7,15 @@ import (
 	"errors"
 	"fmt"
 	"github.com/MingxuanGame/OsuBeatmapSync/base_service"
+	"github.com/MingxuanGame/OsuBeatmapSync/metrics"
 	. "github.com/MingxuanGame/OsuBeatmapSync/model"
 	. "github.com/MingxuanGame/OsuBeatmapSync/model/onedrive"
 	"github.com/MingxuanGame/OsuBeatmapSync/utils"
 	"golang.org/x/oauth2"
 	"io"
+	"math"
 	"net/http"
 	"net/url"
-	"strings"
 	"time"
 )
 
@@ -22,26 +23,14 @@ const AuthUrl string = "https://login.microsoftonline.com/%s/oauth2/v2.0/authori
 const TokenUrl string = "https://login.microsoftonline.com/%s/oauth2/v2.0/token"
 const RootUrl string = "https://graph.microsoft.com/v1.0"
 
+const maxRateLimitRetry = 8
+
 type GraphClient struct {
 	Config *OneDrive
 	*http.Client
 	ctx context.Context
 }
 
-type BatchReq struct {
-	Id     string `json:"id"`
-	Method string `json:"method"`
-	Url    string `json:"url"`
-	Dep    string `json:"dependsOn,omitempty"`
-}
-
-type BatchResp struct {
-	Id      string            `json:"id"`
-	Status  int               `json:"status"`
-	Headers map[string]string `json:"headers"`
-	Body    string            `json:"body"`
-}
-
 var logger = base_service.GetLogger("onedrive")
 
 func NewGraphClient(clientId string, clientSecret string, tenant string, ctx context.Context) (*GraphClient, error) {
@@ -156,35 +145,55 @@ func (client *GraphClient) NewRequestJson(method, url string, data interface{})
 }
 
 func (client *GraphClient) Do(req *http.Request) (*http.Response, error) {
+	return client.do(req, 0)
+}
+
+func (client *GraphClient) do(req *http.Request, rateLimitRetry int) (*http.Response, error) {
 	logger.Trace().Msgf("Do Request: %s %s", req.Method, req.URL.String())
 	resp, err := client.Client.Do(req)
 	if err != nil {
+		var retrieveError *oauth2.RetrieveError
+		if errors.As(err, &retrieveError) {
+			return nil, NewRequestError(ErrorAuthExpired, "onedrive", req.URL.String(), 0, err)
+		}
 		return nil, err
 	}
 	if resp.StatusCode == 429 {
+		metrics.RateLimited.WithLabelValues("onedrive").Inc()
+		_ = resp.Body.Close()
 		retryAfter, ctx, err := utils.GetLimitSecond(resp.Header.Get("Retry-After"), client.ctx)
 		if err != nil {
-			return nil, err
+			retryAfter = time.Duration(math.Pow(2, float64(rateLimitRetry))) * time.Second
+		} else {
+			client.ctx = ctx
+		}
+		if rateLimitRetry >= maxRateLimitRetry {
+			requestError := NewRequestError(ErrorRateLimited, "onedrive", req.URL.String(), resp.StatusCode, fmt.Errorf("retry limit exceeded"))
+			requestError.RetryAfter = retryAfter
+			return nil, requestError
 		}
-		client.ctx = ctx
 		logger.Info().Str("api", "onedrive").Msgf("Rate limited, sleeping for %s.", retryAfter)
-		time.Sleep(retryAfter)
-		body, err := io.ReadAll(req.Body)
-		if err != nil {
-			return nil, err
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(retryAfter):
 		}
-		retryUrl, ok := strings.CutPrefix(req.URL.String(), RootUrl)
-		if !ok {
-			retryUrl = req.URL.String()
+		newReq := req.Clone(req.Context())
+		if req.GetBody != nil {
+			newReq.Body, err = req.GetBody()
+			if err != nil {
+				return nil, err
+			}
 		}
-		newReq, err := client.NewRequest(req.Method, retryUrl, body)
-		newReq.Header = req.Header
-		return client.Do(newReq)
+		return client.do(newReq, rateLimitRetry+1)
 	}
 	return resp, nil
 }
 
 func (client *GraphClient) ReadData(resp *http.Response) ([]byte, error) {
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(resp.Body)
 	data, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, &url.Error{
@@ -194,46 +203,20 @@ func (client *GraphClient) ReadData(resp *http.Response) ([]byte, error) {
 		}
 	}
 	if resp.StatusCode >= 400 {
-		var errMsg ErrorResponse
-		err := json.Unmarshal(data, &errMsg)
-		if err == nil {
-			return nil, &url.Error{
-				Op:  "",
-				URL: resp.Request.Method,
-				Err: fmt.Errorf("status: %s, error: %s", resp.Status, errMsg.Error.Message),
-			}
-		}
-		return nil, &url.Error{
-			Op:  "",
-			URL: resp.Request.Method,
-			Err: fmt.Errorf("status code: %d", resp.StatusCode),
-		}
+		return nil, responseError(resp, data)
 	}
 	return data, nil
 }
 
-func (client *GraphClient) BatchDo(reqs []BatchReq) ([]BatchResp, error) {
-	jsonData, err := json.Marshal(struct {
-		Requests []BatchReq `json:"requests"`
-	}{
-		Requests: reqs,
-	})
-	if err != nil {
-		return nil, err
-	}
-	req, err := client.NewRequest("POST", "/$batch", jsonData)
-	if err != nil {
-		return nil, err
-	}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("error: %d", resp.StatusCode)
-	}
-	var response struct {
-		Response []BatchResp `json:"responses"`
+func responseError(resp *http.Response, data []byte) *RequestError {
+	typ := ErrorTypeFromStatus(resp.StatusCode)
+	var errMsg ErrorResponse
+	err := json.Unmarshal(data, &errMsg)
+	if err == nil && errMsg.Error.Message != "" {
+		if errMsg.Error.Code == "InvalidAuthenticationToken" {
+			typ = ErrorAuthExpired
+		}
+		return NewRequestError(typ, "onedrive", resp.Request.Method+" "+resp.Request.URL.String(), resp.StatusCode, fmt.Errorf("status: %s, error: %s", resp.Status, errMsg.Error.Message))
 	}
-	return response.Response, nil
+	return NewRequestError(typ, "onedrive", resp.Request.Method+" "+resp.Request.URL.String(), resp.StatusCode, fmt.Errorf("status code: %d", resp.StatusCode))
 }
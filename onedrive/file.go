@@ -4,103 +4,95 @@ import (
 	"encoding/json"
 	"fmt"
 	. "github.com/MingxuanGame/OsuBeatmapSync/model/onedrive"
+	"io"
+	"net/http"
 	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 const shareLinkRegex = `https:\/\/(\S+).sharepoint.com\/:\S:\/g\/personal\/(\S+)\/([a-zA-Z_\-0-9]+)`
 
-func (client *GraphClient) ListFiles(path string, length int, nextUrl string) (*[]DriveItem, error) {
-	u := "/me/drive/root:/" + path + ":/children?select=id,name,size,file,folder,shared,parentReference&top=" + strconv.Itoa(length)
-	if nextUrl != "" {
-		u = u + "&$skiptoken=" + nextUrl
-	}
-	req, err := client.NewRequest("GET", u, nil)
+// getJson gets the json at a full url, like the @odata.nextLink of a page
+func (client *GraphClient) getJson(u string, v any) error {
+	logger.Trace().Msgf("New Request: GET %s", u)
+	req, err := http.NewRequestWithContext(client.ctx, "GET", u, nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
-
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, err
+		return err
 	}
-
 	data, err := client.ReadData(resp)
 	if err != nil {
-		return nil, err
-	}
-	var response struct {
-		Value    []DriveItem `json:"value"`
-		NextItem string      `json:"@odata.nextLink"`
-	}
-	err = json.Unmarshal(data, &response)
-	if err != nil {
-		return nil, err
-	}
-	files := response.Value
-	if len(files) == 0 {
-		return nil, nil
+		return err
 	}
+	return json.Unmarshal(data, v)
+}
 
-	if len(files) > length {
-		return &files, nil
-	}
-	for {
-		logger.Info().Str("path", path).Msgf("Got %d, remaining %d", len(files), length-len(files))
-		if response.NextItem == "" || len(files) >= length {
-			break
+// ListFiles returns the children of the folder, following every page
+func (client *GraphClient) ListFiles(path string, pageSize int) ([]DriveItem, error) {
+	u := RootUrl + "/me/drive/root:/" + path + ":/children?" + itemSelect + "&top=" + strconv.Itoa(pageSize)
+	var files []DriveItem
+	for u != "" {
+		var response struct {
+			Value    []DriveItem `json:"value"`
+			NextLink string      `json:"@odata.nextLink"`
 		}
-		m, err := url.ParseQuery(strings.Split(response.NextItem, "?")[1])
+		err := client.getJson(u, &response)
 		if err != nil {
 			return nil, err
 		}
-		nextUrl := m.Get("$skiptoken")
-		nextFiles, err := client.ListFiles(path, length-len(files), nextUrl)
-		if err != nil {
-			return nil, err
-		}
-		files = append(files, *nextFiles...)
-		break
+		files = append(files, response.Value...)
+		u = response.NextLink
+		logger.Debug().Str("path", path).Msgf("Got %d", len(files))
 	}
-	return &files, nil
+	return files, nil
 }
 
-func (client *GraphClient) ListAllFiles(root string, length int) ([]DriveItem, error) {
-	var wg sync.WaitGroup
-
-	rootFiles, err := client.ListFiles(root, length, "")
+// ListAllFiles returns the files under root and its subfolders, the subfolders are listed concurrently
+func (client *GraphClient) ListAllFiles(root string, pageSize int) ([]DriveItem, error) {
+	rootFiles, err := client.ListFiles(root, pageSize)
 	if err != nil {
 		return nil, err
 	}
-	var dirs []DriveItem
 	var allFiles []DriveItem
-	if rootFiles == nil {
-		return nil, nil
-	}
-	for _, file := range *rootFiles {
+	var dirs []DriveItem
+	for _, file := range rootFiles {
 		if file.Folder != nil {
 			dirs = append(dirs, file)
-		} else if strings.HasSuffix(file.Name, ".osz") {
+		} else {
 			allFiles = append(allFiles, file)
 		}
 	}
 
+	var wg sync.WaitGroup
+	var mux sync.Mutex
+	var firstErr error
 	for _, dir := range dirs {
 		wg.Add(1)
-		go func(dir *DriveItem, wg *sync.WaitGroup) {
+		go func(dir DriveItem) {
 			defer wg.Done()
-			files, err := client.ListAllFiles(root+"/"+dir.Name, dir.Folder.ChildCount)
+			files, err := client.ListAllFiles(root+"/"+url.PathEscape(dir.Name), pageSize)
+			mux.Lock()
+			defer mux.Unlock()
 			if err != nil {
-				logger.Error().Err(err).Msg("Failed to list files")
+				if firstErr == nil {
+					firstErr = err
+				}
 				return
 			}
 			allFiles = append(allFiles, files...)
-		}(&dir, &wg)
+		}(dir)
 	}
 	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
 	return allFiles, nil
 }
 
@@ -121,10 +113,15 @@ func (client *GraphClient) MakeShareLink(item string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	return downloadLink(data)
+}
+
+// downloadLink returns the direct download link of the share link in a createLink response
+func downloadLink(data []byte) (string, error) {
 	var response struct {
 		Link ShareLink `json:"link"`
 	}
-	err = json.Unmarshal(data, &response)
+	err := json.Unmarshal(data, &response)
 	if err != nil {
 		return "", err
 	}
@@ -161,7 +158,7 @@ func (client *GraphClient) GetItem(path, filename string) (*DriveItem, error) {
 	if filename != "" {
 		path = path + "/" + url.PathEscape(filename)
 	}
-	req, err := client.NewRequest("GET", "/me/drive/root:/"+path+":/?select=id,name,size,file,folder,shared,parentReference", nil)
+	req, err := client.NewRequest("GET", "/me/drive/root:/"+path+":/?"+itemSelect, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -171,6 +168,7 @@ func (client *GraphClient) GetItem(path, filename string) (*DriveItem, error) {
 		return nil, err
 	}
 	if resp.StatusCode == 404 {
+		_ = resp.Body.Close()
 		return nil, nil
 	}
 	data, err := client.ReadData(resp)
@@ -186,10 +184,18 @@ func (client *GraphClient) GetItem(path, filename string) (*DriveItem, error) {
 }
 
 func (client *GraphClient) DeleteItem(itemId string) error {
+	return client.DeleteItemIfMatch(itemId, "")
+}
+
+// DeleteItemIfMatch deletes the item only if it is not changed since eTag, an empty eTag deletes it anyway
+func (client *GraphClient) DeleteItemIfMatch(itemId, eTag string) error {
 	req, err := client.NewRequest("DELETE", "/me/drive/items/"+itemId, nil)
 	if err != nil {
 		return err
 	}
+	if eTag != "" {
+		req.Header.Set("If-Match", eTag)
+	}
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -202,10 +208,16 @@ func (client *GraphClient) DeleteItem(itemId string) error {
 	return nil
 }
 
-func (client *GraphClient) MoveItem(itemId, targetId string) error {
-	req, err := client.NewRequestJson("PATCH", "/me/drive/items/"+itemId, map[string]interface{}{
-		"parentReference": map[string]string{"id": targetId},
-	})
+// MoveItem moves the item into the folder, replacing the existing file. The item is renamed if name is not empty.
+func (client *GraphClient) MoveItem(itemId, targetId, name string) error {
+	body := map[string]interface{}{
+		"parentReference":                   map[string]string{"id": targetId},
+		"@microsoft.graph.conflictBehavior": "replace",
+	}
+	if name != "" {
+		body["name"] = name
+	}
+	req, err := client.NewRequestJson("PATCH", "/me/drive/items/"+itemId, body)
 	if err != nil {
 		return err
 	}
@@ -221,6 +233,88 @@ func (client *GraphClient) MoveItem(itemId, targetId string) error {
 	return nil
 }
 
+type copyStatus struct {
+	Status     string `json:"status"`
+	ResourceId string `json:"resourceId"`
+	Error      *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// CopyItem copies the item into the folder on the server, replacing the existing file, and waits until the copy is finished
+func (client *GraphClient) CopyItem(itemId, parentId, name string) error {
+	req, err := client.NewRequestJson("POST", "/me/drive/items/"+itemId+"/copy?@microsoft.graph.conflictBehavior=replace", map[string]interface{}{
+		"parentReference": map[string]string{"id": parentId},
+		"name":            name,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	_, err = client.ReadData(resp)
+	if err != nil {
+		return err
+	}
+	monitor := resp.Header.Get("Location")
+	if monitor == "" {
+		return fmt.Errorf("no monitor url for copying %s", itemId)
+	}
+
+	// the monitor url is pre-authenticated and must not be called with the token
+	monitorClient := &http.Client{
+		Timeout: 30 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	for {
+		req, err := http.NewRequestWithContext(client.ctx, "GET", monitor, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := monitorClient.Do(req)
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		// some drives redirect to the new item when the copy is done
+		if resp.StatusCode == http.StatusSeeOther {
+			return nil
+		}
+		if resp.StatusCode >= 400 {
+			return responseError(resp, data)
+		}
+		var status copyStatus
+		err = json.Unmarshal(data, &status)
+		if err != nil {
+			return err
+		}
+		switch status.Status {
+		case "completed":
+			return nil
+		case "failed", "cancelled":
+			if status.Error != nil {
+				return fmt.Errorf("copy %s failed: %s: %s", itemId, status.Error.Code, status.Error.Message)
+			}
+			return fmt.Errorf("copy %s %s", itemId, status.Status)
+		}
+		select {
+		case <-client.ctx.Done():
+			return client.ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
 func (client *GraphClient) CreateFolder(parentId, name string) (*DriveItem, error) {
 	req, err := client.NewRequestJson("POST", "/me/drive/items/"+parentId+"/children", map[string]interface{}{
 		"name": name, "folder": map[string]interface{}{},
@@ -0,0 +1,247 @@
+package onedrive
+
+import (
+	"encoding/json"
+	"errors"
+	. "github.com/MingxuanGame/OsuBeatmapSync/model"
+	. "github.com/MingxuanGame/OsuBeatmapSync/model/onedrive"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// DriveIndexFilename keeps the mirror of the drive tree in the working directory, delete it to list the drive again
+const DriveIndexFilename = "driveIndex.json"
+
+const deltaSelect = "select=id,name,size,eTag,file,folder,deleted,parentReference,root"
+
+// IndexedItem is a file or folder in the mirror of the drive tree
+type IndexedItem struct {
+	Name     string `json:"name"`
+	ParentId string `json:"parentId"`
+	Folder   bool   `json:"folder,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	ETag     string `json:"eTag,omitempty"`
+	// Hash is the base64 QuickXorHash of a file
+	Hash string `json:"hash,omitempty"`
+}
+
+// DriveIndex is a local mirror of the drive tree, kept up to date with the delta API.
+// It answers lookups of files and folders without listing the drive.
+type DriveIndex struct {
+	// DeltaLink continues the delta from the last update, empty before the first one
+	DeltaLink string                  `json:"deltaLink"`
+	RootId    string                  `json:"rootId"`
+	Items     map[string]*IndexedItem `json:"items"`
+
+	mux sync.RWMutex
+}
+
+// LoadDriveIndex reads the index from the file, an index that does not exist yet is empty
+func LoadDriveIndex(filename string) (*DriveIndex, error) {
+	index := &DriveIndex{Items: make(map[string]*IndexedItem)}
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, index)
+	if err != nil {
+		// the next Save replaces the broken file
+		logger.Warn().Err(err).Msgf("Failed to parse %s, listing the drive again", filename)
+		return &DriveIndex{Items: make(map[string]*IndexedItem)}, nil
+	}
+	if index.Items == nil {
+		index.Items = make(map[string]*IndexedItem)
+	}
+	return index, nil
+}
+
+// Save writes the index to a temporary file first, so a crash while writing keeps the last index
+func (index *DriveIndex) Save(filename string) error {
+	index.mux.RLock()
+	data, err := json.Marshal(index)
+	index.mux.RUnlock()
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filename+".tmp", data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+func (index *DriveIndex) apply(item DriveItem) {
+	if item.Deleted != nil {
+		delete(index.Items, item.Id)
+		return
+	}
+	if item.Root != nil {
+		index.RootId = item.Id
+		return
+	}
+	indexed := &IndexedItem{
+		Name:     item.Name,
+		ParentId: item.ParentReference.Id,
+		Folder:   item.Folder != nil,
+		Size:     item.Size,
+		ETag:     item.ETag,
+	}
+	if item.File != nil {
+		indexed.Hash = item.File.Hashes.QuickXorHash
+	}
+	index.Items[item.Id] = indexed
+}
+
+// prune removes the items whose parent is gone, a deleted folder is not always reported with its children
+func (index *DriveIndex) prune() {
+	paths := make(map[string]string)
+	for id := range index.Items {
+		if _, ok := index.path(id, paths); !ok {
+			delete(index.Items, id)
+		}
+	}
+}
+
+// path returns the path of the item relative to the drive root, ok is false if a parent is not in the index.
+// Paths of folders are cached in paths.
+func (index *DriveIndex) path(id string, paths map[string]string) (string, bool) {
+	if id == index.RootId {
+		return "", true
+	}
+	if p, ok := paths[id]; ok {
+		return p, true
+	}
+	item, ok := index.Items[id]
+	if !ok {
+		return "", false
+	}
+	parent, ok := index.path(item.ParentId, paths)
+	if !ok {
+		return "", false
+	}
+	p := item.Name
+	if parent != "" {
+		p = parent + "/" + item.Name
+	}
+	if item.Folder {
+		paths[id] = p
+	}
+	return p, true
+}
+
+func (index *DriveIndex) toDriveItem(id, p string) DriveItem {
+	indexed := index.Items[id]
+	item := DriveItem{Id: id, Name: indexed.Name, Size: indexed.Size, ETag: indexed.ETag}
+	item.ParentReference.Id = indexed.ParentId
+	item.ParentReference.Path = "/drive/root:/" + strings.TrimPrefix(path.Dir("/"+p), "/")
+	if indexed.Folder {
+		item.Folder = &FolderFacet{}
+	} else {
+		item.File = &FileFacet{}
+		item.File.Hashes.QuickXorHash = indexed.Hash
+	}
+	return item
+}
+
+// Files returns the files under dir and its subfolders by path, dir is relative to the drive root
+func (index *DriveIndex) Files(dir string) []DriveItem {
+	index.mux.RLock()
+	defer index.mux.RUnlock()
+	dir = strings.Trim(dir, "/")
+	paths := make(map[string]string)
+	var files []DriveItem
+	for id, item := range index.Items {
+		if item.Folder {
+			continue
+		}
+		p, ok := index.path(id, paths)
+		if !ok || (dir != "" && !strings.HasPrefix(p, dir+"/")) {
+			continue
+		}
+		files = append(files, index.toDriveItem(id, p))
+	}
+	slices.SortFunc(files, func(a, b DriveItem) int {
+		return strings.Compare(a.Path(), b.Path())
+	})
+	return files
+}
+
+// Lookup returns the file or folder at the path, or nil if it is not in the index. It walks the whole index.
+func (index *DriveIndex) Lookup(p string) *DriveItem {
+	index.mux.RLock()
+	defer index.mux.RUnlock()
+	p = strings.Trim(p, "/")
+	paths := make(map[string]string)
+	for id := range index.Items {
+		if itemPath, ok := index.path(id, paths); ok && itemPath == p {
+			item := index.toDriveItem(id, p)
+			return &item
+		}
+	}
+	return nil
+}
+
+// UpdateIndex applies the changes of the drive since the last update to the index.
+// The first update, or one after the delta link expired, reads the whole drive.
+func (client *GraphClient) UpdateIndex(index *DriveIndex) error {
+	index.mux.Lock()
+	defer index.mux.Unlock()
+	u := index.DeltaLink
+	if u == "" {
+		u = RootUrl + "/me/drive/root/delta?" + deltaSelect
+	}
+	changes := 0
+	for {
+		var response struct {
+			Value     []DriveItem `json:"value"`
+			NextLink  string      `json:"@odata.nextLink"`
+			DeltaLink string      `json:"@odata.deltaLink"`
+		}
+		err := client.getJson(u, &response)
+		// 410 means the delta link expired, the drive is read again from the start
+		var requestError *RequestError
+		if errors.As(err, &requestError) && requestError.StatusCode == http.StatusGone && index.DeltaLink != "" {
+			logger.Warn().Msg("Delta link expired, indexing the drive again")
+			index.DeltaLink, index.RootId = "", ""
+			index.Items = make(map[string]*IndexedItem)
+			u = RootUrl + "/me/drive/root/delta?" + deltaSelect
+			changes = 0
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, item := range response.Value {
+			index.apply(item)
+		}
+		changes += len(response.Value)
+		if response.DeltaLink != "" {
+			index.DeltaLink = response.DeltaLink
+			break
+		}
+		if response.NextLink == "" {
+			break
+		}
+		u = response.NextLink
+		logger.Debug().Msgf("Indexed %d change(s)", changes)
+	}
+	// the root is in the first delta, look it up if it is missing so the paths can be built
+	if index.RootId == "" {
+		var root DriveItem
+		err := client.getJson(RootUrl+"/me/drive/root?select=id", &root)
+		if err != nil {
+			return err
+		}
+		index.RootId = root.Id
+	}
+	index.prune()
+	logger.Info().Msgf("Drive index updated with %d change(s), %d item(s)", changes, len(index.Items))
+	return nil
+}
@@ -0,0 +1,234 @@
+package onedrive
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type apiResponse struct {
+	status int
+	body   string
+}
+
+// fakeApi answers GET requests by path and query, the requests it got are kept in order
+type fakeApi struct {
+	mux       sync.Mutex
+	responses map[string]apiResponse
+	requests  []string
+}
+
+func newFakeApi(t *testing.T) (*fakeApi, *GraphClient) {
+	api := &fakeApi{responses: make(map[string]apiResponse)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		api.mux.Lock()
+		defer api.mux.Unlock()
+		key := r.URL.Path + "?" + r.URL.RawQuery
+		api.requests = append(api.requests, key)
+		response, ok := api.responses[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if response.status != 0 {
+			w.WriteHeader(response.status)
+		}
+		_, _ = w.Write([]byte(response.body))
+	}))
+	t.Cleanup(srv.Close)
+	return api, (&fakeGraph{srv: srv}).client()
+}
+
+func (api *fakeApi) set(key string, status int, body string) {
+	api.mux.Lock()
+	defer api.mux.Unlock()
+	api.responses[key] = apiResponse{status, body}
+}
+
+// page is a response with the items and a link to the next page or the next delta
+func page(link string, items ...string) string {
+	return `{"value":[` + strings.Join(items, ",") + `],` + link + `}`
+}
+
+func nextLink(query string) string {
+	return `"@odata.nextLink":"` + RootUrl + "/me/drive/root/delta?" + query + `"`
+}
+
+func deltaLink(query string) string {
+	return `"@odata.deltaLink":"` + RootUrl + "/me/drive/root/delta?" + query + `"`
+}
+
+func folderItem(id, name, parent string) string {
+	return fmt.Sprintf(`{"id":%q,"name":%q,"folder":{"childCount":0},"parentReference":{"id":%q}}`, id, name, parent)
+}
+
+func fileItem(id, name, parent string) string {
+	return fmt.Sprintf(`{"id":%q,"name":%q,"size":1,"file":{"hashes":{"quickXorHash":"%s=="}},"parentReference":{"id":%q}}`, id, name, id, parent)
+}
+
+const rootItem = `{"id":"root","name":"root","folder":{},"root":{}}`
+
+func indexedPaths(index *DriveIndex) []string {
+	var paths []string
+	for _, item := range index.Files("") {
+		paths = append(paths, item.Path())
+	}
+	return paths
+}
+
+func TestUpdateIndex(t *testing.T) {
+	api, client := newFakeApi(t)
+	const delta = "/v1.0/me/drive/root/delta?"
+	// the first read of the drive is in two pages
+	api.set(delta+deltaSelect, 0, page(nextLink("token=page2"),
+		rootItem,
+		folderItem("a", "A", "root"),
+		fileItem("f1", "1.osz", "a"),
+	))
+	api.set(delta+"token=page2", 0, page(deltaLink("token=d1"),
+		folderItem("b", "B", "root"),
+		fileItem("f2", "2.osz", "b"),
+		folderItem("c", "C", "b"),
+		fileItem("f3", "3.osz", "c"),
+	))
+	index := &DriveIndex{Items: make(map[string]*IndexedItem)}
+	err := client.UpdateIndex(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := indexedPaths(index), []string{"A/1.osz", "B/2.osz", "B/C/3.osz"}; !slices.Equal(got, want) {
+		t.Fatalf("indexed %v, want %v", got, want)
+	}
+	if !strings.HasSuffix(index.DeltaLink, "token=d1") {
+		t.Fatalf("delta link %s", index.DeltaLink)
+	}
+	if item := index.Lookup("B/C"); item == nil || !item.IsFolder() {
+		t.Fatalf("looked up folder %+v", item)
+	}
+
+	// B is deleted without its children, 1.osz is moved to the root and renamed
+	api.set(delta+"token=d1", 0, page(deltaLink("token=d2"),
+		`{"id":"b","name":"B","deleted":{"state":"deleted"},"parentReference":{"id":"root"}}`,
+		fileItem("f1", "moved.osz", "root"),
+	))
+	err = client.UpdateIndex(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := indexedPaths(index), []string{"moved.osz"}; !slices.Equal(got, want) {
+		t.Fatalf("indexed %v after the changes, want %v", got, want)
+	}
+	for _, id := range []string{"b", "c", "f2", "f3"} {
+		if _, ok := index.Items[id]; ok {
+			t.Fatalf("%s under the deleted folder is kept", id)
+		}
+	}
+	if index.Lookup("A/1.osz") != nil {
+		t.Fatal("moved file is found at the old path")
+	}
+	if item := index.Lookup("moved.osz"); item == nil || item.File.Hashes.QuickXorHash != "f1==" {
+		t.Fatalf("looked up moved file %+v", item)
+	}
+
+	// the delta link expired, the drive is read again from the start
+	api.set(delta+"token=d2", http.StatusGone, `{"error":{"code":"resyncRequired","message":"Resync required"}}`)
+	api.set(delta+deltaSelect, 0, page(deltaLink("token=d3"),
+		rootItem,
+		fileItem("f4", "new.osz", "root"),
+	))
+	err = client.UpdateIndex(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := indexedPaths(index), []string{"new.osz"}; !slices.Equal(got, want) {
+		t.Fatalf("indexed %v after reading the drive again, want %v", got, want)
+	}
+	if !strings.HasSuffix(index.DeltaLink, "token=d3") {
+		t.Fatalf("delta link %s after reading the drive again", index.DeltaLink)
+	}
+	want := []string{delta + deltaSelect, delta + "token=page2", delta + "token=d1", delta + "token=d2", delta + deltaSelect}
+	if !slices.Equal(api.requests, want) {
+		t.Fatalf("requested\n%s\nwant\n%s", strings.Join(api.requests, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestUpdateIndexWithoutRoot(t *testing.T) {
+	api, client := newFakeApi(t)
+	// a delta that does not report the root folder, it is looked up by itself
+	api.set("/v1.0/me/drive/root/delta?"+deltaSelect, 0, page(deltaLink("token=d1"), fileItem("f1", "1.osz", "root-id")))
+	api.set("/v1.0/me/drive/root?select=id", 0, `{"id":"root-id"}`)
+	index := &DriveIndex{Items: make(map[string]*IndexedItem)}
+	err := client.UpdateIndex(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index.RootId != "root-id" || !slices.Equal(indexedPaths(index), []string{"1.osz"}) {
+		t.Fatalf("root %s, indexed %v", index.RootId, indexedPaths(index))
+	}
+}
+
+func TestDriveIndexSave(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), DriveIndexFilename)
+	index := &DriveIndex{DeltaLink: "link", RootId: "root", Items: map[string]*IndexedItem{
+		"f1": {Name: "1.osz", ParentId: "root", Size: 1, Hash: "hash"},
+	}}
+	err := index.Save(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filename + ".tmp"); !os.IsNotExist(err) {
+		t.Fatal("temporary file is kept")
+	}
+	loaded, err := LoadDriveIndex(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.DeltaLink != "link" || loaded.RootId != "root" || *loaded.Items["f1"] != *index.Items["f1"] {
+		t.Fatalf("loaded %+v", loaded)
+	}
+
+	// a file cut by a crash is read as an empty index, so the drive is listed again
+	err = os.WriteFile(filename, []byte(`{"deltaLink":"link","items":{"f1":{"na`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err = LoadDriveIndex(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.DeltaLink != "" || len(loaded.Items) != 0 {
+		t.Fatalf("loaded %+v from a broken file", loaded)
+	}
+}
+
+func TestListFiles(t *testing.T) {
+	api, client := newFakeApi(t)
+	const children = "/v1.0/me/drive/root:/Beatmaps:/children?"
+	link := func(query string) string {
+		return `"@odata.nextLink":"` + RootUrl + "/me/drive/root:/Beatmaps:/children?" + query + `"`
+	}
+	api.set(children+itemSelect+"&top=2", 0, page(link("token=2"), fileItem("f1", "1.osz", "b"), fileItem("f2", "2.osz", "b")))
+	api.set(children+"token=2", 0, page(link("token=3"), fileItem("f3", "3.osz", "b"), folderItem("c", "C", "b")))
+	api.set(children+"token=3", 0, `{"value":[`+fileItem("f4", "4.osz", "b")+`]}`)
+	files, err := client.ListFiles("Beatmaps", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+	if want := []string{"1.osz", "2.osz", "3.osz", "C", "4.osz"}; !slices.Equal(names, want) {
+		t.Fatalf("listed %v, want %v", names, want)
+	}
+	if len(api.requests) != 3 {
+		t.Fatalf("%d request(s), want one per page", len(api.requests))
+	}
+}
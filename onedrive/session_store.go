@@ -0,0 +1,127 @@
+package onedrive
+
+import (
+	"encoding/json"
+	"maps"
+	"os"
+	"sync"
+	"time"
+)
+
+// UploadSessionsFilename keeps the upload sessions of large files in the working directory,
+// so an upload interrupted by an error or a restart continues where it stopped
+const UploadSessionsFilename = "uploadSessions.json"
+
+type savedSession struct {
+	UploadUrl string    `json:"uploadUrl"`
+	Expires   time.Time `json:"expires"`
+	Size      int64     `json:"size"`
+	// Sent is the bytes acknowledged at the end of the last finished chunk
+	Sent int64 `json:"sent"`
+	// SentHash is the quickXorHash of the first Sent bytes, a resumed upload must have the same.
+	// It is empty before the first chunk is finished.
+	SentHash string `json:"sentHash"`
+}
+
+// sessionStore keeps the saved sessions in memory, the file is read once and written by a single writer
+// after every change. Changes made while the file is written are coalesced into the next write.
+type sessionStore struct {
+	mux      sync.Mutex
+	once     sync.Once
+	filename string
+	saved    map[string]savedSession
+	dirty    chan struct{}
+}
+
+var sessions = newSessionStore(UploadSessionsFilename)
+
+func newSessionStore(filename string) *sessionStore {
+	return &sessionStore{filename: filename, dirty: make(chan struct{}, 1)}
+}
+
+// load reads the file on first use and starts the writer
+func (s *sessionStore) load() {
+	s.once.Do(func() {
+		s.saved = make(map[string]savedSession)
+		data, err := os.ReadFile(s.filename)
+		if err == nil {
+			err = json.Unmarshal(data, &s.saved)
+			if err != nil {
+				logger.Warn().Err(err).Msg("Failed to parse upload sessions, starting over")
+				s.saved = make(map[string]savedSession)
+			}
+		} else if !os.IsNotExist(err) {
+			logger.Warn().Err(err).Msg("Failed to read upload sessions")
+		}
+		go s.writer()
+	})
+}
+
+func (s *sessionStore) writer() {
+	for range s.dirty {
+		s.mux.Lock()
+		now := time.Now()
+		maps.DeleteFunc(s.saved, func(_ string, session savedSession) bool {
+			return session.Expires.Before(now)
+		})
+		saved := maps.Clone(s.saved)
+		s.mux.Unlock()
+		s.write(saved)
+	}
+}
+
+func (s *sessionStore) write(saved map[string]savedSession) {
+	if len(saved) == 0 {
+		err := os.Remove(s.filename)
+		if err != nil && !os.IsNotExist(err) {
+			logger.Warn().Err(err).Msg("Failed to remove upload sessions")
+		}
+		return
+	}
+	data, err := json.Marshal(saved)
+	if err == nil {
+		// a crash while writing must not leave a broken file
+		err = os.WriteFile(s.filename+".tmp", data, 0644)
+	}
+	if err == nil {
+		err = os.Rename(s.filename+".tmp", s.filename)
+	}
+	if err != nil {
+		logger.Warn().Err(err).Msg("Failed to save upload sessions")
+	}
+}
+
+// changed wakes the writer, a write already pending covers this change
+func (s *sessionStore) changed() {
+	select {
+	case s.dirty <- struct{}{}:
+	default:
+	}
+}
+
+func (s *sessionStore) get(key string) (savedSession, bool) {
+	s.load()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	session, ok := s.saved[key]
+	return session, ok
+}
+
+func (s *sessionStore) put(key string, session savedSession) {
+	s.load()
+	s.mux.Lock()
+	s.saved[key] = session
+	s.mux.Unlock()
+	s.changed()
+}
+
+func (s *sessionStore) remove(key string) {
+	s.load()
+	s.mux.Lock()
+	_, ok := s.saved[key]
+	delete(s.saved, key)
+	s.mux.Unlock()
+	if ok {
+		s.changed()
+	}
+}
@@ -3,11 +3,21 @@ package onedrive
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"math"
+	"github.com/MingxuanGame/OsuBeatmapSync/base_service"
+	"github.com/MingxuanGame/OsuBeatmapSync/metrics"
+	. "github.com/MingxuanGame/OsuBeatmapSync/model"
+	. "github.com/MingxuanGame/OsuBeatmapSync/model/onedrive"
+	"github.com/MingxuanGame/OsuBeatmapSync/onedrive/quickxorhash"
+	"hash"
+	"io"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -16,29 +26,171 @@ type uploadSession struct {
 	*http.Client
 	ctx        context.Context
 	currSize   int64
-	singleSize int64
 	expireTime time.Time
 	totalSize  int64
+
+	// key is the path of the file in the saved sessions
+	key string
+	// sent and sentHash are from the saved session when it is resumed, see savedSession
+	sent     int64
+	sentHash string
+}
+
+// errSessionChanged is returned when the file of a resumed session is not the same as the one partly uploaded
+var errSessionChanged = errors.New("file changed since the upload session was created")
+
+const (
+	// simpleUploadLimit is the largest file uploaded by a single PUT
+	simpleUploadLimit = 4 << 20
+	// chunkUnit is the unit of upload chunks required by Graph
+	chunkUnit = 320 << 10
+	// initialChunkSize is the size of the first chunk, about 10MB
+	initialChunkSize = 32 * chunkUnit
+	// maxChunkSize is below the 60MiB limit of Graph, and bounds the memory of each upload
+	maxChunkSize = 100 * chunkUnit
+	// chunkTarget is how long a chunk should take, the chunk size follows the measured throughput
+	chunkTarget = 10 * time.Second
+
+	maxChunkAttempts = 6
+	chunkBaseDelay   = time.Second
+	chunkMaxDelay    = time.Minute
+)
+
+// nextChunkSize returns the size of the next chunk from the last one and how long it took,
+// moving halfway to the size that takes chunkTarget, in multiples of chunkUnit
+func nextChunkSize(last int64, elapsed time.Duration) int64 {
+	if elapsed <= 0 {
+		return last
+	}
+	target := int64(float64(last) * float64(chunkTarget) / float64(elapsed))
+	next := (last + target) / 2 / chunkUnit * chunkUnit
+	return min(max(next, chunkUnit), maxChunkSize)
+}
+
+// Upload uploads size bytes from r, replacing the existing file. Files under 4MB are uploaded by a single PUT,
+// larger ones by an upload session. The quickXorHash is computed while reading and checked against the uploaded item.
+func (client *GraphClient) Upload(path, filename string, r io.Reader, size int64) (*DriveItem, error) {
+	h := quickxorhash.New()
+	var item *DriveItem
+	var err error
+	if size < simpleUploadLimit {
+		item, err = client.uploadSmall(path, filename, io.TeeReader(r, h), size)
+	} else {
+		item, err = client.uploadLarge(path, filename, r, h, size)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if item.File != nil && item.File.Hashes.QuickXorHash != "" {
+		sum := base64.StdEncoding.EncodeToString(h.Sum(nil))
+		if sum != item.File.Hashes.QuickXorHash {
+			return nil, NewRequestError(ErrorCorrupt, "onedrive", path+"/"+filename, 0,
+				fmt.Errorf("quickXorHash mismatch: uploaded %s, got %s", sum, item.File.Hashes.QuickXorHash))
+		}
+	}
+	return item, nil
 }
 
-const chunkSize = 10_485_760 // 10MB
+func (client *GraphClient) uploadSmall(path, filename string, r io.Reader, size int64) (*DriveItem, error) {
+	data := make([]byte, size)
+	_, err := io.ReadFull(r, data)
+	if err != nil {
+		return nil, err
+	}
+	req, err := client.NewRequest("PUT", fmt.Sprintf("/me/drive/root:/%s/%s:/content", path, url.PathEscape(filename)), data)
+	if err != nil {
+		return nil, err
+	}
+	// the throttled body hides the length from net/http
+	req.Body = io.NopCloser(base_service.UploadThrottle().Reader(client.ctx, bytes.NewReader(data)))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(base_service.UploadThrottle().Reader(client.ctx, bytes.NewReader(data))), nil
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := client.ReadData(resp)
+	if err != nil {
+		return nil, err
+	}
+	var item DriveItem
+	err = json.Unmarshal(body, &item)
+	if err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
 
-// UploadFile limit: 4MB
-func (client *GraphClient) UploadFile(path string, filename string, data []byte) error {
-	req, err := client.NewRequest("PUT", fmt.Sprintf("/me/drive/root:/%s/%s:/content", path, filename), data)
+// PutFile uploads a small file and returns the item. With an empty eTag it fails if the file already exists,
+// otherwise it fails if the file is changed since eTag, both with ErrorConflict.
+func (client *GraphClient) PutFile(path, filename, eTag string, data []byte) (*DriveItem, error) {
+	u := fmt.Sprintf("/me/drive/root:/%s/%s:/content", path, url.PathEscape(filename))
+	if eTag == "" {
+		u += "?@microsoft.graph.conflictBehavior=fail"
+	}
+	req, err := client.NewRequest("PUT", u, data)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if eTag != "" {
+		req.Header.Set("If-Match", eTag)
 	}
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	body, err := client.ReadData(resp)
+	if err != nil {
+		return nil, err
 	}
-	_, err = client.ReadData(resp)
+	var item DriveItem
+	err = json.Unmarshal(body, &item)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	return &item, nil
+}
+
+// uploadLarge uploads the file by an upload session, resuming the saved one of the file if there is.
+// The bytes read from src are hashed by h, src is read again from the start if it is a seeker and the file
+// changed since the saved session.
+func (client *GraphClient) uploadLarge(path, filename string, src io.Reader, h hash.Hash, size int64) (*DriveItem, error) {
+	key := path + "/" + filename
+	session := client.resumeUploadSession(key, size)
+	if session == nil {
+		var err error
+		session, err = client.createUploadSession(path, filename, size)
+		if err != nil {
+			return nil, err
+		}
+	}
+	item, err := session.upload(src, h)
+	if errors.Is(err, errSessionChanged) {
+		sessions.remove(key)
+		seeker, ok := src.(io.Seeker)
+		if !ok {
+			return nil, NewRequestError(ErrorCorrupt, "onedrive", key, 0, err)
+		}
+		logger.Warn().Str("path", key).Msg("File changed since the interrupted upload, uploading again")
+		_, err = seeker.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+		h.Reset()
+		session, err = client.createUploadSession(path, filename, size)
+		if err != nil {
+			return nil, err
+		}
+		item, err = session.upload(src, h)
+	}
+	// the saved session is kept for errors that may be resumed later
+	if err == nil || GetErrorType(err) == ErrorNotFound || GetErrorType(err) == ErrorConflict || GetErrorType(err) == ErrorCorrupt {
+		sessions.remove(key)
+	}
+	return item, err
 }
 
 func (client *GraphClient) createUploadSession(path, filename string, totalSize int64) (*uploadSession, error) {
@@ -51,9 +203,6 @@ func (client *GraphClient) createUploadSession(path, filename string, totalSize
 	if err != nil {
 		return nil, err
 	}
-	if resp.StatusCode >= 400 {
-		return nil, fmt.Errorf("failed to create upload session: %d", resp.StatusCode)
-	}
 	data, err := client.ReadData(resp)
 	if err != nil {
 		return nil, err
@@ -71,97 +220,291 @@ func (client *GraphClient) createUploadSession(path, filename string, totalSize
 	if err != nil {
 		expireTime = time.Now().Add(time.Hour)
 	}
-	return &uploadSession{
+	metrics.UploadSessions.Inc()
+	session := &uploadSession{
 		uploadUrl:  response.UploadUrl,
 		Client:     client.Client,
 		ctx:        client.ctx,
 		totalSize:  totalSize,
 		expireTime: expireTime,
 		currSize:   0,
-	}, nil
+		key:        path + "/" + filename,
+	}
+	// the session is kept before the first chunk so it can be resumed, there is nothing to check yet
+	session.save(0, "")
+	return session, nil
+}
+
+// resumeUploadSession returns the saved session of the file if it is still alive, nil otherwise
+func (client *GraphClient) resumeUploadSession(key string, totalSize int64) *uploadSession {
+	saved, ok := sessions.get(key)
+	if !ok {
+		return nil
+	}
+	if saved.Size != totalSize || time.Until(saved.Expires) < time.Minute {
+		sessions.remove(key)
+		return nil
+	}
+	session := &uploadSession{
+		uploadUrl:  saved.UploadUrl,
+		Client:     client.Client,
+		ctx:        client.ctx,
+		totalSize:  totalSize,
+		expireTime: saved.Expires,
+		key:        key,
+		sent:       saved.Sent,
+		sentHash:   saved.SentHash,
+	}
+	next, err := session.status()
+	// the server cannot have less than the finished chunks
+	if err != nil || next < saved.Sent {
+		logger.Warn().Err(err).Str("path", key).Msg("Upload session cannot be resumed, starting over")
+		sessions.remove(key)
+		return nil
+	}
+	logger.Info().Str("path", key).Msgf("Resuming upload from %d/%d bytes", next, totalSize)
+	session.currSize = next
+	return session
+}
+
+func (session *uploadSession) save(sent int64, sentHash string) {
+	sessions.put(session.key, savedSession{
+		UploadUrl: session.uploadUrl,
+		Expires:   session.expireTime,
+		Size:      session.totalSize,
+		Sent:      sent,
+		SentHash:  sentHash,
+	})
+}
+
+type uploadStatus struct {
+	ExpirationDateTime string   `json:"expirationDateTime"`
+	NextExpectedRanges []string `json:"nextExpectedRanges"`
+}
+
+// apply updates the session from the status and returns the next expected byte
+func (session *uploadSession) apply(status uploadStatus) int64 {
+	if expireTime, err := time.Parse(time.RFC3339, status.ExpirationDateTime); err == nil {
+		session.expireTime = expireTime
+	}
+	if len(status.NextExpectedRanges) == 0 {
+		return session.totalSize
+	}
+	start, _, _ := strings.Cut(status.NextExpectedRanges[0], "-")
+	next, err := strconv.ParseInt(start, 10, 64)
+	if err != nil {
+		return session.currSize
+	}
+	return next
 }
 
-func (session *uploadSession) uploadChunkWithRetry(data []byte, retry int, serverFailRetry int) (bool, error) {
-	req, err := http.NewRequestWithContext(session.ctx, "PUT", session.uploadUrl, bytes.NewReader(data))
+// status asks the server for the next expected byte
+func (session *uploadSession) status() (int64, error) {
+	req, err := http.NewRequestWithContext(session.ctx, "GET", session.uploadUrl, nil)
 	if err != nil {
-		return false, err
+		return 0, err
 	}
-	req.Header.Set("Content-Length", fmt.Sprintf("%d", len(data)))
-	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", session.currSize, session.currSize+int64(len(data))-1, session.totalSize))
 	resp, err := session.Do(req)
 	if err != nil {
-		return false, err
+		return 0, err
+	}
+	data, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode >= 400 {
+		return 0, responseError(resp, data)
+	}
+	var status uploadStatus
+	err = json.Unmarshal(data, &status)
+	if err != nil {
+		return 0, err
+	}
+	return session.apply(status), nil
+}
+
+// uploadChunk sends one PUT of data at currSize. It returns the item for the last chunk,
+// and whether the error may be retried with how long to wait if the server said so.
+func (session *uploadSession) uploadChunk(data *io.SectionReader) (item *DriveItem, retryable bool, retryAfter time.Duration, err error) {
+	body := base_service.UploadThrottle().Reader(session.ctx, data)
+	req, err := http.NewRequestWithContext(session.ctx, "PUT", session.uploadUrl, body)
+	if err != nil {
+		return nil, false, 0, err
+	}
+	// the throttled body hides the length from net/http
+	req.ContentLength = data.Size()
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", session.currSize, session.currSize+data.Size()-1, session.totalSize))
+	resp, err := session.Do(req)
+	if err != nil {
+		return nil, session.ctx.Err() == nil, 0, err
+	}
+	respData, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, session.ctx.Err() == nil, 0, err
 	}
 
 	switch {
-	case resp.StatusCode == 202:
-		session.currSize += int64(len(data))
-		return false, nil
-	case resp.StatusCode == 201 || resp.StatusCode == 200:
-		return true, nil
-	case resp.StatusCode == 416:
-		return false, &url.Error{
-			Op:  "",
-			URL: req.URL.String(),
-			Err: fmt.Errorf("chunk %d-%d is already uploaded", session.currSize, session.currSize+int64(len(data))-1),
-		}
-	case resp.StatusCode == 409:
-		return false, &url.Error{
-			Op:  "",
-			URL: req.URL.String(),
-			Err: fmt.Errorf("conflict"),
-		}
-	case resp.StatusCode == 404:
-		return false,
-			&url.Error{
-				Op:  "",
-				URL: req.URL.String(),
-				Err: fmt.Errorf("upload session not found"),
-			}
-	case resp.StatusCode >= 500:
-		logger.Warn().Msgf("Server error, retrying in %d seconds", int(math.Pow(2, float64(serverFailRetry))))
-		time.Sleep(time.Duration(1000 * math.Pow(2, float64(serverFailRetry))))
-		return session.uploadChunkWithRetry(data, retry, serverFailRetry+1)
-	case resp.StatusCode >= 400:
-		logger.Error().Msgf("Client error, retrying in 10 second (%d remaining)", retry-1)
-		if retry == 0 {
-			return false, &url.Error{
-				Op:  "",
-				URL: req.URL.String(),
-				Err: fmt.Errorf("retry limit exceeded"),
-			}
+	case resp.StatusCode == http.StatusAccepted:
+		var status uploadStatus
+		if json.Unmarshal(respData, &status) == nil {
+			session.currSize = session.apply(status)
+		} else {
+			session.currSize += data.Size()
+		}
+		return nil, false, 0, nil
+	case resp.StatusCode == http.StatusCreated || resp.StatusCode == http.StatusOK:
+		session.currSize += data.Size()
+		var item DriveItem
+		err = json.Unmarshal(respData, &item)
+		if err != nil {
+			return nil, false, 0, err
+		}
+		return &item, false, 0, nil
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// the server has other bytes than expected, the status tells where to continue
+		return nil, true, 0, fmt.Errorf("range %d-%d is not expected", session.currSize, session.currSize+data.Size()-1)
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, false, 0, NewRequestError(ErrorNotFound, "onedrive", req.URL.String(), resp.StatusCode, fmt.Errorf("upload session not found"))
+	case resp.StatusCode == http.StatusConflict:
+		return nil, false, 0, NewRequestError(ErrorConflict, "onedrive", req.URL.String(), resp.StatusCode, fmt.Errorf("conflict"))
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			retryAfter = time.Duration(seconds) * time.Second
 		}
-		time.Sleep(time.Second * 10)
-		return session.uploadChunkWithRetry(data, retry-1, serverFailRetry)
+		return nil, true, retryAfter, responseError(resp, respData)
 	}
-	return false, nil
+	return nil, false, 0, responseError(resp, respData)
 }
 
-func (session *uploadSession) upload(data []byte) error {
-	slices := make([][]byte, 0)
-	for i := 0; i < len(data); i += chunkSize {
-		end := i + chunkSize
-		if end > len(data) {
-			end = len(data)
+// uploadChunkWithRetry uploads the chunk starting at currSize, retrying failed requests with backoff
+// from the next expected byte the server reports. It returns the item if it is the last chunk.
+func (session *uploadSession) uploadChunkWithRetry(chunk *io.SectionReader) (*DriveItem, error) {
+	start := session.currSize
+	end := start + chunk.Size()
+	for attempt := 1; ; attempt++ {
+		item, retryable, retryAfter, err := session.uploadChunk(io.NewSectionReader(chunk, session.currSize-start, end-session.currSize))
+		if err == nil {
+			if item != nil || session.currSize >= end {
+				return item, nil
+			}
+			// part of the chunk is received, send the rest
+			attempt = 0
+			continue
+		}
+		if !retryable || attempt >= maxChunkAttempts {
+			return nil, err
+		}
+		if GetErrorType(err) == ErrorRateLimited || GetErrorType(err) == ErrorServer {
+			metrics.ChunkRetries.WithLabelValues("server_error").Inc()
+		} else {
+			metrics.ChunkRetries.WithLabelValues("client_error").Inc()
+		}
+		delay := min(chunkBaseDelay<<(attempt-1), chunkMaxDelay)
+		if retryAfter > 0 {
+			delay = retryAfter
+		}
+		logger.Warn().Err(err).Str("path", session.key).Msgf("Failed to upload chunk %d-%d, retrying in %s (attempt %d/%d)", session.currSize, end-1, delay, attempt, maxChunkAttempts)
+		select {
+		case <-session.ctx.Done():
+			return nil, session.ctx.Err()
+		case <-time.After(delay):
+		}
+		next, statusErr := session.status()
+		if statusErr != nil {
+			if GetErrorType(statusErr) == ErrorNotFound {
+				return nil, statusErr
+			}
+			// the PUT is retried from where it was
+			continue
+		}
+		if next < start || next > end {
+			return nil, fmt.Errorf("server expects byte %d, outside of the chunk %d-%d", next, start, end-1)
+		}
+		session.currSize = next
+		if next == end {
+			return nil, nil
 		}
-		slices = append(slices, data[i:end])
 	}
-	for _, slice := range slices {
-		done, err := session.uploadChunkWithRetry(slice, 3, 0)
+}
+
+// skip reads the bytes the server already has, checking they are the same as the ones sent before.
+// A session interrupted before its first chunk finished has no hash, the bytes are checked by the hash
+// of the uploaded item instead.
+func (session *uploadSession) skip(r io.Reader, h hash.Hash) error {
+	if session.sentHash != "" {
+		_, err := io.CopyN(io.Discard, r, session.sent)
 		if err != nil {
 			return err
 		}
-		if done {
-			break
+		if base64.StdEncoding.EncodeToString(h.Sum(nil)) != session.sentHash {
+			return errSessionChanged
 		}
+	} else {
+		session.sent = 0
 	}
-	return nil
+	_, err := io.CopyN(io.Discard, r, session.currSize-session.sent)
+	return err
 }
 
-func (client *GraphClient) UploadLargeFile(path, filename string, data []byte) error {
-	session, err := client.createUploadSession(path, filename, int64(len(data)))
-	if err != nil {
-		return err
+// chunkReader reads the chunks of a file from src, hashing them by h. The chunks of a bytes.Reader are
+// sections of it, other readers are copied to a buffer sized to the largest chunk.
+type chunkReader struct {
+	src io.Reader
+	h   hash.Hash
+	buf []byte
+}
+
+// next reads the next n bytes, the chunk is valid until the next call
+func (c *chunkReader) next(n int64) (*io.SectionReader, error) {
+	if r, ok := c.src.(*bytes.Reader); ok {
+		offset := r.Size() - int64(r.Len())
+		_, err := io.CopyN(c.h, r, n)
+		return io.NewSectionReader(r, offset, n), err
+	}
+	if int64(len(c.buf)) < n {
+		c.buf = make([]byte, n)
+	}
+	chunk := c.buf[:n]
+	_, err := io.ReadFull(io.TeeReader(c.src, c.h), chunk)
+	return io.NewSectionReader(bytes.NewReader(chunk), 0, n), err
+}
+
+// upload reads the file in chunks, the chunk size adapts to the throughput.
+// h is the hash of the bytes read from src, it is saved with the session after every chunk.
+func (session *uploadSession) upload(src io.Reader, h hash.Hash) (*DriveItem, error) {
+	if session.currSize > 0 {
+		err := session.skip(io.TeeReader(src, h), h)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// read is the bytes read from src and hashed by h
+	read := session.currSize
+	size := int64(initialChunkSize)
+	chunks := &chunkReader{src: src, h: h}
+	if _, ok := src.(*bytes.Reader); !ok {
+		// the chunks grow up to maxChunkSize, a smaller file never needs more than its size
+		chunks.buf = make([]byte, min(maxChunkSize, session.totalSize-session.currSize))
+	}
+	for session.currSize < session.totalSize {
+		chunk, err := chunks.next(min(size, session.totalSize-session.currSize))
+		if err != nil {
+			return nil, err
+		}
+		read += chunk.Size()
+		start := time.Now()
+		item, err := session.uploadChunkWithRetry(chunk)
+		if err != nil {
+			return nil, err
+		}
+		if item != nil {
+			return item, nil
+		}
+		// the chunk is acknowledged, a resumed upload can check the bytes read so far
+		session.save(read, base64.StdEncoding.EncodeToString(h.Sum(nil)))
+		size = nextChunkSize(size, time.Since(start))
 	}
-	return session.upload(data)
+	return nil, fmt.Errorf("upload session finished without an item")
 }
@@ -0,0 +1,389 @@
+package onedrive
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	. "github.com/MingxuanGame/OsuBeatmapSync/model"
+	"github.com/MingxuanGame/OsuBeatmapSync/onedrive/quickxorhash"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGraph serves the upload endpoints of Graph for one file
+type fakeGraph struct {
+	mux sync.Mutex
+	srv *httptest.Server
+	// data is what the server has of the file, received is how much of it
+	data     []byte
+	received int64
+	// sessions is how many upload sessions were created
+	sessions int
+	// failPut fails the PUT of the chunk starting at the offset with the status
+	failPut map[int64]int
+	// hash overrides the quickXorHash of the uploaded item
+	hash string
+}
+
+func newFakeGraph(t *testing.T) *fakeGraph {
+	g := &fakeGraph{failPut: make(map[int64]int)}
+	g.srv = httptest.NewServer(http.HandlerFunc(g.serve))
+	t.Cleanup(g.srv.Close)
+	return g
+}
+
+func (g *fakeGraph) serve(w http.ResponseWriter, r *http.Request) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, ":/createUploadSession"):
+		g.sessions++
+		g.received = 0
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"uploadUrl":          g.srv.URL + "/upload",
+			"expirationDateTime": time.Now().Add(time.Hour).Format(time.RFC3339),
+		})
+	case r.Method == "GET" && r.URL.Path == "/upload":
+		_ = json.NewEncoder(w).Encode(uploadStatus{NextExpectedRanges: []string{fmt.Sprintf("%d-", g.received)}})
+	case r.Method == "PUT" && r.URL.Path == "/upload":
+		var start, end, total int64
+		_, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total)
+		if err != nil || start != g.received {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if status, ok := g.failPut[start]; ok {
+			delete(g.failPut, start)
+			w.WriteHeader(status)
+			return
+		}
+		body := new(bytes.Buffer)
+		_, _ = body.ReadFrom(r.Body)
+		if g.data == nil {
+			g.data = make([]byte, total)
+		}
+		copy(g.data[start:], body.Bytes())
+		g.received = end + 1
+		if g.received < total {
+			w.WriteHeader(http.StatusAccepted)
+			_ = json.NewEncoder(w).Encode(uploadStatus{NextExpectedRanges: []string{fmt.Sprintf("%d-", g.received)}})
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		g.writeItem(w, g.data)
+	case r.Method == "PUT" && strings.HasSuffix(r.URL.Path, ":/content"):
+		body := new(bytes.Buffer)
+		_, _ = body.ReadFrom(r.Body)
+		g.data = body.Bytes()
+		w.WriteHeader(http.StatusCreated)
+		g.writeItem(w, g.data)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (g *fakeGraph) writeItem(w http.ResponseWriter, data []byte) {
+	sum := g.hash
+	if sum == "" {
+		sum = quickXorHash(data)
+	}
+	_, _ = fmt.Fprintf(w, `{"id":"1","name":"a.osz","size":%d,"file":{"hashes":{"quickXorHash":%q}}}`, len(data), sum)
+}
+
+// client returns a client that sends every request to the fake server
+func (g *fakeGraph) client() *GraphClient {
+	target, _ := url.Parse(g.srv.URL)
+	transport := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		req.URL.Scheme, req.URL.Host = target.Scheme, target.Host
+		return http.DefaultTransport.RoundTrip(req)
+	})
+	return &GraphClient{&OneDrive{}, &http.Client{Transport: transport}, context.Background()}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func quickXorHash(data []byte) string {
+	h := quickxorhash.New()
+	h.Write(data)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func randomData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+// useTempSessions keeps the saved sessions of the test in a temporary file
+func useTempSessions(t *testing.T) {
+	dir, err := os.MkdirTemp("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the writer may still be running when the test ends, the directory is removed on a best effort
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	old := sessions
+	sessions = newSessionStore(filepath.Join(dir, UploadSessionsFilename))
+	t.Cleanup(func() { sessions = old })
+}
+
+func TestUploadResumesAfterFirstChunk(t *testing.T) {
+	useTempSessions(t)
+	g := newFakeGraph(t)
+	client := g.client()
+	data := randomData(initialChunkSize + 1<<20)
+	g.failPut[initialChunkSize] = http.StatusBadRequest
+
+	_, err := client.Upload("Beatmaps", "a.osz", bytes.NewReader(data), int64(len(data)))
+	if err == nil {
+		t.Fatal("upload should fail at the second chunk")
+	}
+	saved, ok := sessions.get("Beatmaps/a.osz")
+	if !ok {
+		t.Fatal("session is not saved")
+	}
+	if saved.Sent != initialChunkSize || saved.SentHash != quickXorHash(data[:initialChunkSize]) {
+		t.Fatalf("saved %d bytes with hash %s, want the first chunk", saved.Sent, saved.SentHash)
+	}
+
+	item, err := client.Upload("Beatmaps", "a.osz", bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.sessions != 1 {
+		t.Fatalf("created %d sessions, want the first one resumed", g.sessions)
+	}
+	if item.File.Hashes.QuickXorHash != quickXorHash(data) {
+		t.Fatal("uploaded file is not the same")
+	}
+	if _, ok := sessions.get("Beatmaps/a.osz"); ok {
+		t.Fatal("session is kept after the upload finished")
+	}
+}
+
+func TestUploadResumesDuringFirstChunk(t *testing.T) {
+	useTempSessions(t)
+	g := newFakeGraph(t)
+	client := g.client()
+	data := randomData(5 << 20)
+
+	// the server has part of the first chunk, no chunk was acknowledged to the client
+	g.sessions = 1
+	g.data = make([]byte, len(data))
+	g.received = 1 << 20
+	copy(g.data, data[:g.received])
+	sessions.put("Beatmaps/a.osz", savedSession{
+		UploadUrl: g.srv.URL + "/upload",
+		Expires:   time.Now().Add(time.Hour),
+		Size:      int64(len(data)),
+	})
+
+	item, err := client.Upload("Beatmaps", "a.osz", bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.sessions != 1 {
+		t.Fatalf("created %d sessions, want the saved one resumed", g.sessions)
+	}
+	if item.File.Hashes.QuickXorHash != quickXorHash(data) {
+		t.Fatal("uploaded file is not the same")
+	}
+}
+
+func TestUploadRestartsChangedFile(t *testing.T) {
+	useTempSessions(t)
+	g := newFakeGraph(t)
+	client := g.client()
+	data := randomData(initialChunkSize + 1<<20)
+	g.failPut[initialChunkSize] = http.StatusBadRequest
+	_, _ = client.Upload("Beatmaps", "a.osz", bytes.NewReader(data), int64(len(data)))
+
+	changed := bytes.Clone(data)
+	changed[0]++
+	item, err := client.Upload("Beatmaps", "a.osz", bytes.NewReader(changed), int64(len(changed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.sessions != 2 {
+		t.Fatalf("created %d sessions, want a new one for the changed file", g.sessions)
+	}
+	if item.File.Hashes.QuickXorHash != quickXorHash(changed) {
+		t.Fatal("uploaded file is not the same")
+	}
+}
+
+func TestNextChunkSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		last    int64
+		elapsed time.Duration
+		want    int64
+	}{
+		{"not measured", initialChunkSize, 0, initialChunkSize},
+		{"on target", initialChunkSize, chunkTarget, initialChunkSize},
+		{"twice as fast", initialChunkSize, chunkTarget / 2, 48 * chunkUnit},
+		{"twice as slow", initialChunkSize, chunkTarget * 2, 24 * chunkUnit},
+		{"rounded down", initialChunkSize, 7 * time.Second, 38 * chunkUnit},
+		{"clamped to the largest", initialChunkSize, time.Second, maxChunkSize},
+		{"largest stays", maxChunkSize, time.Millisecond, maxChunkSize},
+		{"clamped to the unit", chunkUnit, time.Hour, chunkUnit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextChunkSize(tt.last, tt.elapsed); got != tt.want {
+				t.Fatalf("got %d (%.2f units), want %d", got, float64(got)/chunkUnit, tt.want)
+			}
+		})
+	}
+
+	// Graph rejects chunks that are not multiples of 320KiB, except the last one
+	for last := int64(chunkUnit); last <= maxChunkSize; last += chunkUnit {
+		for elapsed := 100 * time.Millisecond; elapsed <= time.Minute; elapsed += 900 * time.Millisecond {
+			got := nextChunkSize(last, elapsed)
+			if got%chunkUnit != 0 || got < chunkUnit || got > maxChunkSize {
+				t.Fatalf("next of %d after %s is %d, not a multiple of %d in range", last, elapsed, got, chunkUnit)
+			}
+		}
+	}
+}
+
+func TestUploadVerifiesHash(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		hash     string
+		corrupt  bool
+		sessions int
+	}{
+		{"small", 1 << 10, "", false, 0},
+		{"small mismatch", 1 << 10, quickXorHash([]byte("other")), true, 0},
+		{"large", simpleUploadLimit + 1, "", false, 1},
+		{"large mismatch", simpleUploadLimit + 1, quickXorHash([]byte("other")), true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTempSessions(t)
+			g := newFakeGraph(t)
+			g.hash = tt.hash
+			data := randomData(tt.size)
+			item, err := g.client().Upload("Beatmaps", "a.osz", bytes.NewReader(data), int64(len(data)))
+			if g.sessions != tt.sessions {
+				t.Fatalf("created %d upload sessions, want %d", g.sessions, tt.sessions)
+			}
+			if tt.corrupt {
+				if GetErrorType(err) != ErrorCorrupt {
+					t.Fatalf("got %v, want a corrupt error", err)
+				}
+				if _, ok := sessions.get("Beatmaps/a.osz"); ok {
+					t.Fatal("session of a corrupt upload is kept")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if item.File.Hashes.QuickXorHash != quickXorHash(data) || !bytes.Equal(g.data, data) {
+				t.Fatal("uploaded file is not the same")
+			}
+		})
+	}
+}
+
+func TestChunkReader(t *testing.T) {
+	data := randomData(3 * chunkUnit)
+	tests := []struct {
+		name string
+		src  io.Reader
+	}{
+		{"bytes reader", bytes.NewReader(data)},
+		{"other reader", struct{ io.Reader }{bytes.NewReader(data)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := quickxorhash.New()
+			chunks := &chunkReader{src: tt.src, h: h}
+			var got []byte
+			for _, n := range []int64{chunkUnit, 2 * chunkUnit} {
+				chunk, err := chunks.next(n)
+				if err != nil {
+					t.Fatal(err)
+				}
+				part, _ := io.ReadAll(chunk)
+				got = append(got, part...)
+			}
+			if !bytes.Equal(got, data) || base64.StdEncoding.EncodeToString(h.Sum(nil)) != quickXorHash(data) {
+				t.Fatal("chunks or hash are not the file")
+			}
+			if _, ok := tt.src.(*bytes.Reader); ok && chunks.buf != nil {
+				t.Fatal("chunks of a bytes reader are copied")
+			}
+			if _, err := chunks.next(1); err == nil {
+				t.Fatal("read after the end of the file")
+			}
+		})
+	}
+}
+
+// TestUploadSmallSession checks a file just over the simple upload limit does not get a buffer of the largest chunk
+func TestUploadSmallSession(t *testing.T) {
+	useTempSessions(t)
+	// the server discards the chunks, what is allocated is the memory of the client
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			_, _ = fmt.Fprintf(w, `{"uploadUrl":%q,"expirationDateTime":%q}`, "http://"+r.Host+"/upload", time.Now().Add(time.Hour).Format(time.RFC3339))
+			return
+		}
+		var start, end, total int64
+		_, _ = fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total)
+		_, _ = io.Copy(io.Discard, r.Body)
+		if end+1 < total {
+			w.WriteHeader(http.StatusAccepted)
+			_, _ = fmt.Fprintf(w, `{"nextExpectedRanges":["%d-"]}`, end+1)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		_, _ = fmt.Fprintf(w, `{"id":"1","name":"a.osz","size":%d}`, total)
+	}))
+	t.Cleanup(srv.Close)
+	client := (&fakeGraph{srv: srv}).client()
+	data := randomData(simpleUploadLimit + 1)
+	tests := []struct {
+		name  string
+		src   io.Reader
+		limit uint64
+	}{
+		// the chunks are sections of the bytes, nothing is copied
+		{"bytes reader", bytes.NewReader(data), uint64(len(data)) / 4},
+		{"other reader", struct{ io.Reader }{bytes.NewReader(data)}, maxChunkSize / 2},
+	}
+	for _, tt := range tests {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		_, err := client.Upload("Beatmaps", "a.osz", tt.src, int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		runtime.ReadMemStats(&after)
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated >= tt.limit {
+			t.Fatalf("%s: allocated %d bytes for a file of %d", tt.name, allocated, len(data))
+		}
+	}
+}
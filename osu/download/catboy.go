@@ -4,10 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/MingxuanGame/OsuBeatmapSync/base_service"
 	"github.com/rs/zerolog/log"
 	"io"
 	"net/http"
-	netUrl "net/url"
 )
 
 type CatboyDownloader struct {
@@ -33,25 +33,28 @@ func (d *CatboyDownloader) DownloadBeatmapset(beatmapsetId int) ([]byte, error)
 	if err != nil {
 		return nil, err
 	}
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(resp.Body)
 	if resp.StatusCode != 200 {
 		var responseBody struct {
 			Error string `json:"error"`
 		}
 		err := json.NewDecoder(resp.Body).Decode(&responseBody)
 		if err != nil {
-			return nil, &netUrl.Error{
-				Op:  "",
-				URL: req.URL.String(),
-				Err: fmt.Errorf("status: %s", resp.Status),
-			}
-		}
-		return nil, &netUrl.Error{
-			Op:  "",
-			URL: req.URL.String(),
-			Err: fmt.Errorf("status: %s, error: %s", resp.Status, responseBody.Error),
+			return nil, statusError(d.Name(), resp, nil)
 		}
+		return nil, statusError(d.Name(), resp, fmt.Errorf("status: %s, error: %s", resp.Status, responseBody.Error))
+	}
+	data, err := io.ReadAll(base_service.DownloadThrottle().Reader(req.Context(), resp.Body))
+	if err != nil {
+		return nil, err
+	}
+	err = checkBeatmapset(d.Name(), req.URL.String(), data)
+	if err != nil {
+		return nil, err
 	}
-	return io.ReadAll(resp.Body)
+	return data, nil
 }
 
 func (d *CatboyDownloader) Name() string {
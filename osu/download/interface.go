@@ -1,6 +1,48 @@
 package download
 
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	. "github.com/MingxuanGame/OsuBeatmapSync/model"
+	"net/http"
+	"time"
+)
+
 type BeatmapDownloader interface {
 	Name() string
 	DownloadBeatmapset(beatmapId int) ([]byte, error)
 }
+
+func statusError(source string, resp *http.Response, err error) *RequestError {
+	if err == nil {
+		err = fmt.Errorf("status: %s", resp.Status)
+	}
+	requestError := NewRequestError(ErrorTypeFromStatus(resp.StatusCode), source, resp.Request.URL.String(), resp.StatusCode, err)
+	if requestError.Type == ErrorRateLimited {
+		requestError.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), resp.Header.Get("X-Retry-After"))
+	}
+	return requestError
+}
+
+func parseRetryAfter(values ...string) time.Duration {
+	for _, v := range values {
+		var seconds int
+		if _, err := fmt.Sscanf(v, "%d", &seconds); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return 0
+}
+
+// checkBeatmapset makes sure the downloaded data is a readable .osz archive
+func checkBeatmapset(source, url string, data []byte) error {
+	if len(data) == 0 {
+		return NewRequestError(ErrorCorrupt, source, url, 0, fmt.Errorf("empty body"))
+	}
+	_, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return NewRequestError(ErrorCorrupt, source, url, 0, err)
+	}
+	return nil
+}
@@ -3,12 +3,10 @@ package download
 import (
 	"context"
 	"fmt"
-	"github.com/MingxuanGame/OsuBeatmapSync/utils"
+	"github.com/MingxuanGame/OsuBeatmapSync/base_service"
 	"github.com/rs/zerolog/log"
 	"io"
 	"net/http"
-	"net/url"
-	"time"
 )
 
 const nerinyanApi = "https://api.nerinyan.moe"
@@ -30,32 +28,25 @@ func NewNerinyanDownloader(ctx context.Context) *NerinyanDownloader {
 func (d *NerinyanDownloader) do(req *http.Request) ([]byte, error) {
 	nerinyanLogger.Trace().Msgf("Requesting %s %s", req.Method, req.URL.String())
 	resp, err := d.Client.Do(req)
-	var data []byte
 	if err != nil {
 		return nil, err
 	}
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(resp.Body)
 	if resp.StatusCode == 429 {
-		retryAfter, ctx, err := utils.GetLimitSecond(resp.Header.Get("X-Retry-After"), d.ctx)
-		if err != nil {
-			return nil, err
-		}
-		d.ctx = ctx
-		nerinyanLogger.Warn().Msgf("Rate limited, sleeping for %s.", retryAfter)
-		time.Sleep(retryAfter)
-		data, err = d.do(req)
-		if err != nil {
-			return nil, err
-		}
-		return data, nil
+		requestError := statusError(d.Name(), resp, nil)
+		nerinyanLogger.Warn().Msgf("Rate limited, retry after %s.", requestError.RetryAfter)
+		return nil, requestError
 	}
 	if resp.StatusCode != 200 {
-		return nil, &url.Error{
-			Op:  "",
-			URL: req.URL.String(),
-			Err: fmt.Errorf("status: %s", resp.Status),
-		}
+		return nil, statusError(d.Name(), resp, nil)
 	}
-	data, err = io.ReadAll(resp.Body)
+	data, err := io.ReadAll(base_service.DownloadThrottle().Reader(req.Context(), resp.Body))
+	if err != nil {
+		return nil, err
+	}
+	err = checkBeatmapset(d.Name(), req.URL.String(), data)
 	if err != nil {
 		return nil, err
 	}
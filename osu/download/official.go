@@ -5,6 +5,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/MingxuanGame/OsuBeatmapSync/base_service"
+	. "github.com/MingxuanGame/OsuBeatmapSync/model"
 	"github.com/MingxuanGame/OsuBeatmapSync/utils"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/oauth2"
@@ -130,7 +132,7 @@ func (d *OfficialDownloader) Name() string {
 
 func (d *OfficialDownloader) DownloadBeatmapset(beatmapId int) ([]byte, error) {
 	// https://github.com/ppy/osu/blob/master/osu.Game/Online/API/Requests/DownloadBeatmapSetRequest.cs#L28
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/beatmapsets/%d/download", apiBase, beatmapId), nil)
+	req, err := http.NewRequestWithContext(d.ctx, "GET", fmt.Sprintf("%s/beatmapsets/%d/download", apiBase, beatmapId), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -138,9 +140,19 @@ func (d *OfficialDownloader) DownloadBeatmapset(beatmapId int) ([]byte, error) {
 	req.Header.Set("x-api_version", apiVersion)
 	resp, err := d.client.Do(req)
 	if err != nil {
+		var retrieveError *oauth2.RetrieveError
+		if errors.As(err, &retrieveError) {
+			return nil, NewRequestError(ErrorAuthExpired, d.Name(), req.URL.String(), 0, err)
+		}
 		return nil, err
 	}
-	data, err := io.ReadAll(resp.Body)
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(resp.Body)
+	if resp.StatusCode != 200 {
+		return nil, statusError(d.Name(), resp, nil)
+	}
+	data, err := io.ReadAll(base_service.DownloadThrottle().Reader(req.Context(), resp.Body))
 	if err != nil {
 		return nil, err
 	}
@@ -148,7 +160,11 @@ func (d *OfficialDownloader) DownloadBeatmapset(beatmapId int) ([]byte, error) {
 		// some beatmap cannot be downloaded (like https://osu.ppy.sh/beatmapsets/30877, DMCA takedown)
 		// other api maybe return server error (5xx)
 		// osu!api return empty body
-		return nil, fmt.Errorf("empty body")
+		return nil, NewRequestError(ErrorUnavailable, d.Name(), req.URL.String(), resp.StatusCode, fmt.Errorf("empty body"))
+	}
+	err = checkBeatmapset(d.Name(), req.URL.String(), data)
+	if err != nil {
+		return nil, err
 	}
 	return data, nil
 }
@@ -3,6 +3,8 @@ package download
 import (
 	"context"
 	"fmt"
+	"github.com/MingxuanGame/OsuBeatmapSync/base_service"
+	. "github.com/MingxuanGame/OsuBeatmapSync/model"
 	"github.com/rs/zerolog/log"
 	"io"
 	"net/http"
@@ -43,13 +45,20 @@ func (d *SayobotDownloader) DownloadBeatmapset(beatmapsetId int) ([]byte, error)
 	if err != nil {
 		return nil, err
 	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 300 || resp.StatusCode >= 400 {
+		return nil, statusError(d.Name(), resp, nil)
+	}
 	location, err := netUrl.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return nil, NewRequestError(ErrorServer, d.Name(), req.URL.String(), resp.StatusCode, err)
+	}
 	filename, err := netUrl.PathUnescape(location.Query().Get("filename"))
 	if err != nil {
 		return nil, err
 	}
 	newUrl := fmt.Sprintf("%s://%s%s?filename=%s", location.Scheme, location.Host, location.Path, netUrl.PathEscape(filename))
-	req, err = http.NewRequest("GET", newUrl, nil)
+	req, err = http.NewRequestWithContext(d.ctx, "GET", newUrl, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -57,20 +66,35 @@ func (d *SayobotDownloader) DownloadBeatmapset(beatmapsetId int) ([]byte, error)
 	if err != nil {
 		return nil, err
 	}
-	data, err := io.ReadAll(resp.Body)
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(resp.Body)
+	data, err := io.ReadAll(base_service.DownloadThrottle().Reader(req.Context(), resp.Body))
 	if err != nil {
 		return nil, err
 	}
 	if resp.StatusCode != 200 {
-		return nil, &netUrl.Error{
-			Op:  resp.Request.Method,
-			URL: resp.Request.URL.String(),
-			//-1 = 服务器资源不足
-			//-2 = 读取失败
-			//-3 = ppy不给下载
-			//-4 = 不知道发生了什么
-			Err: fmt.Errorf("status: %s, %s", resp.Status, strings.Split(string(data), "\n")[9]),
+		lines := strings.Split(string(data), "\n")
+		var code string
+		if len(lines) > 9 {
+			code = strings.TrimSpace(lines[9])
+		}
+		requestError := statusError(d.Name(), resp, fmt.Errorf("status: %s, %s", resp.Status, code))
+		//-1 = 服务器资源不足
+		//-2 = 读取失败
+		//-3 = ppy不给下载
+		//-4 = 不知道发生了什么
+		switch {
+		case strings.Contains(code, "-3"):
+			requestError.Type = ErrorUnavailable
+		case strings.Contains(code, "-1") || strings.Contains(code, "-2"):
+			requestError.Type = ErrorServer
 		}
+		return nil, requestError
+	}
+	err = checkBeatmapset(d.Name(), req.URL.String(), data)
+	if err != nil {
+		return nil, err
 	}
 	return data, nil
 }
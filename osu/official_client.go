@@ -2,6 +2,8 @@ package osu
 
 import (
 	"encoding/json"
+	"fmt"
+	"github.com/MingxuanGame/OsuBeatmapSync/metrics"
 	. "github.com/MingxuanGame/OsuBeatmapSync/model"
 	"github.com/rs/zerolog/log"
 	"io"
@@ -13,6 +15,8 @@ import (
 
 var logger = log.With().Str("module", "osu.legacy").Logger()
 
+const apiUrl = "https://osu.ppy.sh/api/get_beatmaps"
+
 // LegacyOfficialClient osu! v1 API
 type LegacyOfficialClient struct {
 	ApiKey string
@@ -38,7 +42,7 @@ func (client *LegacyOfficialClient) GetBeatmap(searchParam map[string]interface{
 		query.Set(k, v.(string))
 	}
 	logger.Trace().Msgf("Getting beatmaps: %v", query)
-	reqUrl := "https://osu.ppy.sh/api/get_beatmaps?" + query.Encode()
+	reqUrl := apiUrl + "?" + query.Encode()
 	req, err := http.NewRequest("GET", reqUrl, nil)
 	if err != nil {
 		return nil, &url.Error{
@@ -56,12 +60,17 @@ func (client *LegacyOfficialClient) GetBeatmap(searchParam map[string]interface{
 			Err: err,
 		}
 	}
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(resp.Body)
 	if resp.StatusCode >= 400 {
-		return nil, &url.Error{
-			Op:  "",
-			URL: reqUrl,
-			Err: err,
+		requestError := NewRequestError(ErrorTypeFromStatus(resp.StatusCode), "osu", apiUrl, resp.StatusCode, fmt.Errorf("status: %s", resp.Status))
+		if requestError.Type == ErrorRateLimited {
+			metrics.RateLimited.WithLabelValues("osu").Inc()
+			retryAfter, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+			requestError.RetryAfter = time.Duration(retryAfter) * time.Second
 		}
+		return nil, requestError
 	}
 	data, err := io.ReadAll(resp.Body)
 	if err != nil {
@@ -74,11 +83,14 @@ func (client *LegacyOfficialClient) GetBeatmap(searchParam map[string]interface{
 	var response []Beatmap
 	err = json.Unmarshal(data, &response)
 	if err != nil {
-		return nil, &url.Error{
-			Op:  "",
-			URL: reqUrl,
-			Err: err,
+		// v1 API returns {"error": "..."} for an invalid key
+		var errorResponse struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &errorResponse) == nil && errorResponse.Error != "" {
+			return nil, NewRequestError(ErrorAuthExpired, "osu", apiUrl, resp.StatusCode, fmt.Errorf("%s", errorResponse.Error))
 		}
+		return nil, NewRequestError(ErrorCorrupt, "osu", apiUrl, resp.StatusCode, err)
 	}
 	return &response, nil
 }
@@ -0,0 +1,191 @@
+package sync
+
+import (
+	"fmt"
+	. "github.com/MingxuanGame/OsuBeatmapSync/model"
+	. "github.com/MingxuanGame/OsuBeatmapSync/model/onedrive"
+	"github.com/MingxuanGame/OsuBeatmapSync/storage"
+	"maps"
+	"path"
+	"slices"
+)
+
+// isFull reports whether the variant is skipped and points at the full file
+func isFull(paths map[string]string, typ string) bool {
+	return typ != "full" && paths["full"] != "" && TrimDriveRoot(paths[typ]) == TrimDriveRoot(paths["full"])
+}
+
+// targetPaths returns the paths of the beatmapset with the current config, for the beatmapset and for each difficulty
+func (s *Syncer) targetPaths(beatmapset BeatmapsetMetadata) (setPaths map[string]string, beatmapPaths map[int]map[string]string) {
+	place := s.placement(beatmapset)
+	setPaths = make(map[string]string)
+	modePaths := make(map[GameMode]map[string]string)
+	for typ := range beatmapset.Path {
+		dir, filename := s.cloudPath(beatmapset, place.primary, typ)
+		setPaths[typ] = path.Join(dir, filename)
+		for mode, modeDir := range place.copies {
+			if modePaths[mode] == nil {
+				modePaths[mode] = make(map[string]string)
+			}
+			dir, filename := s.cloudPath(beatmapset, modeDir, typ)
+			modePaths[mode][typ] = path.Join(dir, filename)
+		}
+	}
+	for typ := range beatmapset.Path {
+		if !isFull(beatmapset.Path, typ) {
+			continue
+		}
+		setPaths[typ] = setPaths["full"]
+		for mode := range modePaths {
+			modePaths[mode][typ] = modePaths[mode]["full"]
+		}
+	}
+	beatmapPaths = make(map[int]map[string]string)
+	for bid, beatmap := range beatmapset.Beatmaps {
+		beatmapPaths[bid] = setPaths
+		if p, ok := modePaths[beatmap.GameMode]; ok {
+			beatmapPaths[bid] = p
+		}
+	}
+	return
+}
+
+// NeedMigrate reports whether any file of the beatmapset is not at its path of the current config
+func (s *Syncer) NeedMigrate(beatmapset BeatmapsetMetadata) bool {
+	setPaths, beatmapPaths := s.targetPaths(beatmapset)
+	equal := func(a, b map[string]string) bool {
+		return maps.EqualFunc(a, b, func(x, y string) bool {
+			return TrimDriveRoot(x) == y
+		})
+	}
+	if !equal(beatmapset.Path, setPaths) {
+		return true
+	}
+	for bid, beatmap := range beatmapset.Beatmaps {
+		if !equal(beatmap.Path, beatmapPaths[bid]) {
+			return true
+		}
+	}
+	return false
+}
+
+// moveFile moves the file to the new path. A file that is already at the new path is kept,
+// so a migration can be resumed after it was interrupted.
+func (s *Syncer) moveFile(oldPath, newPath string) (*storage.Object, error) {
+	if oldPath == newPath {
+		obj, err := s.backend.Stat(newPath)
+		if err == nil && obj == nil {
+			err = NewRequestError(ErrorNotFound, s.backend.Name(), newPath, 0, fmt.Errorf("file %s is not found", newPath))
+		}
+		return obj, err
+	}
+	obj, err := s.backend.Move(oldPath, newPath)
+	if GetErrorType(err) == ErrorNotFound {
+		target, err := s.backend.Stat(newPath)
+		if err != nil {
+			return nil, err
+		}
+		if target == nil {
+			return nil, NewRequestError(ErrorNotFound, s.backend.Name(), oldPath, 0, fmt.Errorf("file %s is not found", oldPath))
+		}
+		return target, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	logger.Info().Msgf("Moved %s to %s", oldPath, newPath)
+	return obj, nil
+}
+
+// Migrate moves the files of the beatmapset to their paths of the current config and returns the beatmapset
+// with the new paths. Files that are not moved keep their links, the links of moved files and new mode copies
+// are made by the backend.
+func (s *Syncer) Migrate(beatmapset BeatmapsetMetadata) (BeatmapsetMetadata, error) {
+	place := s.placement(beatmapset)
+	setPaths, beatmapPaths := s.targetPaths(beatmapset)
+
+	result := beatmapset
+	result.Link = make(map[string]string)
+	result.Path = make(map[string]string)
+	result.Beatmaps = make(map[int]BeatmapMetadata, len(beatmapset.Beatmaps))
+	items := make(map[string]*storage.Object)
+	for typ, oldPath := range beatmapset.Path {
+		if isFull(beatmapset.Path, typ) {
+			continue
+		}
+		item, err := s.moveFile(TrimDriveRoot(oldPath), setPaths[typ])
+		if err != nil {
+			return beatmapset, err
+		}
+		link := beatmapset.Link[typ]
+		if link == "" || TrimDriveRoot(oldPath) != setPaths[typ] {
+			link, err = s.backend.Link(*item)
+			if err != nil {
+				return beatmapset, err
+			}
+		}
+		items[typ] = item
+		result.Link[typ] = link
+		result.Path[typ] = setPaths[typ]
+	}
+	for typ := range beatmapset.Path {
+		if isFull(beatmapset.Path, typ) {
+			result.Link[typ] = result.Link["full"]
+			result.Path[typ] = result.Path["full"]
+		}
+	}
+
+	// the copies of each mode are shared by all difficulties of the mode
+	modeLinks := make(map[GameMode]map[string]string)
+	for _, bid := range slices.Sorted(maps.Keys(beatmapset.Beatmaps)) {
+		beatmap := beatmapset.Beatmaps[bid]
+		modeDir, ok := place.copies[beatmap.GameMode]
+		if !ok {
+			beatmap.Link = result.Link
+			beatmap.Path = result.Path
+			result.Beatmaps[bid] = beatmap
+			continue
+		}
+		links, ok := modeLinks[beatmap.GameMode]
+		if !ok {
+			links = make(map[string]string)
+			for typ, source := range items {
+				oldPath := TrimDriveRoot(beatmap.Path[typ])
+				var item *storage.Object
+				var err error
+				link := ""
+				if oldPath != "" && oldPath != TrimDriveRoot(beatmapset.Path[typ]) {
+					item, err = s.moveFile(oldPath, beatmapPaths[bid][typ])
+					if oldPath == beatmapPaths[bid][typ] {
+						link = beatmap.Link[typ]
+					}
+				} else {
+					item, _, err = s.copyBeatmap(beatmapset, source, modeDir, typ, "", nil)
+				}
+				if err != nil {
+					return beatmapset, err
+				}
+				if link == "" {
+					link, err = s.backend.Link(*item)
+					if err != nil {
+						return beatmapset, err
+					}
+				}
+				links[typ] = link
+			}
+			for typ := range beatmapset.Path {
+				if isFull(beatmapset.Path, typ) {
+					links[typ] = links["full"]
+				}
+			}
+			modeLinks[beatmap.GameMode] = links
+		}
+		beatmap.Link = links
+		beatmap.Path = beatmapPaths[bid]
+		result.Beatmaps[bid] = beatmap
+	}
+
+	// copies that are not needed anymore
+	s.deleteStale(beatmapset, result)
+	return result, nil
+}
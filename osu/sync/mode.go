@@ -0,0 +1,97 @@
+package sync
+
+import (
+	. "github.com/MingxuanGame/OsuBeatmapSync/model"
+	"github.com/MingxuanGame/OsuBeatmapSync/storage"
+	"path"
+	"slices"
+)
+
+const (
+	multiModeMajority = "majority"
+	multiModeFolder   = "multi"
+	multiModeAll      = "all"
+)
+
+// placement is where a beatmapset is stored
+type placement struct {
+	// primary is the mode folder the beatmapset is uploaded to
+	primary string
+	// copies are the mode folders the uploaded file is copied to, for the difficulties of other modes
+	copies map[GameMode]string
+}
+
+// modes returns the game modes of the beatmapset by the number of difficulties, the lower mode first on a tie
+func modes(beatmapset BeatmapsetMetadata) []GameMode {
+	count := make(map[GameMode]int)
+	for _, beatmap := range beatmapset.Beatmaps {
+		count[beatmap.GameMode]++
+	}
+	result := make([]GameMode, 0, len(count))
+	for mode := range count {
+		result = append(result, mode)
+	}
+	slices.SortFunc(result, func(a, b GameMode) int {
+		if count[a] != count[b] {
+			return count[b] - count[a]
+		}
+		return int(a) - int(b)
+	})
+	return result
+}
+
+func (s *Syncer) placement(beatmapset BeatmapsetMetadata) placement {
+	gameModes := modes(beatmapset)
+	if len(gameModes) == 0 {
+		return placement{}
+	}
+	p := placement{primary: s.modeMap[gameModes[0]]}
+	if len(gameModes) == 1 {
+		return p
+	}
+	switch s.config.Path.MultiMode {
+	case multiModeFolder:
+		p.primary = s.config.Path.MultiPath
+		if p.primary == "" {
+			p.primary = multiModeFolder
+		}
+	case multiModeAll:
+		p.copies = make(map[GameMode]string)
+		for _, mode := range gameModes[1:] {
+			p.copies[mode] = s.modeMap[mode]
+		}
+	}
+	return p
+}
+
+// copyBeatmap copies the uploaded file into another mode folder, skipping it if the same file is already there
+// and moving the copy of the previous version at oldPath there if it is the same file.
+// known are files looked up before, like in uploadBeatmap.
+func (s *Syncer) copyBeatmap(beatmapset BeatmapsetMetadata, source *storage.Object, modeDir, typ, oldPath string, known map[string]*storage.Object) (obj *storage.Object, cloudPath string, err error) {
+	uploadPath, filename := s.cloudPath(beatmapset, modeDir, typ)
+	cloudPath = path.Join(uploadPath, filename)
+
+	obj, ok := known[cloudPath]
+	if !ok {
+		obj, err = s.backend.Stat(cloudPath)
+		if err != nil {
+			logger.Warn().Err(err).Int("sid", beatmapset.BeatmapsetId).Str("type", typ).Msgf("Failed to get item %s", cloudPath)
+		}
+	}
+	if obj != nil && obj.Hash != "" && obj.Hash == source.Hash {
+		logger.Info().Int("sid", beatmapset.BeatmapsetId).Str("type", typ).Msgf("File %s is the same, skip copying", cloudPath)
+		return obj, cloudPath, nil
+	}
+	if obj == nil && err == nil {
+		if moved := s.reuse(beatmapset, typ, oldPath, cloudPath, source.Hash, known); moved != nil {
+			return moved, cloudPath, nil
+		}
+	}
+
+	obj, err = s.backend.Copy(source.Path, cloudPath)
+	if err != nil {
+		return nil, "", err
+	}
+	logger.Info().Int("sid", beatmapset.BeatmapsetId).Str("type", typ).Msgf("Copied to %s", cloudPath)
+	return obj, cloudPath, nil
+}
@@ -0,0 +1,360 @@
+package sync
+
+import (
+	"github.com/MingxuanGame/OsuBeatmapSync/metrics"
+	. "github.com/MingxuanGame/OsuBeatmapSync/model"
+	"github.com/MingxuanGame/OsuBeatmapSync/osu/download"
+	"github.com/MingxuanGame/OsuBeatmapSync/storage"
+	"github.com/MingxuanGame/OsuBeatmapSync/utils"
+	"github.com/MingxuanGame/OsuBeatmapSync/utils/beatmap_processing"
+	"github.com/MingxuanGame/OsuBeatmapSync/webhook"
+	"path"
+	"sync"
+)
+
+const (
+	stageDownload = "download"
+	stageProcess  = "process"
+	stageUpload   = "upload"
+)
+
+// syncJob is a beatmapset moving through the download, process and upload stages
+type syncJob struct {
+	beatmapset BeatmapsetMetadata
+	// first is the index of the first downloader to try
+	first    int
+	data     []byte
+	variants []variant
+	// held is the number of bytes the job holds in the memory budget
+	held int64
+}
+
+type variant struct {
+	typ  string
+	data []byte
+	// full is set when the variant is skipped because it is the same as full or saves almost nothing
+	full bool
+}
+
+func (s *Syncer) release(job *syncJob) {
+	s.budget.Release(job.held)
+	job.held = 0
+	job.data = nil
+	job.variants = nil
+}
+
+func (s *Syncer) processors(beatmapset *BeatmapsetMetadata) []beatmap_processing.Processor {
+	var processors []beatmap_processing.Processor
+	if (beatmapset.HasVideo || beatmapset.HasStoryboard) && utils.In(s.config.Osu.ProcessTypes, "mini") {
+		processors = append(processors, beatmap_processing.NewMiniProcessor())
+	}
+	if beatmapset.HasVideo && utils.In(s.config.Osu.ProcessTypes, "no_video") {
+		processors = append(processors, beatmap_processing.NewNoVideoProcessor())
+
+	}
+	if beatmapset.HasStoryboard && utils.In(s.config.Osu.ProcessTypes, "no_storyboard") {
+		processors = append(processors, beatmap_processing.NewNoStoryboardProcessor())
+	}
+	if utils.In(s.config.Osu.ProcessTypes, "no_hit_sound") {
+		processors = append(processors, beatmap_processing.NewNoHitSoundProcessor())
+	}
+	if utils.In(s.config.Osu.ProcessTypes, "no_bg") {
+		processors = append(processors, beatmap_processing.NewNoBackgroundProcessor())
+	}
+	return processors
+}
+
+// downloadStage reserves an estimated size from the memory budget before downloading. The downloaded archive is
+// counted at once, then it waits for an archive sized slot for every variant, so processing never waits while it
+// holds the archive. A kept variant is smaller than the archive, the slots are an upper bound.
+// The budget is exceeded by archives larger than their estimate and by one job at a time taking its slots over
+// the limit when every byte in use belongs to jobs waiting here.
+func (s *Syncer) downloadStage(downloaders []download.BeatmapDownloader, job *syncJob) bool {
+	estimated := min(s.averageSize.Load(), s.budget.Limit())
+	err := s.budget.Acquire(s.ctx, estimated)
+	if err != nil {
+		s.fail(job.beatmapset, err, false, "download")
+		return false
+	}
+	job.held = estimated
+
+	data, permanent, err := s.downloadWithFallback(downloaders, job.first, &job.beatmapset)
+	if err != nil {
+		s.release(job)
+		s.fail(job.beatmapset, err, permanent, "download")
+		return false
+	}
+	size := int64(len(data))
+	// the archive is in memory already, it replaces the estimate without waiting
+	s.budget.Add(size - job.held)
+	job.held = size
+	job.data = data
+	slots := size * int64(len(s.processors(&job.beatmapset)))
+	err = s.budget.AcquireHolding(s.ctx, slots, job.held)
+	if err != nil {
+		s.release(job)
+		s.fail(job.beatmapset, err, false, "download")
+		return false
+	}
+	job.held += slots
+	// moving average, so the next reservations follow the real sizes
+	s.averageSize.Store((s.averageSize.Load()*7 + size) / 8)
+	return true
+}
+
+// processStage builds every variant of the beatmapset in the memory reserved by downloadStage,
+// the reservation of variants that are skipped or smaller than the archive is given back at the end
+func (s *Syncer) processStage(job *syncJob) bool {
+	used := int64(len(job.data))
+	for _, p := range s.processors(&job.beatmapset) {
+		logger.Debug().Msgf("Processing %s with mode %s", job.beatmapset.String(), p.String())
+		result, err := beatmap_processing.ProcessWithResult(p, job.data)
+		if err != nil {
+			s.release(job)
+			s.fail(job.beatmapset, NewRequestError(ErrorCorrupt, "process", p.String(), 0, err), false, "process")
+			return false
+		}
+		if percent := float64(result.Saved) * 100 / float64(len(job.data)); result.Removed == 0 || percent < s.config.Osu.MinSavingPercent {
+			logger.Debug().Int("sid", job.beatmapset.BeatmapsetId).Msgf("Skip %s of %s, removed %d file(s) saving %.1f%%", p.String(), job.beatmapset.String(), result.Removed, percent)
+			job.variants = append(job.variants, variant{typ: p.String(), full: true})
+			continue
+		}
+		used += int64(len(result.Data))
+		job.variants = append(job.variants, variant{typ: p.String(), data: result.Data})
+	}
+	s.budget.Add(used - job.held)
+	job.held = used
+	return true
+}
+
+// linkTarget is where the link of an uploaded or copied file goes
+type linkTarget struct {
+	// primary is set for the file in the primary folder, otherwise it is the copy of mode
+	primary bool
+	mode    GameMode
+	typ     string
+}
+
+// lookup looks up every file the variants are uploaded or copied to and the files of the previous version that
+// may be moved there, with one batch if the backend supports it.
+// Files that cannot be looked up are left out, they are looked up again before uploading.
+func (s *Syncer) lookup(beatmapset BeatmapsetMetadata, place placement, variants []variant, prev previousPaths) map[string]*storage.Object {
+	var paths []string
+	for _, v := range variants {
+		if v.full {
+			continue
+		}
+		dir, filename := s.cloudPath(beatmapset, place.primary, v.typ)
+		paths = append(paths, path.Join(dir, filename))
+		for _, modeDir := range place.copies {
+			dir, filename := s.cloudPath(beatmapset, modeDir, v.typ)
+			paths = append(paths, path.Join(dir, filename))
+		}
+	}
+	paths = append(paths, prev.all()...)
+	objs, errs := storage.StatAll(s.backend, paths)
+	known := make(map[string]*storage.Object, len(paths))
+	for i, p := range paths {
+		if errs[i] != nil {
+			logger.Warn().Err(errs[i]).Int("sid", beatmapset.BeatmapsetId).Msgf("Failed to get item %s", p)
+			continue
+		}
+		known[p] = objs[i]
+	}
+	return known
+}
+
+func (s *Syncer) uploadStage(job *syncJob) {
+	defer s.release(job)
+	beatmapset := job.beatmapset
+	place := s.placement(beatmapset)
+
+	linkMap := make(map[string]string)
+	pathMap := make(map[string]string)
+	modeLinks := make(map[GameMode]map[string]string)
+	modePaths := make(map[GameMode]map[string]string)
+	for mode := range place.copies {
+		modeLinks[mode] = make(map[string]string)
+		modePaths[mode] = make(map[string]string)
+	}
+	variants := append([]variant{{typ: "full", data: job.data}}, job.variants...)
+	prev := s.previousPaths(beatmapset)
+	known := s.lookup(beatmapset, place, variants, prev)
+	// the links are made after the uploads, a backend with batch requests makes them in one round trip
+	var items []storage.Object
+	var targets []linkTarget
+	for _, v := range variants {
+		if v.full {
+			continue
+		}
+		item, cloudPath, err := s.uploadBeatmap(beatmapset, place.primary, v.typ, v.data, prev.set[v.typ], known)
+		if err != nil {
+			s.fail(beatmapset, err, false, "upload")
+			return
+		}
+		items = append(items, *item)
+		targets = append(targets, linkTarget{primary: true, typ: v.typ})
+		pathMap[v.typ] = cloudPath
+
+		for mode, modeDir := range place.copies {
+			copied, cloudPath, err := s.copyBeatmap(beatmapset, item, modeDir, v.typ, prev.modes[mode][v.typ], known)
+			if err != nil {
+				s.fail(beatmapset, err, false, "copy")
+				return
+			}
+			items = append(items, *copied)
+			targets = append(targets, linkTarget{mode: mode, typ: v.typ})
+			modePaths[mode][v.typ] = cloudPath
+		}
+	}
+	links, errs := storage.LinkAll(s.backend, items)
+	for i, target := range targets {
+		if errs[i] != nil {
+			s.fail(beatmapset, errs[i], false, "link")
+			return
+		}
+		if target.primary {
+			linkMap[target.typ] = links[i]
+		} else {
+			modeLinks[target.mode][target.typ] = links[i]
+		}
+	}
+
+	// skipped variants point at full
+	for _, v := range variants {
+		if !v.full {
+			continue
+		}
+		linkMap[v.typ] = linkMap["full"]
+		pathMap[v.typ] = pathMap["full"]
+		for mode := range place.copies {
+			modeLinks[mode][v.typ] = modeLinks[mode]["full"]
+			modePaths[mode][v.typ] = modePaths[mode]["full"]
+		}
+	}
+
+	// every difficulty links to the file in the folder of its own mode if there is a copy
+	for bid, v := range beatmapset.Beatmaps {
+		v.Link = linkMap
+		v.Path = pathMap
+		if _, ok := place.copies[v.GameMode]; ok {
+			v.Link = modeLinks[v.GameMode]
+			v.Path = modePaths[v.GameMode]
+		}
+		beatmapset.Beatmaps[bid] = v
+	}
+	beatmapset.Link = linkMap
+	beatmapset.Path = pathMap
+	s.removeStale(beatmapset)
+	s.mux.Lock()
+	s.result[beatmapset.BeatmapsetId] = beatmapset
+	s.mux.Unlock()
+	s.retry.Forget(beatmapset.BeatmapsetId)
+	s.Stats.Done()
+	logger.Info().Int("sid", beatmapset.BeatmapsetId).Msgf("Upload %s successfully", beatmapset.String())
+	s.Notifier.Emit(webhook.Event{Type: webhook.SetSynced, Run: "sync", Beatmapset: webhook.NewBeatmapset(beatmapset)})
+}
+
+func startWorkers(n int, wg *sync.WaitGroup, worker func()) {
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			worker()
+		}()
+	}
+}
+
+// SyncNewBeatmap pushes the beatmapsets through the download, process and upload worker pools.
+// Backpressure comes from the bounded channels between stages and the memory budget.
+func (s *Syncer) SyncNewBeatmap(downloaders []download.BeatmapDownloader, needSyncBeatmapset []BeatmapsetMetadata) {
+	downloadCh := make(chan *syncJob)
+	processCh := make(chan *syncJob, s.processWorkers)
+	uploadCh := make(chan *syncJob, s.uploadWorkers)
+
+	var downloadWg, processWg, uploadWg sync.WaitGroup
+	startWorkers(s.downloadWorkers, &downloadWg, func() {
+		for job := range downloadCh {
+			ok := s.downloadStage(downloaders, job)
+			s.Stats.Leave(stageDownload)
+			if ok {
+				s.Stats.Enter(stageProcess)
+				processCh <- job
+			}
+		}
+	})
+	startWorkers(s.processWorkers, &processWg, func() {
+		for job := range processCh {
+			ok := s.processStage(job)
+			s.Stats.Leave(stageProcess)
+			if ok {
+				s.Stats.Enter(stageUpload)
+				uploadCh <- job
+			}
+		}
+	})
+	startWorkers(s.uploadWorkers, &uploadWg, func() {
+		for job := range uploadCh {
+			s.uploadStage(job)
+			s.Stats.Leave(stageUpload)
+		}
+	})
+
+feed:
+	for i, beatmapset := range needSyncBeatmapset {
+		if fatal := s.FatalError(); fatal != nil {
+			logger.Error().Err(fatal).Msg("Stop creating tasks because of a fatal error")
+			s.mux.Lock()
+			s.Failed = append(s.Failed, needSyncBeatmapset[i:]...)
+			s.mux.Unlock()
+			break
+		}
+		if beatmapset.CannotDownload || beatmapset.NoAudio {
+			logger.Warn().Int("sid", beatmapset.BeatmapsetId).Msgf("Beatmapset %s is missing download or audio, skip", beatmapset.String())
+			continue
+		}
+		if s.retry.NextRetry(beatmapset.BeatmapsetId).IsZero() {
+			s.Stats.AddTotal(1)
+		}
+		s.Stats.Enter(stageDownload)
+		select {
+		case <-s.ctx.Done():
+			s.Stats.Leave(stageDownload)
+			s.mux.Lock()
+			s.Failed = append(s.Failed, needSyncBeatmapset[i:]...)
+			s.mux.Unlock()
+			break feed
+		case downloadCh <- &syncJob{beatmapset: beatmapset, first: i % len(downloaders)}:
+		}
+	}
+	close(downloadCh)
+
+	logger.Info().Msg("Waiting for all tasks to finish, it may need some time...")
+	downloadWg.Wait()
+	close(processCh)
+	processWg.Wait()
+	close(uploadCh)
+	uploadWg.Wait()
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for k, v := range s.result {
+		for bid, beatmap := range v.Beatmaps {
+			s.Metadata.Beatmaps[bid] = beatmap
+			if v.LastUpdate < beatmap.LastUpdate {
+				v.LastUpdate = beatmap.LastUpdate
+			}
+			gamemode, ok := s.Metadata.GameMode[beatmap.GameMode]
+			if !ok || gamemode.UpdateTime < beatmap.LastUpdate {
+				s.Metadata.GameMode[beatmap.GameMode] = MetadataGameMode{
+					UpdateTime: beatmap.LastUpdate,
+				}
+			}
+		}
+		s.Metadata.Beatmapsets[k] = v
+	}
+	clear(s.result)
+	for mode, m := range s.Metadata.GameMode {
+		metrics.NewestBeatmap.WithLabelValues(mode.String()).Set(float64(m.UpdateTime))
+	}
+}
@@ -0,0 +1,77 @@
+package sync
+
+import (
+	"context"
+	. "github.com/MingxuanGame/OsuBeatmapSync/model"
+	"github.com/MingxuanGame/OsuBeatmapSync/osu/download"
+	"github.com/MingxuanGame/OsuBeatmapSync/storage"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingDownloader returns archives of size once all the expected downloads are running at the same time
+type blockingDownloader struct {
+	size    int
+	started sync.WaitGroup
+}
+
+func (d *blockingDownloader) Name() string {
+	return "blocking"
+}
+
+func (d *blockingDownloader) DownloadBeatmapset(int) ([]byte, error) {
+	d.started.Done()
+	d.started.Wait()
+	return make([]byte, d.size), nil
+}
+
+func TestDownloadStageCountsArchives(t *testing.T) {
+	backend, err := storage.NewLocal(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig()
+	config.General.MemoryBudget = 1
+	config.Osu.ProcessTypes = []string{"no_bg"}
+	s, err := NewSyncer(context.Background(), newMetadata(), backend, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const downloads, size = 4, 400 << 10
+	// the estimates of all downloads fit, an archive with its slot does not fit beside the others
+	s.averageSize.Store(200 << 10)
+	d := &blockingDownloader{size: size}
+	d.started.Add(downloads)
+	done := make(chan *syncJob, downloads)
+	for sid := 1; sid <= downloads; sid++ {
+		go func(job *syncJob) {
+			if s.downloadStage([]download.BeatmapDownloader{d}, job) {
+				done <- job
+			}
+		}(&syncJob{beatmapset: testBeatmapset(sid, StatusRanked, GameModeOsu)})
+	}
+
+	var peak int64
+	for left := downloads; left > 0; left-- {
+		var job *syncJob
+		select {
+		case job = <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d download(s) are stuck with %d of %d bytes used", left, s.budget.Used(), s.budget.Limit())
+		}
+		// the archives of the waiting jobs are counted, one job at a time takes its slot over the limit
+		used := s.budget.Used()
+		if want := int64(left*size + size); used != want {
+			t.Fatalf("%d bytes used with %d archive(s) in memory, want %d", used, left, want)
+		}
+		peak = max(peak, used)
+		s.release(job)
+	}
+	if peak != downloads*size+size {
+		t.Fatalf("peak %d bytes used, want every archive and one slot", peak)
+	}
+	if used := s.budget.Used(); used != 0 {
+		t.Fatalf("%d bytes used after every job is released", used)
+	}
+}
@@ -1,17 +1,23 @@
 package sync
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"github.com/MingxuanGame/OsuBeatmapSync/metrics"
 	. "github.com/MingxuanGame/OsuBeatmapSync/model"
-	"github.com/MingxuanGame/OsuBeatmapSync/onedrive"
+	. "github.com/MingxuanGame/OsuBeatmapSync/model/onedrive"
 	"github.com/MingxuanGame/OsuBeatmapSync/osu/download"
+	"github.com/MingxuanGame/OsuBeatmapSync/stats"
+	"github.com/MingxuanGame/OsuBeatmapSync/storage"
 	"github.com/MingxuanGame/OsuBeatmapSync/utils"
-	"github.com/MingxuanGame/OsuBeatmapSync/utils/beatmap_processing"
+	"github.com/MingxuanGame/OsuBeatmapSync/webhook"
 	"github.com/rs/zerolog/log"
 	"path"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,22 +25,48 @@ var logger = log.With().Str("module", "osu.sync").Logger()
 
 type Syncer struct {
 	ctx       context.Context
-	graph     *onedrive.GraphClient
+	backend   storage.Backend
 	config    *Config
 	modeMap   map[GameMode]string
 	statusMap map[BeatmapStatus]string
+	template  *PathTemplate
 
 	Metadata *Metadata
 	Failed   []BeatmapsetMetadata
+	// DeadLetters are beatmapsets that failed for good or ran out of attempts, they are not retried
+	DeadLetters []utils.RetryState[BeatmapsetMetadata]
+	// Fatal is set when the sync cannot continue, like an expired OneDrive token, read it by FatalError
+	Fatal error
+	Stats *stats.Stats
+	// Notifier receives the events of synced and given up beatmapsets, it may be nil
+	Notifier *webhook.Notifier
 
-	downloadSem chan struct{}
-	uploadSem   chan struct{}
-	mux         sync.RWMutex
-	created     map[int]struct{}
-	result      map[int]BeatmapsetMetadata
+	downloadWorkers int
+	processWorkers  int
+	uploadWorkers   int
+	budget          *utils.ByteBudget
+	averageSize     atomic.Int64
+
+	mux      sync.RWMutex
+	result   map[int]BeatmapsetMetadata
+	disabled map[string]struct{}
+	retry    *utils.RetryTracker[int, BeatmapsetMetadata]
 }
 
-func NewSyncer(ctx context.Context, metadata *Metadata, graph *onedrive.GraphClient, config *Config) *Syncer {
+const defaultRateLimitBackoff = 30 * time.Second
+
+// defaultEstimatedSize is reserved from the memory budget for a download before its real size is known
+const defaultEstimatedSize = 16 << 20
+
+func NewSyncer(ctx context.Context, metadata *Metadata, backend storage.Backend, config *Config) (*Syncer, error) {
+	template, err := config.Path.PathTemplate()
+	if err != nil {
+		return nil, err
+	}
+	err = config.General.CheckBandwidthSchedule()
+	if err != nil {
+		return nil, err
+	}
 	modeMap := map[GameMode]string{
 		GameModeOsu:   config.Path.StdPath,
 		GameModeTaiko: config.Path.TaikoPath,
@@ -47,22 +79,44 @@ func NewSyncer(ctx context.Context, metadata *Metadata, graph *onedrive.GraphCli
 		StatusApproved:  config.Path.RankedPath,
 		StatusQualified: config.Path.QualifiedPath,
 	}
-	return &Syncer{
-		ctx:         ctx,
-		Metadata:    metadata,
-		graph:       graph,
-		config:      config,
-		modeMap:     modeMap,
-		statusMap:   statusMap,
-		downloadSem: make(chan struct{}, config.General.MaxConcurrent),
-		uploadSem:   make(chan struct{}, config.General.MaxConcurrent),
-		created:     make(map[int]struct{}),
-		result:      make(map[int]BeatmapsetMetadata),
+	if config.General.UploadMultiple > 0 {
+		logger.Warn().Msg("upload_multiple is deprecated and ignored, use upload_workers instead")
 	}
+	maxAttempts, baseDelay, maxDelay := config.General.RetryPolicy()
+	downloadWorkers, processWorkers, uploadWorkers := config.General.Workers()
+	s := &Syncer{
+		ctx:             ctx,
+		Metadata:        metadata,
+		backend:         backend,
+		config:          config,
+		modeMap:         modeMap,
+		statusMap:       statusMap,
+		template:        template,
+		downloadWorkers: downloadWorkers,
+		processWorkers:  processWorkers,
+		uploadWorkers:   uploadWorkers,
+		budget:          utils.NewByteBudget(config.General.MemoryBudgetBytes()),
+		result:          make(map[int]BeatmapsetMetadata),
+		disabled:        make(map[string]struct{}),
+		retry:           utils.NewRetryTracker[int, BeatmapsetMetadata](maxAttempts, baseDelay, maxDelay),
+		Stats:           stats.New(stageDownload, stageProcess, stageUpload),
+	}
+	s.averageSize.Store(defaultEstimatedSize)
+	return s, nil
 }
 
-func (s *Syncer) makePath(gameMode GameMode, beatmapStatus BeatmapStatus, typ string) string {
-	return path.Join(s.config.Path.Root, s.modeMap[gameMode], s.statusMap[beatmapStatus], typ)
+// cloudPath returns the folder and the filename of a variant of the beatmapset in the mode folder
+func (s *Syncer) cloudPath(beatmapset BeatmapsetMetadata, modeDir, typ string) (dir, filename string) {
+	p := s.template.Execute(PathValues{
+		Root:       s.config.Path.Root,
+		Mode:       modeDir,
+		Status:     s.statusMap[beatmapset.Primary().Status],
+		Type:       typ,
+		Beatmapset: beatmapset,
+		Unicode:    s.config.Path.UnicodeFilename,
+	})
+	dir, filename = path.Split(p)
+	return strings.TrimSuffix(dir, "/"), filename
 }
 
 func downloadBeatmap(downloader download.BeatmapDownloader, beatmapset *BeatmapsetMetadata) ([]byte, error) {
@@ -82,212 +136,299 @@ func downloadBeatmap(downloader download.BeatmapDownloader, beatmapset *Beatmaps
 	return data, nil
 }
 
-func (s *Syncer) uploadBeatmap(beatmapset BeatmapsetMetadata, typ string, data []byte) (link, cloudPath string, err error) {
-	var beatmap BeatmapMetadata
-	for _, v := range beatmapset.Beatmaps {
-		beatmap = v
-		break
-	}
+func (s *Syncer) isDisabled(downloader download.BeatmapDownloader) bool {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	_, ok := s.disabled[downloader.Name()]
+	return ok
+}
 
-	uploadPath := s.makePath(beatmap.GameMode, beatmap.Status, typ)
-	filename := utils.MakeFilename(beatmapset.BeatmapsetId, beatmap.Artist, beatmap.Title)
+func (s *Syncer) disable(downloader download.BeatmapDownloader) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.disabled[downloader.Name()] = struct{}{}
+}
 
-	item, err := s.graph.GetItem(uploadPath, filename)
-	if err != nil {
-		logger.Warn().Err(err).Int("sid", beatmapset.BeatmapsetId).Str("type", typ).Msgf("Failed to get item %s/%s", uploadPath, filename)
-	}
-	if item != nil {
-		logger.Info().Int("sid", beatmapset.BeatmapsetId).Str("type", typ).Msgf("File %s/%s already exists", uploadPath, filename)
-		if item.VerifyQuickXorHash(data) {
-			logger.Info().Int("sid", beatmapset.BeatmapsetId).Str("type", typ).Msgf("File %s/%s is the same, skip", uploadPath, filename)
-			goto skipUpload
+// downloadWithFallback tries every enabled downloader starting from the first one, switching mirror on failure.
+// permanent is true only if all mirrors report that the beatmapset cannot be downloaded.
+func (s *Syncer) downloadWithFallback(downloaders []download.BeatmapDownloader, first int, beatmapset *BeatmapsetMetadata) (data []byte, permanent bool, err error) {
+	permanent = true
+	tried := 0
+	for i := range downloaders {
+		downloader := downloaders[(first+i)%len(downloaders)]
+		if s.isDisabled(downloader) {
+			continue
+		}
+		tried++
+		data, err = downloadBeatmap(downloader, beatmapset)
+		if err == nil {
+			s.Stats.AddDownloaded(downloader.Name(), int64(len(data)))
+			metrics.Downloads.WithLabelValues(downloader.Name(), "success").Inc()
+			metrics.DownloadBytes.WithLabelValues(downloader.Name()).Add(float64(len(data)))
+			return data, false, nil
+		}
+		if errors.Is(err, context.Canceled) {
+			return nil, false, err
+		}
+		metrics.Downloads.WithLabelValues(downloader.Name(), "failure").Inc()
+		if GetErrorType(err) == ErrorRateLimited {
+			metrics.RateLimited.WithLabelValues(downloader.Name()).Inc()
 		}
+
+		logEvent := logger.Warn().Err(err).Str("downloader", downloader.Name()).Int("sid", beatmapset.BeatmapsetId)
+		switch GetErrorType(err) {
+		case ErrorNotFound, ErrorUnavailable:
+			logEvent.Msgf("Beatmapset %s is not available on this mirror, switching", beatmapset.String())
+			continue
+		case ErrorAuthExpired:
+			logEvent.Msgf("Authorization of downloader expired, disabling it")
+			s.disable(downloader)
+			// only the mirror is lost, the sync goes on with the others
+			err = NewRequestError(ErrorUnavailable, downloader.Name(), "", 0, err)
+		case ErrorRateLimited:
+			retryAfter := defaultRateLimitBackoff
+			var requestError *RequestError
+			if errors.As(err, &requestError) && requestError.RetryAfter > 0 {
+				retryAfter = requestError.RetryAfter
+			}
+			logEvent.Msgf("Rate limited, backing off for %s and switching mirror", retryAfter)
+			select {
+			case <-s.ctx.Done():
+				return nil, false, s.ctx.Err()
+			case <-time.After(retryAfter):
+			}
+		default:
+			logEvent.Msgf("Failed to download %s, switching mirror", beatmapset.String())
+		}
+		permanent = false
+	}
+	if tried == 0 {
+		return nil, false, fmt.Errorf("no downloader available")
 	}
+	return nil, permanent, err
+}
 
-	err = s.graph.UploadLargeFile(uploadPath, filename, data)
-	if err != nil {
+func (s *Syncer) fail(beatmapset BeatmapsetMetadata, err error, permanent bool, action string) {
+	if errors.Is(err, context.Canceled) {
+		s.mux.Lock()
+		s.Failed = append(s.Failed, beatmapset)
+		s.mux.Unlock()
 		return
 	}
+	metrics.Failures.WithLabelValues(action, GetErrorType(err).String()).Inc()
+	retry, state := s.retry.Fail(beatmapset.BeatmapsetId, beatmapset, GetErrorType(err).String(), err, permanent)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	// an expired mirror is disabled by downloadWithFallback, this is the storage and nothing can be uploaded
+	if GetErrorType(err) == ErrorAuthExpired && s.Fatal == nil {
+		s.Fatal = err
+	}
+	if !retry {
+		s.Stats.Fail()
+		s.DeadLetters = append(s.DeadLetters, state)
+		logger.Error().Err(err).Int("sid", beatmapset.BeatmapsetId).Msgf("Failed %s %s after %d attempt(s), giving up", action, beatmapset.String(), state.Attempts)
+		s.Notifier.Emit(webhook.Event{
+			Type:       webhook.SetFailed,
+			Run:        "sync",
+			Beatmapset: webhook.NewBeatmapset(beatmapset),
+			Attempts:   state.Attempts,
+			Error:      err.Error(),
+		})
+		return
+	}
+	s.Failed = append(s.Failed, beatmapset)
+	logger.Warn().Err(err).Int("sid", beatmapset.BeatmapsetId).Msgf("Failed %s %s (attempt %d), retry in %s", action, beatmapset.String(), state.Attempts, time.Until(state.NextRetry).Round(time.Second))
+}
 
-skipUpload:
-	if item == nil {
-		item, err = s.graph.GetItem(uploadPath, filename)
+// FatalError returns the error the sync stopped for, nil if it can continue
+func (s *Syncer) FatalError() error {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.Fatal
+}
+
+// uploadBeatmap uploads the file unless the same file is there or the file of the previous version at oldPath
+// is the same and can be moved there. known are files looked up before, other paths are looked up here.
+func (s *Syncer) uploadBeatmap(beatmapset BeatmapsetMetadata, modeDir, typ string, data []byte, oldPath string, known map[string]*storage.Object) (obj *storage.Object, cloudPath string, err error) {
+	uploadPath, filename := s.cloudPath(beatmapset, modeDir, typ)
+	cloudPath = path.Join(uploadPath, filename)
+
+	obj, ok := known[cloudPath]
+	if !ok {
+		obj, err = s.backend.Stat(cloudPath)
 		if err != nil {
-			return
+			logger.Warn().Err(err).Int("sid", beatmapset.BeatmapsetId).Str("type", typ).Msgf("Failed to get item %s", cloudPath)
 		}
 	}
-	if item == nil {
-		return "", "", fmt.Errorf("item %s/%s is not found", uploadPath, filename)
+	hash := s.backend.Hash(data)
+	if obj != nil {
+		logger.Info().Int("sid", beatmapset.BeatmapsetId).Str("type", typ).Msgf("File %s already exists", cloudPath)
+		if obj.Hash != "" && obj.Hash == hash {
+			logger.Info().Int("sid", beatmapset.BeatmapsetId).Str("type", typ).Msgf("File %s is the same, skip", cloudPath)
+			return obj, cloudPath, nil
+		}
+	} else if err == nil {
+		if moved := s.reuse(beatmapset, typ, oldPath, cloudPath, hash, known); moved != nil {
+			return moved, cloudPath, nil
+		}
 	}
-	link, err = s.graph.MakeShareLink(item.Id)
+
+	obj, err = s.backend.Put(cloudPath, bytes.NewReader(data), int64(len(data)))
 	if err != nil {
-		return
+		return nil, "", err
 	}
-	cloudPath = path.Join(uploadPath, filename)
-	return
+	s.Stats.AddUploaded(int64(len(data)))
+	metrics.UploadBytes.Add(float64(len(data)))
+	return obj, cloudPath, nil
+}
 
+// previousPaths are the files of the previous version of a beatmapset by variant, in the primary folder and
+// in the folder of each mode it was copied to
+type previousPaths struct {
+	set   map[string]string
+	modes map[GameMode]map[string]string
 }
 
-func (s *Syncer) uploadTask(wg *sync.WaitGroup, beatmapset BeatmapsetMetadata, data []byte) {
-	defer wg.Done()
-	defer func() {
-		s.mux.Lock()
-		delete(s.created, beatmapset.BeatmapsetId)
-		s.mux.Unlock()
-	}()
-	s.uploadSem <- struct{}{}
-	defer func() { <-s.uploadSem }()
-	defer func() {
-		if r := recover(); r != nil {
-			s.mux.Lock()
-			s.Failed = append(s.Failed, beatmapset)
-			s.mux.Unlock()
-			if strings.Contains(fmt.Sprint(r), "context canceled") {
-				return
-			}
-			logger.Warn().Err(r.(error)).Int("sid", beatmapset.BeatmapsetId).Msgf("Failed upload %s", beatmapset.String())
+func (p previousPaths) all() []string {
+	var result []string
+	for _, v := range p.set {
+		result = append(result, v)
+	}
+	for _, paths := range p.modes {
+		for _, v := range paths {
+			result = append(result, v)
 		}
-	}()
-
-	var processors []beatmap_processing.Processor
-	if (beatmapset.HasVideo || beatmapset.HasStoryboard) && utils.In(s.config.Osu.ProcessTypes, "mini") {
-		processors = append(processors, beatmap_processing.NewMiniProcessor())
 	}
-	if beatmapset.HasVideo && utils.In(s.config.Osu.ProcessTypes, "no_video") {
-		processors = append(processors, beatmap_processing.NewNoVideoProcessor())
+	return result
+}
 
+// previousPaths returns the files of the previous version of the beatmapset that may be moved to the new paths.
+// Variants that pointed at full and difficulties that used the files in the primary folder are left out.
+func (s *Syncer) previousPaths(beatmapset BeatmapsetMetadata) previousPaths {
+	prev := previousPaths{set: make(map[string]string), modes: make(map[GameMode]map[string]string)}
+	s.mux.RLock()
+	old, ok := s.Metadata.Beatmapsets[beatmapset.BeatmapsetId]
+	s.mux.RUnlock()
+	if !ok {
+		return prev
 	}
-	if beatmapset.HasStoryboard && utils.In(s.config.Osu.ProcessTypes, "no_storyboard") {
-		processors = append(processors, beatmap_processing.NewNoStoryboardProcessor())
-	}
-	if utils.In(s.config.Osu.ProcessTypes, "no_hit_sound") {
-		processors = append(processors, beatmap_processing.NewNoHitSoundProcessor())
+	for typ, p := range old.Path {
+		if p != "" && !isFull(old.Path, typ) {
+			prev.set[typ] = TrimDriveRoot(p)
+		}
 	}
-	if utils.In(s.config.Osu.ProcessTypes, "no_bg") {
-		processors = append(processors, beatmap_processing.NewNoBackgroundProcessor())
+	for _, beatmap := range old.Beatmaps {
+		for typ, p := range beatmap.Path {
+			p = TrimDriveRoot(p)
+			if p == "" || p == TrimDriveRoot(old.Path[typ]) || isFull(beatmap.Path, typ) {
+				continue
+			}
+			if prev.modes[beatmap.GameMode] == nil {
+				prev.modes[beatmap.GameMode] = make(map[string]string)
+			}
+			prev.modes[beatmap.GameMode][typ] = p
+		}
 	}
+	return prev
+}
 
-	linkMap := make(map[string]string)
-	pathMap := make(map[string]string)
-	link, cloudPath, err := s.uploadBeatmap(beatmapset, "full", data)
-	if err != nil {
-		panic(err)
+// reuse moves the file of the previous version at oldPath to cloudPath if it has the same content, so a file whose
+// path changed, like after the beatmapset moves to another status, is not uploaded again.
+// It returns nil if nothing is moved, the file is then uploaded and the old one is deleted by removeStale.
+func (s *Syncer) reuse(beatmapset BeatmapsetMetadata, typ, oldPath, cloudPath, hash string, known map[string]*storage.Object) *storage.Object {
+	if oldPath == "" || oldPath == cloudPath || hash == "" {
+		return nil
 	}
-	linkMap["full"] = link
-	pathMap["full"] = cloudPath
-	for _, p := range processors {
-		logger.Debug().Msgf("Processing %s with mode %s", beatmapset.String(), p.String())
-		processed, err := beatmap_processing.Process(p, data)
+	old, ok := known[oldPath]
+	if !ok {
+		var err error
+		old, err = s.backend.Stat(oldPath)
 		if err != nil {
-			panic(err)
+			logger.Warn().Err(err).Int("sid", beatmapset.BeatmapsetId).Str("type", typ).Msgf("Failed to get item %s", oldPath)
+			return nil
 		}
-		typ := p.String()
-		link, cloudPath, err = s.uploadBeatmap(beatmapset, typ, processed)
-		if err != nil {
-			panic(err)
-		}
-		linkMap[typ] = link
-		pathMap[typ] = cloudPath
 	}
-
-	for bid, v := range beatmapset.Beatmaps {
-		v.Link = linkMap
-		v.Path = pathMap
-		beatmapset.Beatmaps[bid] = v
+	if old == nil || old.Hash != hash {
+		return nil
 	}
-	beatmapset.Link = linkMap
-	beatmapset.Path = pathMap
-	s.mux.Lock()
-	s.result[beatmapset.BeatmapsetId] = beatmapset
-	s.mux.Unlock()
-	logger.Info().Int("sid", beatmapset.BeatmapsetId).Msgf("Upload %s successfully", beatmapset.String())
-}
-
-func (s *Syncer) syncSingleBeatmapset(wg *sync.WaitGroup, downloader download.BeatmapDownloader, beatmapset BeatmapsetMetadata) {
-	defer func() {
-		if r := recover(); r != nil {
-			s.Failed = append(s.Failed, beatmapset)
-			s.mux.Lock()
-			delete(s.created, beatmapset.BeatmapsetId)
-			s.mux.Unlock()
-			if strings.Contains(fmt.Sprint(r), "context canceled") {
-				return
-			}
-			logger.Warn().Err(r.(error)).Int("sid", beatmapset.BeatmapsetId).Msgf("Failed download %s", beatmapset.String())
-		}
-	}()
-	defer wg.Done()
-	defer func() { <-s.downloadSem }()
-	s.mux.Lock()
-	s.created[beatmapset.BeatmapsetId] = struct{}{}
-	s.mux.Unlock()
-	if beatmapset.CannotDownload || beatmapset.NoAudio {
-		logger.Warn().Int("sid", beatmapset.BeatmapsetId).Msgf("Beatmapset %s is missing download or audio, skip", beatmapset.String())
-		s.mux.Lock()
-		delete(s.created, beatmapset.BeatmapsetId)
-		s.mux.Unlock()
-		return
-	}
-	data, err := downloadBeatmap(downloader, &beatmapset)
+	obj, err := s.backend.Move(oldPath, cloudPath)
 	if err != nil {
-		panic(err)
+		logger.Warn().Err(err).Int("sid", beatmapset.BeatmapsetId).Str("type", typ).Msgf("Failed to move %s to %s, uploading again", oldPath, cloudPath)
+		return nil
 	}
+	logger.Info().Int("sid", beatmapset.BeatmapsetId).Str("type", typ).Msgf("File %s is the same, moved to %s", oldPath, cloudPath)
+	return obj
+}
 
-	// Wait
-	for {
-		select {
-		case <-s.ctx.Done():
-			return
-		default:
-
-		}
-		if len(s.created) < s.config.General.MaxConcurrent*s.config.General.UploadMultiple {
-			break
+// paths returns every file of the beatmapset, including the copies in other mode folders
+func paths(beatmapset BeatmapsetMetadata) map[string]string {
+	result := make(map[string]string)
+	for typ, p := range beatmapset.Path {
+		result[TrimDriveRoot(p)] = typ
+	}
+	for _, beatmap := range beatmapset.Beatmaps {
+		for typ, p := range beatmap.Path {
+			result[TrimDriveRoot(p)] = typ
 		}
-		time.Sleep(time.Second)
 	}
+	delete(result, "")
+	return result
+}
 
-	wg.Add(1)
-	go s.uploadTask(wg, beatmapset, data)
+// removeStale deletes the files of the previous version of the beatmapset whose path is no longer used,
+// like after the artist or title is changed or the beatmapset moves to another status
+func (s *Syncer) removeStale(beatmapset BeatmapsetMetadata) {
+	s.mux.RLock()
+	old, ok := s.Metadata.Beatmapsets[beatmapset.BeatmapsetId]
+	s.mux.RUnlock()
+	if !ok {
+		return
+	}
+	s.deleteStale(old, beatmapset)
 }
 
-func (s *Syncer) SyncNewBeatmap(downloaders []download.BeatmapDownloader, needSyncBeatmapset []BeatmapsetMetadata) {
-	var wg sync.WaitGroup
-	for i, beatmapset := range needSyncBeatmapset {
-		select {
-		case <-s.ctx.Done():
-			goto jumpLoop
-		default:
+// deleteStale deletes the files of old that are not used by beatmapset
+func (s *Syncer) deleteStale(old, beatmapset BeatmapsetMetadata) {
+	current := paths(beatmapset)
+	for oldPath, typ := range paths(old) {
+		if _, ok := current[oldPath]; ok {
+			continue
+		}
+		err := s.backend.Delete(oldPath, "")
+		if GetErrorType(err) == ErrorNotFound {
+			continue
+		}
+		if err != nil {
+			logger.Warn().Err(err).Int("sid", beatmapset.BeatmapsetId).Str("type", typ).Msgf("Failed to delete stale file %s", oldPath)
+			continue
 		}
-		wg.Add(1)
-		s.downloadSem <- struct{}{}
-		downloader := downloaders[i%len(downloaders)]
-		go s.syncSingleBeatmapset(&wg, downloader, beatmapset)
+		logger.Info().Int("sid", beatmapset.BeatmapsetId).Str("type", typ).Msgf("Deleted stale file %s, replaced by %s", oldPath, beatmapset.Path[typ])
 	}
+}
 
-jumpLoop:
-	logger.Info().Msg("Waiting for all tasks to finish, it may need some time...")
-	wg.Wait()
-	clear(s.created)
-	for k, v := range s.result {
-		for bid, beatmap := range v.Beatmaps {
-			s.Metadata.Beatmaps[bid] = beatmap
-			if v.LastUpdate < beatmap.LastUpdate {
-				v.LastUpdate = beatmap.LastUpdate
-			}
-			gamemode, ok := s.Metadata.GameMode[beatmap.GameMode]
-			if !ok || gamemode.UpdateTime < beatmap.LastUpdate {
-				s.Metadata.GameMode[beatmap.GameMode] = MetadataGameMode{
-					UpdateTime: beatmap.LastUpdate,
-				}
-			}
+// NextRetry returns the earliest time one of the failed beatmapsets may be retried
+func (s *Syncer) NextRetry() time.Time {
+	var next time.Time
+	for _, beatmapset := range s.Failed {
+		retryTime := s.retry.NextRetry(beatmapset.BeatmapsetId)
+		if next.IsZero() || retryTime.Before(next) {
+			next = retryTime
 		}
-		s.Metadata.Beatmapsets[k] = v
 	}
+	return next
 }
 
+// ReSync syncs the failed beatmapsets whose backoff has expired
 func (s *Syncer) ReSync(downloaders []download.BeatmapDownloader) {
-	failed := s.Failed
-	s.Failed = nil
-	s.SyncNewBeatmap(downloaders, failed)
+	var due, waiting []BeatmapsetMetadata
+	now := time.Now()
+	for _, beatmapset := range s.Failed {
+		if s.retry.NextRetry(beatmapset.BeatmapsetId).After(now) {
+			waiting = append(waiting, beatmapset)
+		} else {
+			due = append(due, beatmapset)
+		}
+	}
+	s.Failed = waiting
+	s.SyncNewBeatmap(downloaders, due)
 }
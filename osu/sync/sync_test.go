@@ -0,0 +1,233 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	. "github.com/MingxuanGame/OsuBeatmapSync/model"
+	. "github.com/MingxuanGame/OsuBeatmapSync/model/onedrive"
+	"github.com/MingxuanGame/OsuBeatmapSync/osu/download"
+	"github.com/MingxuanGame/OsuBeatmapSync/storage"
+	"io"
+	"testing"
+)
+
+type fakeDownloader struct {
+	files map[int][]byte
+	// err is returned instead of the files if it is set
+	err error
+}
+
+func (d *fakeDownloader) Name() string {
+	return "fake"
+}
+
+func (d *fakeDownloader) DownloadBeatmapset(beatmapsetId int) ([]byte, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	return d.files[beatmapsetId], nil
+}
+
+func testConfig() *Config {
+	config := &Config{}
+	config.Path.Root = "Beatmaps"
+	config.Path.StdPath, config.Path.TaikoPath, config.Path.CatchPath, config.Path.ManiaPath = "osu", "taiko", "catch", "mania"
+	config.Path.RankedPath, config.Path.LovedPath, config.Path.QualifiedPath = "Ranked", "Loved", "Qualified"
+	config.Path.MultiMode = multiModeAll
+	config.General.MaxConcurrent = 2
+	return config
+}
+
+func testBeatmapset(sid int, status BeatmapStatus, modes ...GameMode) BeatmapsetMetadata {
+	beatmapset := BeatmapsetMetadata{BeatmapsetId: sid, Beatmaps: make(map[int]BeatmapMetadata)}
+	for i, mode := range modes {
+		bid := sid*10 + i
+		beatmapset.Beatmaps[bid] = BeatmapMetadata{Beatmap: Beatmap{
+			BeatmapId:    bid,
+			BeatmapsetId: sid,
+			Artist:       "Artist",
+			Title:        "Title",
+			Status:       status,
+			GameMode:     mode,
+		}}
+	}
+	return beatmapset
+}
+
+func newMetadata() *Metadata {
+	return &Metadata{
+		GameMode:    make(map[GameMode]MetadataGameMode),
+		Beatmaps:    make(map[int]BeatmapMetadata),
+		Beatmapsets: make(map[int]BeatmapsetMetadata),
+	}
+}
+
+// syncOnce runs one sync of the beatmapsets like the sync command does and returns the bytes uploaded
+func syncOnce(t *testing.T, backend storage.Backend, metadata *Metadata, downloader *fakeDownloader, beatmapsets ...BeatmapsetMetadata) int64 {
+	t.Helper()
+	s, err := NewSyncer(context.Background(), metadata, backend, testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SyncNewBeatmap([]download.BeatmapDownloader{downloader}, beatmapsets)
+	if len(s.Failed) > 0 || len(s.DeadLetters) > 0 {
+		t.Fatalf("%d beatmapset(s) failed, %d given up", len(s.Failed), len(s.DeadLetters))
+	}
+	return s.Stats.Snapshot().Uploaded
+}
+
+func readFile(t *testing.T, backend storage.Backend, p string) []byte {
+	t.Helper()
+	data, err := storage.ReadAll(backend, TrimDriveRoot(p))
+	if err != nil {
+		t.Fatalf("read %s: %v", p, err)
+	}
+	return data
+}
+
+func assertMissing(t *testing.T, backend storage.Backend, p string) {
+	t.Helper()
+	obj, err := backend.Stat(TrimDriveRoot(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj != nil {
+		t.Fatalf("%s is not removed", p)
+	}
+}
+
+func TestSyncLocal(t *testing.T) {
+	backend, err := storage.NewLocal(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := newMetadata()
+	archive := []byte("beatmapset archive")
+	downloader := &fakeDownloader{files: map[int][]byte{1: archive}}
+
+	uploaded := syncOnce(t, backend, metadata, downloader, testBeatmapset(1, StatusRanked, GameModeOsu, GameModeOsu, GameModeTaiko))
+	if uploaded != int64(len(archive)) {
+		t.Fatalf("uploaded %d bytes, want the archive once", uploaded)
+	}
+	synced := metadata.Beatmapsets[1]
+	primary := synced.Path["full"]
+	if primary != "Beatmaps/osu/Ranked/full/1 Artist - Title.osz" {
+		t.Fatalf("uploaded to %s", primary)
+	}
+	if !bytes.Equal(readFile(t, backend, primary), archive) {
+		t.Fatal("uploaded file is not the archive")
+	}
+	if synced.Link["full"] == "" {
+		t.Fatal("no link in the metadata")
+	}
+	// the taiko difficulty links to the copy in the taiko folder
+	taiko := metadata.Beatmaps[12].Path["full"]
+	if taiko != "Beatmaps/taiko/Ranked/full/1 Artist - Title.osz" || !bytes.Equal(readFile(t, backend, taiko), archive) {
+		t.Fatalf("taiko copy at %s", taiko)
+	}
+	if metadata.Beatmaps[10].Path["full"] != primary {
+		t.Fatal("osu difficulty does not link to the primary file")
+	}
+
+	// a status change moves the files instead of uploading them again
+	uploaded = syncOnce(t, backend, metadata, downloader, testBeatmapset(1, StatusLoved, GameModeOsu, GameModeOsu, GameModeTaiko))
+	if uploaded != 0 {
+		t.Fatalf("uploaded %d bytes after a status change, want the files moved", uploaded)
+	}
+	moved := metadata.Beatmapsets[1].Path["full"]
+	if moved != "Beatmaps/osu/Loved/full/1 Artist - Title.osz" || !bytes.Equal(readFile(t, backend, moved), archive) {
+		t.Fatalf("moved to %s", moved)
+	}
+	assertMissing(t, backend, primary)
+	assertMissing(t, backend, taiko)
+	if !bytes.Equal(readFile(t, backend, metadata.Beatmaps[12].Path["full"]), archive) {
+		t.Fatal("taiko copy is not moved")
+	}
+
+	// changed content is uploaded again and the stale file is deleted
+	updated := []byte("updated beatmapset archive")
+	downloader.files[1] = updated
+	uploaded = syncOnce(t, backend, metadata, downloader, testBeatmapset(1, StatusRanked, GameModeOsu, GameModeOsu, GameModeTaiko))
+	if uploaded != int64(len(updated)) {
+		t.Fatalf("uploaded %d bytes, want the updated archive once", uploaded)
+	}
+	if !bytes.Equal(readFile(t, backend, metadata.Beatmapsets[1].Path["full"]), updated) {
+		t.Fatal("uploaded file is not the updated archive")
+	}
+	assertMissing(t, backend, moved)
+
+	objects, err := backend.List("Beatmaps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 {
+		t.Fatalf("%d file(s) in the storage, want the file and the taiko copy", len(objects))
+	}
+}
+
+func TestSyncLocalSkipsSameFile(t *testing.T) {
+	backend, err := storage.NewLocal(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := []byte("beatmapset archive")
+	downloader := &fakeDownloader{files: map[int][]byte{2: archive}}
+	syncOnce(t, backend, newMetadata(), downloader, testBeatmapset(2, StatusRanked, GameModeMania))
+
+	// a lost metadata file is made again without uploading the files that are there
+	metadata := newMetadata()
+	uploaded := syncOnce(t, backend, metadata, downloader, testBeatmapset(2, StatusRanked, GameModeMania))
+	if uploaded != 0 {
+		t.Fatalf("uploaded %d bytes, want the existing file kept", uploaded)
+	}
+	if !bytes.Equal(readFile(t, backend, metadata.Beatmapsets[2].Path["full"]), archive) {
+		t.Fatal("file is changed")
+	}
+}
+
+// expiredBackend is a storage whose authorization expired for uploads
+type expiredBackend struct {
+	storage.Backend
+}
+
+func (expiredBackend) Put(p string, _ io.Reader, _ int64) (*storage.Object, error) {
+	return nil, NewRequestError(ErrorAuthExpired, "storage", p, 401, errors.New("token expired"))
+}
+
+func TestSyncAuthExpired(t *testing.T) {
+	local, err := storage.NewLocal(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := []byte("beatmapset archive")
+	tests := []struct {
+		name       string
+		backend    storage.Backend
+		downloader *fakeDownloader
+		fatal      bool
+	}{
+		// a mirror is disabled and the other beatmapsets are still tried
+		{"mirror", local, &fakeDownloader{err: NewRequestError(ErrorAuthExpired, "fake", "", 401, errors.New("token expired"))}, false},
+		// nothing can be uploaded, the sync stops
+		{"storage", expiredBackend{local}, &fakeDownloader{files: map[int][]byte{1: archive, 2: archive}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewSyncer(context.Background(), newMetadata(), tt.backend, testConfig())
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.SyncNewBeatmap([]download.BeatmapDownloader{tt.downloader}, []BeatmapsetMetadata{
+				testBeatmapset(1, StatusRanked, GameModeOsu),
+				testBeatmapset(2, StatusRanked, GameModeOsu),
+			})
+			if fatal := s.FatalError(); (fatal != nil) != tt.fatal {
+				t.Fatalf("fatal error %v, want fatal %t", fatal, tt.fatal)
+			}
+			if !tt.fatal && len(s.Failed)+len(s.DeadLetters) != 2 {
+				t.Fatalf("%d beatmapset(s) failed, want both tried", len(s.Failed)+len(s.DeadLetters))
+			}
+		})
+	}
+}
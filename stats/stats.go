@@ -0,0 +1,130 @@
+package stats
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats are the counters of a sync or metadata run, they are safe for concurrent use
+type Stats struct {
+	started  time.Time
+	total    atomic.Int64
+	done     atomic.Int64
+	failed   atomic.Int64
+	uploaded atomic.Int64
+
+	mux        sync.RWMutex
+	downloaded map[string]*atomic.Int64
+	stages     []string
+	depth      map[string]*atomic.Int64
+}
+
+type Snapshot struct {
+	Time     time.Time
+	Started  time.Time
+	Total    int64
+	Done     int64
+	Failed   int64
+	Uploaded int64
+	// Downloaded is the number of bytes downloaded from each mirror
+	Downloaded map[string]int64
+	// Stages are the stage names in pipeline order, Depth is the number of items queued or running in each
+	Stages []string
+	Depth  map[string]int64
+}
+
+func New(stages ...string) *Stats {
+	s := &Stats{
+		started:    time.Now(),
+		downloaded: make(map[string]*atomic.Int64),
+		stages:     stages,
+		depth:      make(map[string]*atomic.Int64),
+	}
+	for _, stage := range stages {
+		s.depth[stage] = &atomic.Int64{}
+	}
+	return s
+}
+
+func (s *Stats) AddTotal(n int) {
+	s.total.Add(int64(n))
+}
+
+func (s *Stats) Done() {
+	s.done.Add(1)
+}
+
+func (s *Stats) Fail() {
+	s.failed.Add(1)
+}
+
+func (s *Stats) AddDownloaded(mirror string, n int64) {
+	s.mux.RLock()
+	counter, ok := s.downloaded[mirror]
+	s.mux.RUnlock()
+	if !ok {
+		s.mux.Lock()
+		counter, ok = s.downloaded[mirror]
+		if !ok {
+			counter = &atomic.Int64{}
+			s.downloaded[mirror] = counter
+		}
+		s.mux.Unlock()
+	}
+	counter.Add(n)
+}
+
+func (s *Stats) AddUploaded(n int64) {
+	s.uploaded.Add(n)
+}
+
+// Enter marks an item as queued or running in the stage, Leave undoes it
+func (s *Stats) Enter(stage string) {
+	if counter, ok := s.depth[stage]; ok {
+		counter.Add(1)
+	}
+}
+
+func (s *Stats) Leave(stage string) {
+	if counter, ok := s.depth[stage]; ok {
+		counter.Add(-1)
+	}
+}
+
+func (s *Stats) Snapshot() Snapshot {
+	snapshot := Snapshot{
+		Time:       time.Now(),
+		Started:    s.started,
+		Total:      s.total.Load(),
+		Done:       s.done.Load(),
+		Failed:     s.failed.Load(),
+		Uploaded:   s.uploaded.Load(),
+		Downloaded: make(map[string]int64),
+		Stages:     s.stages,
+		Depth:      make(map[string]int64),
+	}
+	s.mux.RLock()
+	for mirror, counter := range s.downloaded {
+		snapshot.Downloaded[mirror] = counter.Load()
+	}
+	s.mux.RUnlock()
+	for stage, counter := range s.depth {
+		snapshot.Depth[stage] = counter.Load()
+	}
+	return snapshot
+}
+
+func (s Snapshot) Remaining() int64 {
+	return max(s.Total-s.Done-s.Failed, 0)
+}
+
+// ETA estimates the time left from the average speed since the run started, zero if unknown
+func (s Snapshot) ETA() time.Duration {
+	finished := s.Done + s.Failed
+	if finished == 0 {
+		return 0
+	}
+	perItem := s.Time.Sub(s.Started) / time.Duration(finished)
+	return perItem * time.Duration(s.Remaining())
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/MingxuanGame/OsuBeatmapSync/model"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Object is a file in a backend
+type Object struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	// Path is relative to the root of the backend, separated by "/"
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// Hash is the content hash in the format of Backend.Hash, empty if the backend does not know it
+	Hash string `json:"hash,omitempty"`
+	// ETag changes whenever the file changes, it is used for conditional writes
+	ETag string `json:"etag,omitempty"`
+}
+
+// Backend stores the beatmap files and the metadata. Paths are relative to the root of the backend.
+// Errors are *model.RequestError with ErrorNotFound for a missing file and ErrorConflict for a failed condition.
+type Backend interface {
+	// Name is the name of the backend in logs, like "onedrive"
+	Name() string
+	// Put writes size bytes from r to the file, creating missing folders and replacing an existing file
+	Put(p string, r io.Reader, size int64) (*Object, error)
+	// PutIf writes a small file only if it is unchanged. With an empty eTag the file must not exist,
+	// otherwise its ETag must equal eTag.
+	PutIf(p string, data []byte, eTag string) (*Object, error)
+	// Stat returns the file, or nil if it does not exist
+	Stat(p string) (*Object, error)
+	// List returns all files under dir and its subfolders
+	List(dir string) ([]Object, error)
+	// Get opens the file for reading
+	Get(p string) (io.ReadCloser, error)
+	// Delete deletes the file, only if its ETag equals eTag when eTag is not empty
+	Delete(p, eTag string) error
+	// Move moves the file, replacing the file at the new path
+	Move(from, to string) (*Object, error)
+	// Copy copies the file, replacing the file at the new path
+	Copy(from, to string) (*Object, error)
+	// Link returns the public download link of a file from this backend
+	Link(obj Object) (string, error)
+	// Hash returns the content hash of data in the format of Object.Hash
+	Hash(data []byte) string
+}
+
+// Batcher is implemented by backends that look up files and make links of many files in fewer requests
+type Batcher interface {
+	// StatAll is Stat of every path, the results and errors are in the order of paths
+	StatAll(paths []string) ([]*Object, []error)
+	// LinkAll is Link of every object, the results and errors are in the order of objs
+	LinkAll(objs []Object) ([]string, []error)
+}
+
+// StatAll looks up the files with one batch if the backend supports it, or one by one
+func StatAll(backend Backend, paths []string) ([]*Object, []error) {
+	if batcher, ok := backend.(Batcher); ok {
+		return batcher.StatAll(paths)
+	}
+	objs := make([]*Object, len(paths))
+	errs := make([]error, len(paths))
+	for i, p := range paths {
+		objs[i], errs[i] = backend.Stat(p)
+	}
+	return objs, errs
+}
+
+// LinkAll makes the links of the files with one batch if the backend supports it, or one by one
+func LinkAll(backend Backend, objs []Object) ([]string, []error) {
+	if batcher, ok := backend.(Batcher); ok {
+		return batcher.LinkAll(objs)
+	}
+	links := make([]string, len(objs))
+	errs := make([]error, len(objs))
+	for i, obj := range objs {
+		links[i], errs[i] = backend.Link(obj)
+	}
+	return links, errs
+}
+
+// Clean returns p relative to the root, without leading or trailing slashes and ".." escaping the root
+func Clean(p string) string {
+	return strings.Trim(path.Clean("/"+p), "/")
+}
+
+// ReadAll reads the whole file
+func ReadAll(backend Backend, p string) ([]byte, error) {
+	r, err := backend.Get(p)
+	if err != nil {
+		return nil, err
+	}
+	defer func(r io.ReadCloser) {
+		_ = r.Close()
+	}(r)
+	return io.ReadAll(r)
+}
+
+// escapePath escapes every segment of p for a url
+func escapePath(p string) string {
+	parts := strings.Split(Clean(p), "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+func notFound(backend, p string) error {
+	return model.NewRequestError(model.ErrorNotFound, backend, p, http.StatusNotFound, fmt.Errorf("%s not found", p))
+}
+
+func conflict(backend, p string) error {
+	return model.NewRequestError(model.ErrorConflict, backend, p, http.StatusPreconditionFailed, fmt.Errorf("%s was changed", p))
+}
@@ -0,0 +1,253 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Local stores the files in a directory tree, for a disk served by a web server or synced by another tool
+type Local struct {
+	dir     string
+	baseUrl string
+
+	// mux makes PutIf and conditional deletes atomic in this process
+	mux sync.Mutex
+}
+
+// NewLocal returns a backend rooted at dir. Links are baseUrl joined with the path, or file:// urls if it is empty.
+func NewLocal(dir, baseUrl string) (*Local, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("no directory for the local storage")
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &Local{dir: dir, baseUrl: strings.TrimSuffix(baseUrl, "/")}, nil
+}
+
+func (l *Local) Name() string {
+	return "local"
+}
+
+func (l *Local) file(p string) string {
+	return filepath.Join(l.dir, filepath.FromSlash(Clean(p)))
+}
+
+func (l *Local) toObject(p string, info fs.FileInfo) *Object {
+	return &Object{
+		Name: info.Name(),
+		Path: Clean(p),
+		Size: info.Size(),
+		ETag: fmt.Sprintf("%x-%x", info.ModTime().UnixNano(), info.Size()),
+	}
+}
+
+func (l *Local) Put(p string, r io.Reader, _ int64) (*Object, error) {
+	file := l.file(p)
+	err := os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return nil, err
+	}
+	// write beside the file and rename, so readers never see a partial file
+	tmp, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".*")
+	if err != nil {
+		return nil, err
+	}
+	h := sha1.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return nil, err
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	obj := l.toObject(p, info)
+	obj.Hash = hex.EncodeToString(h.Sum(nil))
+	return obj, nil
+}
+
+func (l *Local) PutIf(p string, data []byte, eTag string) (*Object, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	file := l.file(p)
+	if eTag == "" {
+		err := os.MkdirAll(filepath.Dir(file), 0755)
+		if err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			return nil, conflict(l.Name(), p)
+		}
+		if err != nil {
+			return nil, err
+		}
+		_, err = f.Write(data)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, err
+		}
+		return l.Stat(p)
+	}
+	obj, err := l.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return nil, notFound(l.Name(), p)
+	}
+	if obj.ETag != eTag {
+		return nil, conflict(l.Name(), p)
+	}
+	return l.Put(p, bytes.NewReader(data), int64(len(data)))
+}
+
+func (l *Local) Stat(p string) (*Object, error) {
+	file := l.file(p)
+	info, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	obj := l.toObject(p, info)
+	if info.IsDir() {
+		return obj, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+	h := sha1.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+	obj.Hash = hex.EncodeToString(h.Sum(nil))
+	return obj, nil
+}
+
+// List does not hash the files, Stat a file for its hash
+func (l *Local) List(dir string) ([]Object, error) {
+	var objects []Object
+	root := l.file(dir)
+	err := filepath.WalkDir(root, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && file == root {
+				return fs.SkipDir
+			}
+			return err
+		}
+		// skip the temporary files of Put
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(l.dir, file)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, *l.toObject(filepath.ToSlash(rel), info))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+func (l *Local) Get(p string) (io.ReadCloser, error) {
+	f, err := os.Open(l.file(p))
+	if os.IsNotExist(err) {
+		return nil, notFound(l.Name(), p)
+	}
+	return f, err
+}
+
+func (l *Local) Delete(p, eTag string) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	file := l.file(p)
+	if eTag != "" {
+		info, err := os.Stat(file)
+		if err == nil && l.toObject(p, info).ETag != eTag {
+			return conflict(l.Name(), p)
+		}
+	}
+	err := os.Remove(file)
+	if os.IsNotExist(err) {
+		return notFound(l.Name(), p)
+	}
+	return err
+}
+
+func (l *Local) Move(from, to string) (*Object, error) {
+	target := l.file(to)
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Rename(l.file(from), target)
+	if os.IsNotExist(err) {
+		return nil, notFound(l.Name(), from)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return l.Stat(to)
+}
+
+func (l *Local) Copy(from, to string) (*Object, error) {
+	r, err := l.Get(from)
+	if err != nil {
+		return nil, err
+	}
+	defer func(r io.ReadCloser) {
+		_ = r.Close()
+	}(r)
+	return l.Put(to, r, -1)
+}
+
+func (l *Local) Link(obj Object) (string, error) {
+	if l.baseUrl == "" {
+		return (&url.URL{Scheme: "file", Path: filepath.ToSlash(l.file(obj.Path))}).String(), nil
+	}
+	return l.baseUrl + "/" + escapePath(obj.Path), nil
+}
+
+// Hash returns the hex SHA1 of data
+func (l *Local) Hash(data []byte) string {
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
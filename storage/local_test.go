@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"bytes"
+	"github.com/MingxuanGame/OsuBeatmapSync/model"
+	"testing"
+)
+
+func newTestLocal(t *testing.T) *Local {
+	l, err := NewLocal(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestLocalPutIf(t *testing.T) {
+	l := newTestLocal(t)
+	created, err := l.PutIf("a/lock", []byte("first"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.ETag == "" || created.Hash != l.Hash([]byte("first")) {
+		t.Fatalf("created %+v", created)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		data string
+		eTag string
+		want model.ErrorType
+	}{
+		{"create existing", "a/lock", "second", "", model.ErrorConflict},
+		{"stale eTag", "a/lock", "second", "stale", model.ErrorConflict},
+		{"missing file", "a/missing", "second", created.ETag, model.ErrorNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := l.PutIf(tt.path, []byte(tt.data), tt.eTag)
+			if model.GetErrorType(err) != tt.want {
+				t.Fatalf("got %v, want %s", err, tt.want)
+			}
+		})
+	}
+	data, err := ReadAll(l, "a/lock")
+	if err != nil || string(data) != "first" {
+		t.Fatalf("file is %q after failed writes, err %v", data, err)
+	}
+
+	replaced, err := l.PutIf("a/lock", []byte("replaced"), created.ETag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced.ETag == created.ETag {
+		t.Fatal("eTag is not changed by the write")
+	}
+	_, err = l.PutIf("a/lock", []byte("again"), created.ETag)
+	if model.GetErrorType(err) != model.ErrorConflict {
+		t.Fatalf("write with the replaced eTag: got %v, want a conflict", err)
+	}
+	obj, err := l.Stat("a/lock")
+	if err != nil || obj.ETag != replaced.ETag {
+		t.Fatalf("stat eTag %v, want %s, err %v", obj, replaced.ETag, err)
+	}
+}
+
+func TestLocalDelete(t *testing.T) {
+	l := newTestLocal(t)
+	obj, err := l.PutIf("lock", []byte("data"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Delete("lock", "stale")
+	if model.GetErrorType(err) != model.ErrorConflict {
+		t.Fatalf("delete with a stale eTag: got %v, want a conflict", err)
+	}
+	if kept, _ := l.Stat("lock"); kept == nil {
+		t.Fatal("file is deleted with a stale eTag")
+	}
+	err = l.Delete("lock", obj.ETag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Delete("lock", "")
+	if model.GetErrorType(err) != model.ErrorNotFound {
+		t.Fatalf("delete a missing file: got %v, want not found", err)
+	}
+}
+
+func TestLocalMove(t *testing.T) {
+	l := newTestLocal(t)
+	_, err := l.Put("from/a.osz", bytes.NewReader([]byte("data")), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved, err := l.Move("from/a.osz", "new/dir/b.osz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.Path != "new/dir/b.osz" || moved.Name != "b.osz" || moved.Hash != l.Hash([]byte("data")) {
+		t.Fatalf("moved %+v", moved)
+	}
+	if source, _ := l.Stat("from/a.osz"); source != nil {
+		t.Fatal("source is kept")
+	}
+	_, err = l.Move("from/a.osz", "new/c.osz")
+	if model.GetErrorType(err) != model.ErrorNotFound {
+		t.Fatalf("move a missing file: got %v, want not found", err)
+	}
+}
+
+func TestLocalList(t *testing.T) {
+	l := newTestLocal(t)
+	for _, p := range []string{"a/1.osz", "a/b/2.osz", "c/3.osz"} {
+		_, err := l.Put(p, bytes.NewReader([]byte(p)), int64(len(p)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	objects, err := l.List("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 || objects[0].Path != "a/1.osz" || objects[1].Path != "a/b/2.osz" {
+		t.Fatalf("listed %+v", objects)
+	}
+	objects, err = l.List("missing")
+	if err != nil || len(objects) != 0 {
+		t.Fatalf("listed %+v in a missing folder, err %v", objects, err)
+	}
+}
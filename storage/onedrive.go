@@ -0,0 +1,260 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	. "github.com/MingxuanGame/OsuBeatmapSync/model/onedrive"
+	"github.com/MingxuanGame/OsuBeatmapSync/onedrive"
+	"github.com/MingxuanGame/OsuBeatmapSync/onedrive/quickxorhash"
+	"io"
+	"path"
+	"sync"
+)
+
+// OneDrive stores the files in the drive of the signed-in user, paths are relative to the drive root
+type OneDrive struct {
+	graph *onedrive.GraphClient
+
+	mux sync.Mutex
+	// folders caches the ids of the folders files are moved or copied into
+	folders map[string]string
+
+	indexMux sync.Mutex
+	// index mirrors the drive tree, it is loaded on the first List
+	index *onedrive.DriveIndex
+}
+
+func NewOneDrive(graph *onedrive.GraphClient) *OneDrive {
+	return &OneDrive{graph: graph, folders: make(map[string]string)}
+}
+
+// Graph returns the client of the drive
+func (o *OneDrive) Graph() *onedrive.GraphClient {
+	return o.graph
+}
+
+func toObject(item *DriveItem) *Object {
+	obj := &Object{
+		Id:   item.Id,
+		Name: item.Name,
+		Path: item.Path(),
+		Size: item.Size,
+		ETag: item.ETag,
+	}
+	if item.File != nil {
+		obj.Hash = item.File.Hashes.QuickXorHash
+	}
+	return obj
+}
+
+func (o *OneDrive) Name() string {
+	return "onedrive"
+}
+
+func (o *OneDrive) Put(p string, r io.Reader, size int64) (*Object, error) {
+	// the size of an upload session is fixed when it is created
+	if size < 0 {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		r, size = bytes.NewReader(data), int64(len(data))
+	}
+	dir, name := path.Split(Clean(p))
+	item, err := o.graph.Upload(Clean(dir), name, r, size)
+	if err != nil {
+		return nil, err
+	}
+	// the parent reference of an uploaded item may have no path
+	obj := toObject(item)
+	obj.Path = Clean(p)
+	return obj, nil
+}
+
+func (o *OneDrive) PutIf(p string, data []byte, eTag string) (*Object, error) {
+	dir, name := path.Split(Clean(p))
+	item, err := o.graph.PutFile(Clean(dir), name, eTag, data)
+	if err != nil {
+		return nil, err
+	}
+	obj := toObject(item)
+	obj.Path = Clean(p)
+	return obj, nil
+}
+
+func (o *OneDrive) Stat(p string) (*Object, error) {
+	dir, name := path.Split(Clean(p))
+	item, err := o.graph.GetItem(Clean(dir), name)
+	if err != nil || item == nil {
+		return nil, err
+	}
+	return toObject(item), nil
+}
+
+// Index returns the mirror of the drive tree after applying the changes since the last call.
+// The index is saved to onedrive.DriveIndexFilename, so the next run only reads the changes too.
+func (o *OneDrive) Index() (*onedrive.DriveIndex, error) {
+	o.indexMux.Lock()
+	defer o.indexMux.Unlock()
+	if o.index == nil {
+		index, err := onedrive.LoadDriveIndex(onedrive.DriveIndexFilename)
+		if err != nil {
+			return nil, err
+		}
+		o.index = index
+	}
+	err := o.graph.UpdateIndex(o.index)
+	if err != nil {
+		return nil, err
+	}
+	err = o.index.Save(onedrive.DriveIndexFilename)
+	if err != nil {
+		return nil, err
+	}
+	return o.index, nil
+}
+
+// List reads the files from the drive index instead of listing every folder
+func (o *OneDrive) List(dir string) ([]Object, error) {
+	index, err := o.Index()
+	if err != nil {
+		return nil, err
+	}
+	items := index.Files(Clean(dir))
+	objects := make([]Object, 0, len(items))
+	for _, item := range items {
+		objects = append(objects, *toObject(&item))
+	}
+	return objects, nil
+}
+
+// stat returns the file, or an ErrorNotFound error if it does not exist
+func (o *OneDrive) stat(p string) (*Object, error) {
+	obj, err := o.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return nil, notFound(o.Name(), p)
+	}
+	return obj, nil
+}
+
+func (o *OneDrive) Get(p string) (io.ReadCloser, error) {
+	obj, err := o.stat(p)
+	if err != nil {
+		return nil, err
+	}
+	data, err := o.graph.DownloadFile(obj.Id)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (o *OneDrive) Delete(p, eTag string) error {
+	obj, err := o.stat(p)
+	if err != nil {
+		return err
+	}
+	return o.graph.DeleteItemIfMatch(obj.Id, eTag)
+}
+
+// folder returns the id of the folder, creating it if it does not exist
+func (o *OneDrive) folder(dir string) (string, error) {
+	o.mux.Lock()
+	id, ok := o.folders[dir]
+	o.mux.Unlock()
+	if ok {
+		return id, nil
+	}
+	item, err := o.graph.CreateFolderRecursive(dir)
+	if err != nil {
+		return "", err
+	}
+	o.mux.Lock()
+	o.folders[dir] = item.Id
+	o.mux.Unlock()
+	return item.Id, nil
+}
+
+func (o *OneDrive) Move(from, to string) (*Object, error) {
+	source, err := o.stat(from)
+	if err != nil {
+		return nil, err
+	}
+	dir, name := path.Split(Clean(to))
+	folderId, err := o.folder(Clean(dir))
+	if err != nil {
+		return nil, err
+	}
+	err = o.graph.MoveItem(source.Id, folderId, name)
+	if err != nil {
+		return nil, err
+	}
+	// the id is kept, only the eTag changes
+	moved := *source
+	moved.Name, moved.Path, moved.ETag = name, Clean(to), ""
+	return &moved, nil
+}
+
+func (o *OneDrive) Copy(from, to string) (*Object, error) {
+	source, err := o.stat(from)
+	if err != nil {
+		return nil, err
+	}
+	dir, name := path.Split(Clean(to))
+	folderId, err := o.folder(Clean(dir))
+	if err != nil {
+		return nil, err
+	}
+	err = o.graph.CopyItem(source.Id, folderId, name)
+	if err != nil {
+		return nil, err
+	}
+	return o.stat(to)
+}
+
+func (o *OneDrive) Link(obj Object) (string, error) {
+	if obj.Id == "" {
+		found, err := o.stat(obj.Path)
+		if err != nil {
+			return "", err
+		}
+		obj = *found
+	}
+	return o.graph.MakeShareLink(obj.Id)
+}
+
+// StatAll looks up the files with $batch requests of up to 20 paths
+func (o *OneDrive) StatAll(paths []string) ([]*Object, []error) {
+	cleaned := make([]string, len(paths))
+	for i, p := range paths {
+		cleaned[i] = Clean(p)
+	}
+	items, errs := o.graph.GetItems(cleaned)
+	objs := make([]*Object, len(items))
+	for i, item := range items {
+		if item != nil {
+			objs[i] = toObject(item)
+		}
+	}
+	return objs, errs
+}
+
+// LinkAll makes the links with $batch requests, files without an id are addressed by their path
+func (o *OneDrive) LinkAll(objs []Object) ([]string, []error) {
+	ids := make([]string, len(objs))
+	paths := make([]string, len(objs))
+	for i, obj := range objs {
+		ids[i], paths[i] = obj.Id, Clean(obj.Path)
+	}
+	return o.graph.MakeShareLinks(ids, paths)
+}
+
+// Hash returns the base64 QuickXorHash, the format of the drive item hashes
+func (o *OneDrive) Hash(data []byte) string {
+	sum, _ := hex.DecodeString(quickxorhash.Sum(data))
+	return base64.StdEncoding.EncodeToString(sum)
+}
@@ -0,0 +1,258 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"github.com/MingxuanGame/OsuBeatmapSync/base_service"
+	"github.com/MingxuanGame/OsuBeatmapSync/model"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// s3PartSize is the size of the parts of multipart uploads, files up to this size are uploaded at once
+const s3PartSize = 16 << 20
+
+// md5Metadata is the user metadata holding the MD5 of a file, the ETag of a multipart upload is not its MD5
+const md5Metadata = "Md5"
+
+// S3 stores the files in an S3-compatible bucket, paths are the object keys
+type S3 struct {
+	ctx    context.Context
+	client *minio.Client
+	config model.S3Storage
+}
+
+func NewS3(ctx context.Context, config model.S3Storage) (*S3, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, fmt.Errorf("no endpoint or bucket for the s3 storage")
+	}
+	lookup := minio.BucketLookupAuto
+	if config.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:        credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+		Secure:       !config.Insecure,
+		Region:       config.Region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, err
+	}
+	s := &S3{ctx: ctx, client: client, config: config}
+	ok, err := client.BucketExists(ctx, config.Bucket)
+	if err != nil {
+		return nil, s.error(err, "")
+	}
+	if !ok {
+		return nil, fmt.Errorf("bucket %s does not exist", config.Bucket)
+	}
+	return s, nil
+}
+
+func (s *S3) Name() string {
+	return "s3"
+}
+
+func (s *S3) error(err error, key string) error {
+	if err == nil {
+		return nil
+	}
+	resp := minio.ToErrorResponse(err)
+	if resp.StatusCode == 0 {
+		return err
+	}
+	typ := model.ErrorUnknown
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		typ = model.ErrorNotFound
+	case resp.StatusCode == http.StatusConflict || resp.StatusCode == http.StatusPreconditionFailed:
+		typ = model.ErrorConflict
+	case resp.StatusCode == http.StatusTooManyRequests || resp.Code == "SlowDown":
+		typ = model.ErrorRateLimited
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		typ = model.ErrorAuthExpired
+	case resp.StatusCode >= 500:
+		typ = model.ErrorServer
+	}
+	return model.NewRequestError(typ, s.Name(), key, resp.StatusCode, err)
+}
+
+// hash returns the MD5 of the object, from the user metadata or the ETag of a single part upload
+func hash(info minio.ObjectInfo) string {
+	if sum := info.UserMetadata[md5Metadata]; sum != "" {
+		return sum
+	}
+	if len(info.ETag) == md5.Size*2 {
+		return info.ETag
+	}
+	return ""
+}
+
+func (s *S3) toObject(info minio.ObjectInfo) *Object {
+	return &Object{
+		Name: path.Base(info.Key),
+		Path: info.Key,
+		Size: info.Size,
+		Hash: hash(info),
+		ETag: info.ETag,
+	}
+}
+
+func (s *S3) Put(p string, r io.Reader, size int64) (*Object, error) {
+	key := Clean(p)
+	opts := minio.PutObjectOptions{ContentType: "application/octet-stream", PartSize: s3PartSize}
+	// the MD5 is known before the upload only if the file can be read twice
+	if seeker, ok := r.(io.ReadSeeker); ok {
+		h := md5.New()
+		_, err := io.Copy(h, seeker)
+		if err != nil {
+			return nil, err
+		}
+		_, err = seeker.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+		opts.UserMetadata = map[string]string{md5Metadata: hex.EncodeToString(h.Sum(nil))}
+	}
+	_, err := s.client.PutObject(s.ctx, s.config.Bucket, key, base_service.UploadThrottle().Reader(s.ctx, r), size, opts)
+	if err != nil {
+		return nil, s.error(err, key)
+	}
+	return s.stat(key)
+}
+
+// PutIf uses conditional writes, supported by MinIO, AWS S3 and Cloudflare R2
+func (s *S3) PutIf(p string, data []byte, eTag string) (*Object, error) {
+	key := Clean(p)
+	opts := minio.PutObjectOptions{ContentType: "application/octet-stream", DisableMultipart: true}
+	if eTag == "" {
+		opts.SetMatchETagExcept("*")
+	} else {
+		opts.SetMatchETag(eTag)
+	}
+	_, err := s.client.PutObject(s.ctx, s.config.Bucket, key, bytes.NewReader(data), int64(len(data)), opts)
+	if err != nil {
+		return nil, s.error(err, key)
+	}
+	return s.stat(key)
+}
+
+func (s *S3) Stat(p string) (*Object, error) {
+	key := Clean(p)
+	info, err := s.client.StatObject(s.ctx, s.config.Bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		err = s.error(err, key)
+		if model.GetErrorType(err) == model.ErrorNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return s.toObject(info), nil
+}
+
+// stat returns the file, or an ErrorNotFound error if it does not exist
+func (s *S3) stat(p string) (*Object, error) {
+	obj, err := s.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return nil, notFound(s.Name(), p)
+	}
+	return obj, nil
+}
+
+func (s *S3) List(dir string) ([]Object, error) {
+	prefix := Clean(dir)
+	if prefix != "" {
+		prefix += "/"
+	}
+	var objects []Object
+	for info := range s.client.ListObjects(s.ctx, s.config.Bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if info.Err != nil {
+			return nil, s.error(info.Err, prefix)
+		}
+		objects = append(objects, *s.toObject(info))
+	}
+	return objects, nil
+}
+
+func (s *S3) Get(p string) (io.ReadCloser, error) {
+	key := Clean(p)
+	obj, err := s.client.GetObject(s.ctx, s.config.Bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s.error(err, key)
+	}
+	// the request is only sent on the first read or stat
+	_, err = obj.Stat()
+	if err != nil {
+		_ = obj.Close()
+		return nil, s.error(err, key)
+	}
+	return obj, nil
+}
+
+// Delete checks the eTag before deleting, the check and the delete are not atomic
+func (s *S3) Delete(p, eTag string) error {
+	key := Clean(p)
+	if eTag != "" {
+		obj, err := s.stat(key)
+		if err != nil {
+			return err
+		}
+		if obj.ETag != eTag {
+			return conflict(s.Name(), key)
+		}
+	}
+	return s.error(s.client.RemoveObject(s.ctx, s.config.Bucket, key, minio.RemoveObjectOptions{}), key)
+}
+
+func (s *S3) Move(from, to string) (*Object, error) {
+	obj, err := s.Copy(from, to)
+	if err != nil {
+		return nil, err
+	}
+	err = s.Delete(from, "")
+	if err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// Copy copies the object on the server, with its metadata
+func (s *S3) Copy(from, to string) (*Object, error) {
+	src, dst := Clean(from), Clean(to)
+	_, err := s.client.CopyObject(s.ctx,
+		minio.CopyDestOptions{Bucket: s.config.Bucket, Object: dst},
+		minio.CopySrcOptions{Bucket: s.config.Bucket, Object: src})
+	if err != nil {
+		return nil, s.error(err, src)
+	}
+	return s.stat(dst)
+}
+
+func (s *S3) Link(obj Object) (string, error) {
+	key := Clean(obj.Path)
+	if s.config.PublicUrl != "" {
+		return strings.TrimSuffix(s.config.PublicUrl, "/") + "/" + escapePath(key), nil
+	}
+	u, err := s.client.PresignedGetObject(s.ctx, s.config.Bucket, key, s.config.LinkExpiryDuration(), nil)
+	if err != nil {
+		return "", s.error(err, key)
+	}
+	return u.String(), nil
+}
+
+// Hash returns the hex MD5 of data
+func (s *S3) Hash(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
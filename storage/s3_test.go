@@ -0,0 +1,324 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/MingxuanGame/OsuBeatmapSync/model"
+	"github.com/minio/minio-go/v7"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestS3Hash(t *testing.T) {
+	sum := md5.Sum([]byte("data"))
+	md5Hex := hex.EncodeToString(sum[:])
+	tests := []struct {
+		name string
+		info minio.ObjectInfo
+		want string
+	}{
+		{"single part eTag", minio.ObjectInfo{ETag: md5Hex}, md5Hex},
+		{"multipart eTag", minio.ObjectInfo{ETag: md5Hex + "-3"}, ""},
+		{"metadata", minio.ObjectInfo{ETag: md5Hex + "-3", UserMetadata: map[string]string{md5Metadata: md5Hex}}, md5Hex},
+		{"metadata over eTag", minio.ObjectInfo{ETag: strings.Repeat("0", 32), UserMetadata: map[string]string{md5Metadata: md5Hex}}, md5Hex},
+		{"no eTag", minio.ObjectInfo{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hash(tt.info); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestS3Error(t *testing.T) {
+	s := &S3{}
+	tests := []struct {
+		status int
+		code   string
+		want   model.ErrorType
+	}{
+		{http.StatusNotFound, "NoSuchKey", model.ErrorNotFound},
+		{http.StatusConflict, "OperationAborted", model.ErrorConflict},
+		{http.StatusPreconditionFailed, "PreconditionFailed", model.ErrorConflict},
+		{http.StatusTooManyRequests, "", model.ErrorRateLimited},
+		{http.StatusServiceUnavailable, "SlowDown", model.ErrorRateLimited},
+		{http.StatusForbidden, "AccessDenied", model.ErrorAuthExpired},
+		{http.StatusInternalServerError, "InternalError", model.ErrorServer},
+		{http.StatusBadRequest, "InvalidArgument", model.ErrorUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d %s", tt.status, tt.code), func(t *testing.T) {
+			err := s.error(minio.ErrorResponse{StatusCode: tt.status, Code: tt.code}, "key")
+			if got := model.GetErrorType(err); got != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+	// errors without a response, like a closed connection, are kept
+	err := errors.New("connection reset")
+	if s.error(err, "key") != err {
+		t.Fatal("error without a response is changed")
+	}
+}
+
+// fakeS3 is a bucket that follows the conditional writes of S3
+type fakeS3 struct {
+	mux     sync.Mutex
+	objects map[string][]byte
+	// conditions are the If-Match and If-None-Match headers of the PUTs
+	conditions []string
+}
+
+func (f *fakeS3) eTag(key string) string {
+	sum := md5.Sum(f.objects[key])
+	return hex.EncodeToString(sum[:])
+}
+
+func (f *fakeS3) serve(w http.ResponseWriter, r *http.Request) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != "bucket" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if key == "" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	data, exists := f.objects[key]
+	switch r.Method {
+	case http.MethodHead:
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", `"`+f.eTag(key)+`"`)
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPut:
+		ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+		f.conditions = append(f.conditions, "If-Match: "+ifMatch+", If-None-Match: "+ifNoneMatch)
+		if (ifNoneMatch == "*" && exists) || (ifMatch != "" && (!exists || strings.Trim(ifMatch, `"`) != f.eTag(key))) {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusPreconditionFailed)
+			_, _ = io.WriteString(w, `<Error><Code>PreconditionFailed</Code><Message>At least one of the pre-conditions you specified did not hold</Message></Error>`)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+			body = decodeChunks(body)
+		}
+		f.objects[key] = body
+		w.Header().Set("ETag", `"`+f.eTag(key)+`"`)
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// decodeChunks returns the data of a body signed in chunks, each chunk is "size;chunk-signature=...\r\ndata\r\n"
+func decodeChunks(body []byte) []byte {
+	var data []byte
+	for len(body) > 0 {
+		header, rest, _ := bytes.Cut(body, []byte("\r\n"))
+		sizeHex, _, _ := bytes.Cut(header, []byte(";"))
+		var size int
+		_, _ = fmt.Sscanf(string(sizeHex), "%x", &size)
+		if size == 0 || len(rest) < size {
+			break
+		}
+		data = append(data, rest[:size]...)
+		body = bytes.TrimPrefix(rest[size:], []byte("\r\n"))
+	}
+	return data
+}
+
+func newFakeS3(t *testing.T) (*S3, *fakeS3) {
+	f := &fakeS3{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(srv.Close)
+	u, _ := url.Parse(srv.URL)
+	s, err := NewS3(context.Background(), model.S3Storage{
+		Endpoint:  u.Host,
+		Insecure:  true,
+		Region:    "us-east-1",
+		Bucket:    "bucket",
+		AccessKey: "access",
+		SecretKey: "secret",
+		PathStyle: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, f
+}
+
+func TestS3PutIf(t *testing.T) {
+	s, f := newFakeS3(t)
+	created, err := s.PutIf("lock", []byte("first"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.ETag != f.eTag("lock") || created.Hash != s.Hash([]byte("first")) {
+		t.Fatalf("created %+v", created)
+	}
+	_, err = s.PutIf("lock", []byte("second"), "")
+	if model.GetErrorType(err) != model.ErrorConflict {
+		t.Fatalf("create an existing file: got %v, want a conflict", err)
+	}
+	_, err = s.PutIf("lock", []byte("second"), "stale")
+	if model.GetErrorType(err) != model.ErrorConflict {
+		t.Fatalf("write with a stale eTag: got %v, want a conflict", err)
+	}
+	replaced, err := s.PutIf("lock", []byte("replaced"), created.ETag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced.ETag == created.ETag || string(f.objects["lock"]) != "replaced" {
+		t.Fatal("file is not replaced")
+	}
+
+	want := []string{
+		"If-Match: , If-None-Match: *",
+		"If-Match: , If-None-Match: *",
+		`If-Match: "stale", If-None-Match: `,
+		`If-Match: "` + created.ETag + `", If-None-Match: `,
+	}
+	if strings.Join(f.conditions, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("sent conditions\n%s\nwant\n%s", strings.Join(f.conditions, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestS3Delete(t *testing.T) {
+	s, f := newFakeS3(t)
+	obj, err := s.PutIf("lock", []byte("data"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Delete("lock", "stale")
+	if model.GetErrorType(err) != model.ErrorConflict {
+		t.Fatalf("delete with a stale eTag: got %v, want a conflict", err)
+	}
+	if _, ok := f.objects["lock"]; !ok {
+		t.Fatal("file is deleted with a stale eTag")
+	}
+	err = s.Delete("lock", obj.ETag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Delete("lock", obj.ETag)
+	if model.GetErrorType(err) != model.ErrorNotFound {
+		t.Fatalf("delete a missing file with an eTag: got %v, want not found", err)
+	}
+}
+
+// TestS3Server runs against a real server like MinIO, set OSU_SYNC_TEST_S3 to endpoint/bucket and
+// OSU_SYNC_TEST_S3_KEYS to access:secret, like localhost:9000/test and minioadmin:minioadmin
+func TestS3Server(t *testing.T) {
+	target := os.Getenv("OSU_SYNC_TEST_S3")
+	if target == "" {
+		t.Skip("OSU_SYNC_TEST_S3 is not set")
+	}
+	endpoint, bucket, _ := strings.Cut(target, "/")
+	accessKey, secretKey, _ := strings.Cut(os.Getenv("OSU_SYNC_TEST_S3_KEYS"), ":")
+	s, err := NewS3(context.Background(), model.S3Storage{
+		Endpoint:  endpoint,
+		Insecure:  os.Getenv("OSU_SYNC_TEST_S3_TLS") == "",
+		Region:    "us-east-1",
+		Bucket:    bucket,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		PathStyle: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := fmt.Sprintf("osu-sync-test-%d", time.Now().UnixNano())
+	t.Cleanup(func() {
+		objects, _ := s.List(prefix)
+		for _, obj := range objects {
+			_ = s.Delete(obj.Path, "")
+		}
+	})
+
+	data := []byte("beatmapset archive")
+	put, err := s.Put(prefix+"/a/1.osz", bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if put.Hash != s.Hash(data) || put.Size != int64(len(data)) {
+		t.Fatalf("put %+v", put)
+	}
+	stat, err := s.Stat(prefix + "/a/1.osz")
+	if err != nil || stat == nil || stat.ETag != put.ETag || stat.Hash != put.Hash {
+		t.Fatalf("stat %+v, err %v", stat, err)
+	}
+	missing, err := s.Stat(prefix + "/missing")
+	if err != nil || missing != nil {
+		t.Fatalf("stat a missing file: %+v, err %v", missing, err)
+	}
+
+	lock := prefix + "/.sync.lock"
+	created, err := s.PutIf(lock, []byte("first"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.PutIf(lock, []byte("second"), "")
+	if model.GetErrorType(err) != model.ErrorConflict {
+		t.Fatalf("create an existing file: got %v, want a conflict", err)
+	}
+	replaced, err := s.PutIf(lock, []byte("replaced"), created.ETag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.PutIf(lock, []byte("again"), created.ETag)
+	if model.GetErrorType(err) != model.ErrorConflict {
+		t.Fatalf("write with a stale eTag: got %v, want a conflict", err)
+	}
+
+	moved, err := s.Move(prefix+"/a/1.osz", prefix+"/b/2.osz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.Hash != put.Hash {
+		t.Fatalf("moved %+v", moved)
+	}
+	objects, err := s.List(prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 || objects[0].Path != lock || objects[1].Path != prefix+"/b/2.osz" {
+		t.Fatalf("listed %+v", objects)
+	}
+
+	err = s.Delete(lock, created.ETag)
+	if model.GetErrorType(err) != model.ErrorConflict {
+		t.Fatalf("delete with a stale eTag: got %v, want a conflict", err)
+	}
+	err = s.Delete(lock, replaced.ETag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Get(lock)
+	if model.GetErrorType(err) != model.ErrorNotFound {
+		t.Fatalf("get a deleted file: got %v, want not found", err)
+	}
+}
@@ -0,0 +1,388 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"github.com/MingxuanGame/OsuBeatmapSync/base_service"
+	"github.com/MingxuanGame/OsuBeatmapSync/model"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+)
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns">
+  <d:prop><d:getetag/><d:getcontentlength/><d:resourcetype/><oc:checksums/></d:prop>
+</d:propfind>`
+
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Prop struct {
+				ETag         string `xml:"getetag"`
+				Length       int64  `xml:"getcontentlength"`
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+				// Checksums is a Nextcloud extension, like "SHA1:... MD5:... ADLER32:..."
+				Checksums []string `xml:"checksums>checksum"`
+			} `xml:"prop"`
+			Status string `xml:"status"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// WebDAV stores the files on a WebDAV server, paths are relative to the configured collection
+type WebDAV struct {
+	ctx    context.Context
+	client *http.Client
+	config model.WebDAVStorage
+	base   *url.URL
+
+	mux sync.Mutex
+	// folders caches the collections known to exist
+	folders map[string]struct{}
+}
+
+func NewWebDAV(ctx context.Context, config model.WebDAVStorage) (*WebDAV, error) {
+	if config.Url == "" {
+		return nil, fmt.Errorf("no url for the webdav storage")
+	}
+	base, err := url.Parse(strings.TrimSuffix(config.Url, "/"))
+	if err != nil {
+		return nil, err
+	}
+	w := &WebDAV{
+		ctx:     ctx,
+		client:  &http.Client{},
+		config:  config,
+		base:    base,
+		folders: map[string]struct{}{"": {}},
+	}
+	obj, err := w.Stat("")
+	if err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return nil, fmt.Errorf("webdav collection %s does not exist", config.Url)
+	}
+	return w, nil
+}
+
+func (w *WebDAV) Name() string {
+	return "webdav"
+}
+
+func (w *WebDAV) url(p string) string {
+	p = Clean(p)
+	if p == "" {
+		return w.base.String() + "/"
+	}
+	return w.base.String() + "/" + escapePath(p)
+}
+
+func (w *WebDAV) newRequest(method, p string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(w.ctx, method, w.url(p), body)
+	if err != nil {
+		return nil, err
+	}
+	if w.config.Username != "" {
+		req.SetBasicAuth(w.config.Username, w.config.Password)
+	}
+	return req, nil
+}
+
+func (w *WebDAV) error(resp *http.Response, p string) error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	typ := model.ErrorUnknown
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		typ = model.ErrorNotFound
+	case resp.StatusCode == http.StatusConflict || resp.StatusCode == http.StatusPreconditionFailed || resp.StatusCode == http.StatusLocked:
+		typ = model.ErrorConflict
+	case resp.StatusCode == http.StatusTooManyRequests:
+		typ = model.ErrorRateLimited
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		typ = model.ErrorAuthExpired
+	case resp.StatusCode >= 500:
+		typ = model.ErrorServer
+	}
+	return model.NewRequestError(typ, w.Name(), p, resp.StatusCode, fmt.Errorf("%s %s: %s", resp.Request.Method, resp.Status, strings.TrimSpace(string(data))))
+}
+
+// do sends the request and returns an error for a status of 400 or above, the body is closed
+func (w *WebDAV) do(req *http.Request, p string) (*http.Response, []byte, error) {
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(resp.Body)
+	if resp.StatusCode >= 400 {
+		return resp, nil, w.error(resp, p)
+	}
+	data, err := io.ReadAll(resp.Body)
+	return resp, data, err
+}
+
+// mkdir creates the collection and its parents
+func (w *WebDAV) mkdir(dir string) error {
+	dir = Clean(dir)
+	w.mux.Lock()
+	_, ok := w.folders[dir]
+	w.mux.Unlock()
+	if ok {
+		return nil
+	}
+	err := w.mkdir(path.Dir("/" + dir))
+	if err != nil {
+		return err
+	}
+	req, err := w.newRequest("MKCOL", dir+"/", nil)
+	if err != nil {
+		return err
+	}
+	resp, _, err := w.do(req, dir)
+	// 405 is returned if the collection exists
+	if err != nil && (resp == nil || resp.StatusCode != http.StatusMethodNotAllowed) {
+		return err
+	}
+	w.mux.Lock()
+	w.folders[dir] = struct{}{}
+	w.mux.Unlock()
+	return nil
+}
+
+func (w *WebDAV) put(p string, r io.Reader, size int64, header http.Header) (*Object, error) {
+	dir, _ := path.Split(Clean(p))
+	err := w.mkdir(dir)
+	if err != nil {
+		return nil, err
+	}
+	req, err := w.newRequest("PUT", p, base_service.UploadThrottle().Reader(w.ctx, r))
+	if err != nil {
+		return nil, err
+	}
+	if size >= 0 {
+		req.ContentLength = size
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	_, _, err = w.do(req, p)
+	if err != nil {
+		return nil, err
+	}
+	return w.stat(p)
+}
+
+func (w *WebDAV) Put(p string, r io.Reader, size int64) (*Object, error) {
+	header := http.Header{}
+	// Nextcloud keeps the checksum of the upload, it is only known if the file can be read twice
+	if seeker, ok := r.(io.ReadSeeker); ok {
+		h := sha1.New()
+		_, err := io.Copy(h, seeker)
+		if err != nil {
+			return nil, err
+		}
+		_, err = seeker.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+		header.Set("OC-Checksum", "SHA1:"+hex.EncodeToString(h.Sum(nil)))
+	}
+	return w.put(p, r, size, header)
+}
+
+func (w *WebDAV) PutIf(p string, data []byte, eTag string) (*Object, error) {
+	header := http.Header{}
+	if eTag == "" {
+		header.Set("If-None-Match", "*")
+	} else {
+		header.Set("If-Match", eTag)
+	}
+	return w.put(p, bytes.NewReader(data), int64(len(data)), header)
+}
+
+// propfind returns the resources at p with the depth, the first one is p itself
+func (w *WebDAV) propfind(p, depth string) ([]Object, []bool, error) {
+	req, err := w.newRequest("PROPFIND", p, strings.NewReader(propfindBody))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Depth", depth)
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	_, data, err := w.do(req, p)
+	if err != nil {
+		return nil, nil, err
+	}
+	var multistatus davMultistatus
+	err = xml.Unmarshal(data, &multistatus)
+	if err != nil {
+		return nil, nil, err
+	}
+	basePath := strings.TrimSuffix(w.base.Path, "/")
+	objects := make([]Object, 0, len(multistatus.Responses))
+	collections := make([]bool, 0, len(multistatus.Responses))
+	for _, response := range multistatus.Responses {
+		href, err := url.Parse(response.Href)
+		if err != nil {
+			return nil, nil, err
+		}
+		rel := Clean(strings.TrimPrefix(href.Path, basePath))
+		obj := Object{Name: path.Base("/" + rel), Path: rel}
+		collection := false
+		for _, propstat := range response.Propstat {
+			if !strings.Contains(propstat.Status, " 200 ") {
+				continue
+			}
+			prop := propstat.Prop
+			obj.ETag, obj.Size = prop.ETag, prop.Length
+			collection = prop.ResourceType.Collection != nil
+			for _, checksums := range prop.Checksums {
+				for _, checksum := range strings.Fields(checksums) {
+					if sum, ok := strings.CutPrefix(checksum, "SHA1:"); ok {
+						obj.Hash = strings.ToLower(sum)
+					}
+				}
+			}
+		}
+		objects = append(objects, obj)
+		collections = append(collections, collection)
+	}
+	return objects, collections, nil
+}
+
+func (w *WebDAV) Stat(p string) (*Object, error) {
+	objects, _, err := w.propfind(p, "0")
+	if model.GetErrorType(err) == model.ErrorNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(objects) == 0 {
+		return nil, nil
+	}
+	return &objects[0], nil
+}
+
+// stat returns the file, or an ErrorNotFound error if it does not exist
+func (w *WebDAV) stat(p string) (*Object, error) {
+	obj, err := w.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return nil, notFound(w.Name(), p)
+	}
+	return obj, nil
+}
+
+// List walks the collections one level at a time, many servers refuse "Depth: infinity"
+func (w *WebDAV) List(dir string) ([]Object, error) {
+	var files []Object
+	queue := []string{Clean(dir)}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		objects, collections, err := w.propfind(current+"/", "1")
+		if model.GetErrorType(err) == model.ErrorNotFound && current == Clean(dir) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for i, obj := range objects {
+			if obj.Path == current {
+				continue
+			}
+			if collections[i] {
+				queue = append(queue, obj.Path)
+			} else {
+				files = append(files, obj)
+			}
+		}
+	}
+	return files, nil
+}
+
+func (w *WebDAV) Get(p string) (io.ReadCloser, error) {
+	req, err := w.newRequest("GET", p, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		defer func(body io.ReadCloser) {
+			_ = body.Close()
+		}(resp.Body)
+		return nil, w.error(resp, p)
+	}
+	return resp.Body, nil
+}
+
+func (w *WebDAV) Delete(p, eTag string) error {
+	req, err := w.newRequest("DELETE", p, nil)
+	if err != nil {
+		return err
+	}
+	if eTag != "" {
+		req.Header.Set("If-Match", eTag)
+	}
+	_, _, err = w.do(req, p)
+	return err
+}
+
+// transfer sends a MOVE or COPY, replacing the file at the destination
+func (w *WebDAV) transfer(method, from, to string) (*Object, error) {
+	dir, _ := path.Split(Clean(to))
+	err := w.mkdir(dir)
+	if err != nil {
+		return nil, err
+	}
+	req, err := w.newRequest(method, from, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Destination", w.url(to))
+	req.Header.Set("Overwrite", "T")
+	_, _, err = w.do(req, from)
+	if err != nil {
+		return nil, err
+	}
+	return w.stat(to)
+}
+
+func (w *WebDAV) Move(from, to string) (*Object, error) {
+	return w.transfer("MOVE", from, to)
+}
+
+func (w *WebDAV) Copy(from, to string) (*Object, error) {
+	return w.transfer("COPY", from, to)
+}
+
+func (w *WebDAV) Link(obj Object) (string, error) {
+	if w.config.PublicUrl == "" {
+		return w.url(obj.Path), nil
+	}
+	return strings.TrimSuffix(w.config.PublicUrl, "/") + "/" + escapePath(obj.Path), nil
+}
+
+// Hash returns the hex SHA1 of data, the checksum Nextcloud keeps
+func (w *WebDAV) Hash(data []byte) string {
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
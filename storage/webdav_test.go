@@ -0,0 +1,348 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/MingxuanGame/OsuBeatmapSync/model"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// davBase is the path of the collection on the fake server, like the files of a Nextcloud user
+const davBase = "/remote.php/dav/files/user"
+
+// fakeDAV is a WebDAV server in memory with the checksums of Nextcloud, paths are relative to davBase
+type fakeDAV struct {
+	mux         sync.Mutex
+	srv         *httptest.Server
+	files       map[string][]byte
+	checksums   map[string]string
+	collections map[string]bool
+	// versions change the eTag of a file every time it is written
+	versions map[string]int
+	// requests are the methods and paths of the requests, with the Depth of a PROPFIND
+	requests []string
+	// absolute makes the hrefs full urls instead of paths
+	absolute bool
+	// denied is a collection MKCOL is forbidden for
+	denied string
+}
+
+func newFakeDAV(t *testing.T) *fakeDAV {
+	f := &fakeDAV{
+		files:       make(map[string][]byte),
+		checksums:   make(map[string]string),
+		collections: map[string]bool{"": true},
+		versions:    make(map[string]int),
+	}
+	f.srv = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeDAV) eTag(p string) string {
+	return fmt.Sprintf(`"%s-%d"`, strings.ReplaceAll(p, "/", "-"), f.versions[p])
+}
+
+func (f *fakeDAV) serve(w http.ResponseWriter, r *http.Request) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if !strings.HasPrefix(r.URL.Path, davBase+"/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	p := Clean(strings.TrimPrefix(r.URL.Path, davBase))
+	request := r.Method + " " + p
+	if r.Method == "PROPFIND" {
+		request += " " + r.Header.Get("Depth")
+	}
+	f.requests = append(f.requests, request)
+	_, isFile := f.files[p]
+	exists := isFile || f.collections[p]
+	switch r.Method {
+	case "PROPFIND":
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		resources := []string{p}
+		if f.collections[p] && r.Header.Get("Depth") == "1" {
+			resources = append(resources, f.children(p)...)
+		}
+		var body strings.Builder
+		body.WriteString(`<?xml version="1.0"?><d:multistatus xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns">`)
+		for _, resource := range resources {
+			f.writeResponse(&body, resource)
+		}
+		body.WriteString(`</d:multistatus>`)
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.WriteHeader(http.StatusMultiStatus)
+		_, _ = io.WriteString(w, body.String())
+	case "MKCOL":
+		switch {
+		case exists:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case p == f.denied:
+			w.WriteHeader(http.StatusForbidden)
+		case !f.collections[Clean(path.Dir("/"+p))]:
+			w.WriteHeader(http.StatusConflict)
+		default:
+			f.collections[p] = true
+			w.WriteHeader(http.StatusCreated)
+		}
+	case "PUT":
+		if !f.collections[Clean(path.Dir("/"+p))] {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+		if (ifNoneMatch == "*" && isFile) || (ifMatch != "" && (!isFile || ifMatch != f.eTag(p))) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		f.files[p] = data
+		f.versions[p]++
+		f.checksums[p] = r.Header.Get("OC-Checksum")
+		w.WriteHeader(http.StatusCreated)
+	case "GET":
+		if !isFile {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(f.files[p])
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// children are the files and collections directly in the collection
+func (f *fakeDAV) children(dir string) []string {
+	var children []string
+	for _, m := range []map[string]bool{f.collections, f.fileSet()} {
+		for p := range m {
+			if p != "" && Clean(path.Dir("/"+p)) == dir {
+				children = append(children, p)
+			}
+		}
+	}
+	sort.Strings(children)
+	return children
+}
+
+func (f *fakeDAV) fileSet() map[string]bool {
+	files := make(map[string]bool)
+	for p := range f.files {
+		files[p] = true
+	}
+	return files
+}
+
+func (f *fakeDAV) writeResponse(body *strings.Builder, p string) {
+	href := davBase + "/" + escapePath(p)
+	if f.collections[p] {
+		href = strings.TrimSuffix(href, "/") + "/"
+	}
+	if f.absolute {
+		href = f.srv.URL + href
+	}
+	fmt.Fprintf(body, `<d:response><d:href>%s</d:href><d:propstat><d:prop>`, href)
+	if f.collections[p] {
+		body.WriteString(`<d:resourcetype><d:collection/></d:resourcetype>`)
+	} else {
+		fmt.Fprintf(body, `<d:getetag>%s</d:getetag><d:getcontentlength>%d</d:getcontentlength><d:resourcetype/>`, f.eTag(p), len(f.files[p]))
+		if checksum := f.checksums[p]; checksum != "" {
+			// Nextcloud sends the checksums in upper case, separated by spaces
+			fmt.Fprintf(body, `<oc:checksums><oc:checksum>%s MD5:0123 ADLER32:abcd</oc:checksum></oc:checksums>`, strings.ToUpper(checksum))
+		}
+	}
+	body.WriteString(`</d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat>`)
+	// the properties a resource does not have come in a propstat of their own
+	body.WriteString(`<d:propstat><d:prop><d:getetag/><oc:checksums/></d:prop><d:status>HTTP/1.1 404 Not Found</d:status></d:propstat></d:response>`)
+}
+
+func newTestWebDAV(t *testing.T, f *fakeDAV) *WebDAV {
+	w, err := NewWebDAV(context.Background(), model.WebDAVStorage{Url: f.srv.URL + davBase + "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestWebDAVPropfind(t *testing.T) {
+	for _, absolute := range []bool{false, true} {
+		t.Run(fmt.Sprintf("absolute %t", absolute), func(t *testing.T) {
+			f := newFakeDAV(t)
+			f.absolute = absolute
+			w := newTestWebDAV(t, f)
+			data := []byte("beatmapset")
+			obj, err := w.Put("Beatmaps/1 a b [c].osz", bytes.NewReader(data), int64(len(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if obj.Path != "Beatmaps/1 a b [c].osz" || obj.Name != "1 a b [c].osz" || obj.Size != int64(len(data)) {
+				t.Fatalf("stat %+v", obj)
+			}
+			if obj.ETag != f.eTag("Beatmaps/1 a b [c].osz") {
+				t.Fatalf("eTag %s, the one of the 200 propstat is %s", obj.ETag, f.eTag("Beatmaps/1 a b [c].osz"))
+			}
+			sum := sha1.Sum(data)
+			if obj.Hash != hex.EncodeToString(sum[:]) || obj.Hash != w.Hash(data) {
+				t.Fatalf("hash %q from checksums %q", obj.Hash, f.checksums["Beatmaps/1 a b [c].osz"])
+			}
+
+			// a file that cannot be read twice is stored without a checksum
+			obj, err = w.Put("Beatmaps/2.osz", io.MultiReader(bytes.NewReader(data)), int64(len(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if obj.Hash != "" {
+				t.Fatalf("hash %q without a checksum", obj.Hash)
+			}
+			obj, err = w.Stat("Beatmaps/missing.osz")
+			if err != nil || obj != nil {
+				t.Fatalf("stat of a missing file %+v, %v", obj, err)
+			}
+		})
+	}
+}
+
+func TestWebDAVMkdir(t *testing.T) {
+	f := newFakeDAV(t)
+	w := newTestWebDAV(t, f)
+	// the collection exists on the server, but the client does not know it yet
+	f.collections["Beatmaps"] = true
+	_, err := w.Put("Beatmaps/osu/Ranked/1.osz", bytes.NewReader([]byte("1")), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Put("Beatmaps/osu/Ranked/2.osz", bytes.NewReader([]byte("2")), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mkcols []string
+	for _, req := range f.requests {
+		if strings.HasPrefix(req, "MKCOL ") {
+			mkcols = append(mkcols, strings.TrimPrefix(req, "MKCOL "))
+		}
+	}
+	// 405 for the existing collection is taken as created, the known collections are not made again
+	if want := []string{"Beatmaps", "Beatmaps/osu", "Beatmaps/osu/Ranked"}; !slices.Equal(mkcols, want) {
+		t.Fatalf("made collections %v, want %v", mkcols, want)
+	}
+	if !f.collections["Beatmaps/osu/Ranked"] {
+		t.Fatal("collection is not made")
+	}
+
+	// other errors of MKCOL are returned and the collection is not taken as made
+	f.denied = "private"
+	for range 2 {
+		_, err = w.Put("private/1.osz", bytes.NewReader([]byte("1")), 1)
+		if model.GetErrorType(err) != model.ErrorAuthExpired {
+			t.Fatalf("got %v, want the error of MKCOL", err)
+		}
+	}
+	if last := f.requests[len(f.requests)-1]; last != "MKCOL private" {
+		t.Fatalf("last request %s, want MKCOL sent again", last)
+	}
+}
+
+func TestWebDAVPutIf(t *testing.T) {
+	f := newFakeDAV(t)
+	w := newTestWebDAV(t, f)
+	created, err := w.PutIf("lock", []byte("first"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		eTag string
+	}{
+		{"create existing", ""},
+		{"stale eTag", `"stale"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := w.PutIf("lock", []byte("second"), tt.eTag)
+			if model.GetErrorType(err) != model.ErrorConflict {
+				t.Fatalf("got %v, want a conflict", err)
+			}
+		})
+	}
+	replaced, err := w.PutIf("lock", []byte("replaced"), created.ETag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced.ETag == created.ETag || string(f.files["lock"]) != "replaced" {
+		t.Fatal("file is not replaced")
+	}
+	_, err = w.PutIf("missing", []byte("data"), created.ETag)
+	if model.GetErrorType(err) != model.ErrorConflict {
+		t.Fatalf("write a missing file with an eTag: got %v, want a conflict", err)
+	}
+}
+
+func TestWebDAVList(t *testing.T) {
+	f := newFakeDAV(t)
+	w := newTestWebDAV(t, f)
+	for _, p := range []string{"a/1.osz", "a/b/2.osz", "a/b/c d/3.osz", "a/e/4.osz", "other/5.osz"} {
+		_, err := w.Put(p, bytes.NewReader([]byte(p)), int64(len(p)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.collections["a/empty"] = true
+	f.requests = nil
+	objects, err := w.List("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, obj := range objects {
+		paths = append(paths, obj.Path)
+	}
+	sort.Strings(paths)
+	if want := []string{"a/1.osz", "a/b/2.osz", "a/b/c d/3.osz", "a/e/4.osz"}; !slices.Equal(paths, want) {
+		t.Fatalf("listed %v, want %v", paths, want)
+	}
+	for _, req := range f.requests {
+		if !strings.HasPrefix(req, "PROPFIND ") || !strings.HasSuffix(req, " 1") {
+			t.Fatalf("sent %s, want PROPFIND with depth 1", req)
+		}
+	}
+	if len(f.requests) != 5 {
+		t.Fatalf("sent %d PROPFIND, want one per collection", len(f.requests))
+	}
+
+	objects, err = w.List("missing")
+	if err != nil || objects != nil {
+		t.Fatalf("listed %+v in a missing collection, err %v", objects, err)
+	}
+}
+
+func TestWebDAVUrl(t *testing.T) {
+	w := &WebDAV{base: &url.URL{Scheme: "https", Host: "cloud.example.com", Path: davBase}}
+	if got, want := w.url("/a b/c#1.osz"), "https://cloud.example.com"+davBase+"/a%20b/c%231.osz"; got != want {
+		t.Fatalf("url %s, want %s", got, want)
+	}
+	link, err := w.Link(Object{Path: "a b/c.osz"})
+	if err != nil || link != "https://cloud.example.com"+davBase+"/a%20b/c.osz" {
+		t.Fatalf("link %s, %v", link, err)
+	}
+	w.config.PublicUrl = "https://cdn.example.com/files/"
+	link, err = w.Link(Object{Path: "a b/c.osz"})
+	if err != nil || link != "https://cdn.example.com/files/a%20b/c.osz" {
+		t.Fatalf("public link %s, %v", link, err)
+	}
+}
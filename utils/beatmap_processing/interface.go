@@ -123,38 +123,57 @@ func copyFile(srcFile *zip.File, dstZip *zip.Writer) error {
 	return nil
 }
 
-func process(reader *zip.Reader, writer *zip.Writer, p Processor) error {
+// Result is the processed archive and what the processor removed from it
+type Result struct {
+	Data []byte
+	// Removed is the number of files removed from the archive
+	Removed int
+	// Saved is the compressed size of the removed files
+	Saved int64
+}
+
+func process(reader *zip.Reader, writer *zip.Writer, p Processor) (removed int, saved int64, err error) {
 	for _, file := range reader.File {
 		skip, err := p.Rule(file.Name, reader)
 		if err != nil {
-			return fmt.Errorf("rule error: %w", err)
+			return 0, 0, fmt.Errorf("rule error: %w", err)
 		}
 		if skip {
+			removed++
+			saved += int64(file.CompressedSize64)
 			continue
 		}
 		err = copyFile(file, writer)
 		if err != nil {
-			return fmt.Errorf("copy file %s error: %w", file.Name, err)
+			return 0, 0, fmt.Errorf("copy file %s error: %w", file.Name, err)
 		}
 	}
-	return nil
+	return removed, saved, nil
 }
 
 func Process(p Processor, full []byte) ([]byte, error) {
+	result, err := ProcessWithResult(p, full)
+	if err != nil {
+		return nil, err
+	}
+	return result.Data, nil
+}
+
+func ProcessWithResult(p Processor, full []byte) (Result, error) {
 	zipReader := bytes.NewReader(full)
 	reader, err := zip.NewReader(zipReader, int64(len(full)))
 	if err != nil {
-		return nil, fmt.Errorf("cannot read zip file: %w", err)
+		return Result{}, fmt.Errorf("cannot read zip file: %w", err)
 	}
 	var noVideoBuf bytes.Buffer
 	noVideoWriter := zip.NewWriter(&noVideoBuf)
-	err = process(reader, noVideoWriter, p)
+	removed, saved, err := process(reader, noVideoWriter, p)
 	if err != nil {
-		return nil, fmt.Errorf("process %s error: %w", p, err)
+		return Result{}, fmt.Errorf("process %s error: %w", p, err)
 	}
 	err = noVideoWriter.Close()
 	if err != nil {
-		return nil, fmt.Errorf("cannot close %s writer: %w", p, err)
+		return Result{}, fmt.Errorf("cannot close %s writer: %w", p, err)
 	}
-	return noVideoBuf.Bytes(), nil
+	return Result{Data: noVideoBuf.Bytes(), Removed: removed, Saved: saved}, nil
 }
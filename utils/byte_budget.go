@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"context"
+	"sync"
+)
+
+// ByteBudget limits the total number of bytes held in memory at the same time
+type ByteBudget struct {
+	mux   sync.Mutex
+	limit int64
+	used  int64
+	// waiting is the bytes held by the callers blocked in AcquireHolding
+	waiting int64
+	changed chan struct{}
+}
+
+func NewByteBudget(limit int64) *ByteBudget {
+	return &ByteBudget{
+		limit:   limit,
+		changed: make(chan struct{}),
+	}
+}
+
+// Acquire blocks until n bytes fit in the budget. A request larger than the whole budget is clamped to it,
+// it waits until nothing else is held and then runs alone, so it cannot block forever.
+func (b *ByteBudget) Acquire(ctx context.Context, n int64) error {
+	for {
+		b.mux.Lock()
+		if b.used+min(n, b.limit) <= b.limit {
+			b.used += n
+			b.mux.Unlock()
+			return nil
+		}
+		changed := b.changed
+		b.mux.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// AcquireHolding blocks until n bytes fit in the budget, for a caller that already holds held bytes of it.
+// When all the bytes in use are held by such waiters nothing can be given back, then the first of them takes
+// n over the limit and the others wait for it to release.
+func (b *ByteBudget) AcquireHolding(ctx context.Context, n, held int64) error {
+	if n <= 0 {
+		return nil
+	}
+	b.mux.Lock()
+	b.waiting += held
+	// the others may be waiting for the bytes this caller holds
+	b.notify()
+	for {
+		if b.used+n <= b.limit || b.used == b.waiting {
+			b.used += n
+			b.waiting -= held
+			b.mux.Unlock()
+			return nil
+		}
+		changed := b.changed
+		b.mux.Unlock()
+		select {
+		case <-ctx.Done():
+			b.mux.Lock()
+			b.waiting -= held
+			b.mux.Unlock()
+			return ctx.Err()
+		case <-changed:
+		}
+		b.mux.Lock()
+	}
+}
+
+// Add takes n bytes without waiting, n may be negative to give back part of an acquisition.
+// It is only for giving back or for holders that are about to release, new memory goes through Acquire.
+func (b *ByteBudget) Add(n int64) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.used += n
+	if n < 0 {
+		b.notify()
+	}
+}
+
+func (b *ByteBudget) Release(n int64) {
+	b.Add(-n)
+}
+
+func (b *ByteBudget) Used() int64 {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.used
+}
+
+func (b *ByteBudget) Limit() int64 {
+	return b.limit
+}
+
+func (b *ByteBudget) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
@@ -2,15 +2,18 @@ package utils
 
 import (
 	"fmt"
+	"golang.org/x/text/unicode/norm"
 	"regexp"
 	"strconv"
 )
 
-const OsuFilenameRegex = `^(?P<beatmapsetId>\d+)\s+(?P<artist>[\x00-\xff]+)\s+-\s+(?P<name>.+)\.osz$`
+const OsuFilenameRegex = `^(?P<beatmapsetId>\d+)\s+(?P<artist>.+?)\s+-\s+(?P<name>.+)\.osz$`
+
+var osuFilenameRe = regexp.MustCompile(OsuFilenameRegex)
 
 func ParseFilename(filename string) (artist, name string, beatmapsetId int) {
-	re := regexp.MustCompile(OsuFilenameRegex)
-	match := re.FindStringSubmatch(filename)
+	re := osuFilenameRe
+	match := re.FindStringSubmatch(norm.NFC.String(filename))
 	result := make(map[string]string)
 	if match == nil {
 		return "", "", 0
@@ -27,5 +30,5 @@ func ParseFilename(filename string) (artist, name string, beatmapsetId int) {
 }
 
 func MakeFilename(beatmapsetId int, artist, name string) string {
-	return SanitizeFileName(fmt.Sprintf("%d %s - %s.osz", beatmapsetId, artist, name))
+	return NormalizeFileName(fmt.Sprintf("%d %s - %s.osz", beatmapsetId, artist, name))
 }
@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+type FailureRecord struct {
+	Time  int64  `json:"time"`
+	Type  string `json:"type"`
+	Error string `json:"error"`
+}
+
+// RetryState is the failure history of a single item
+type RetryState[T any] struct {
+	Item      T               `json:"item"`
+	Attempts  int             `json:"attempts"`
+	Errors    []FailureRecord `json:"errors"`
+	NextRetry time.Time       `json:"-"`
+}
+
+// Backoff returns the delay before the next try after the given number of attempts,
+// growing exponentially from base up to max with half of it randomized
+func Backoff(attempts int, base, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	if delay <= 1 {
+		return delay
+	}
+	half := delay / 2
+	return half + rand.N(half)
+}
+
+type RetryTracker[K comparable, T any] struct {
+	mux         sync.Mutex
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	states      map[K]*RetryState[T]
+}
+
+func NewRetryTracker[K comparable, T any](maxAttempts int, baseDelay, maxDelay time.Duration) *RetryTracker[K, T] {
+	return &RetryTracker[K, T]{
+		maxAttempts: maxAttempts,
+		baseDelay:   baseDelay,
+		maxDelay:    maxDelay,
+		states:      make(map[K]*RetryState[T]),
+	}
+}
+
+// Fail records a failure of the item and reports whether it should be retried.
+// A permanent failure or running out of attempts makes it a dead letter.
+func (t *RetryTracker[K, T]) Fail(key K, item T, typ string, err error, permanent bool) (bool, RetryState[T]) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	state, ok := t.states[key]
+	if !ok {
+		state = &RetryState[T]{}
+		t.states[key] = state
+	}
+	state.Item = item
+	state.Attempts++
+	state.Errors = append(state.Errors, FailureRecord{Time: time.Now().Unix(), Type: typ, Error: err.Error()})
+	if permanent || state.Attempts >= t.maxAttempts {
+		delete(t.states, key)
+		return false, *state
+	}
+	state.NextRetry = time.Now().Add(Backoff(state.Attempts, t.baseDelay, t.maxDelay))
+	return true, *state
+}
+
+// NextRetry returns when the item may be tried again, zero if it has never failed
+func (t *RetryTracker[K, T]) NextRetry(key K) time.Time {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if state, ok := t.states[key]; ok {
+		return state.NextRetry
+	}
+	return time.Time{}
+}
+
+func (t *RetryTracker[K, T]) Forget(key K) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	delete(t.states, key)
+}
@@ -28,3 +28,13 @@ func SplitSlice[T any](s []T, n int) [][]T {
 
 	return result
 }
+
+// DealSlice splits s into n parts like dealing cards, so every part gets its share of the front of s
+func DealSlice[T any](s []T, n int) [][]T {
+	n = min(n, len(s))
+	result := make([][]T, n)
+	for i, v := range s {
+		result[i%n] = append(result[i%n], v)
+	}
+	return result
+}
@@ -1,6 +1,9 @@
 package utils
 
-import "strings"
+import (
+	"golang.org/x/text/unicode/norm"
+	"strings"
+)
 
 func Reverse(s string) string {
 	runes := []rune(s)
@@ -23,3 +26,9 @@ func SanitizeFileName(fileName string) string {
 	}
 	return fileName
 }
+
+// NormalizeFileName sanitizes the name and converts it to NFC,
+// so the same name typed with composed or decomposed characters gives the same file
+func NormalizeFileName(fileName string) string {
+	return norm.NFC.String(SanitizeFileName(fileName))
+}
@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// throttleBurst is the most bytes read or written at once, so a limited transfer moves smoothly
+const throttleBurst = 32 << 10
+
+// Throttle limits the bytes per second shared by all transfers through it
+type Throttle struct {
+	mux sync.Mutex
+	// limit returns the current limit in bytes per second, 0 for no limit
+	limit func() int64
+	next  time.Time
+}
+
+func NewThrottle(limit func() int64) *Throttle {
+	return &Throttle{limit: limit}
+}
+
+// WaitN blocks until n bytes can be transferred under the limit
+func (t *Throttle) WaitN(ctx context.Context, n int) error {
+	limit := t.limit()
+	if limit <= 0 || n <= 0 {
+		return nil
+	}
+	t.mux.Lock()
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	wait := t.next.Sub(now)
+	t.next = t.next.Add(time.Duration(int64(n) * int64(time.Second) / limit))
+	t.mux.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Reader returns a reader of r limited by the throttle
+func (t *Throttle) Reader(ctx context.Context, r io.Reader) io.Reader {
+	return &throttledReader{ctx: ctx, r: r, throttle: t}
+}
+
+type throttledReader struct {
+	ctx      context.Context
+	r        io.Reader
+	throttle *Throttle
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleBurst {
+		p = p[:throttleBurst]
+	}
+	n, err := r.r.Read(p)
+	if waitErr := r.throttle.WaitN(r.ctx, n); waitErr != nil {
+		return n, waitErr
+	}
+	return n, err
+}
@@ -0,0 +1,99 @@
+package webhook
+
+import (
+	"fmt"
+	. "github.com/MingxuanGame/OsuBeatmapSync/model"
+	"slices"
+	"strings"
+	"time"
+)
+
+type EventType string
+
+const (
+	RunStarted  EventType = "run_started"
+	SetSynced   EventType = "set_synced"
+	SetFailed   EventType = "set_failed"
+	RunFinished EventType = "run_finished"
+)
+
+type Event struct {
+	Type       EventType   `json:"type"`
+	Time       time.Time   `json:"time"`
+	Run        string      `json:"run"`
+	Beatmapset *Beatmapset `json:"beatmapset,omitempty"`
+	Attempts   int         `json:"attempts,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	Summary    *Summary    `json:"summary,omitempty"`
+}
+
+type Beatmapset struct {
+	Id      int               `json:"id"`
+	Artist  string            `json:"artist"`
+	Title   string            `json:"title"`
+	Creator string            `json:"creator"`
+	Status  string            `json:"status"`
+	Modes   []string          `json:"modes"`
+	Links   map[string]string `json:"links,omitempty"`
+}
+
+type Summary struct {
+	Total       int64   `json:"total"`
+	Done        int64   `json:"done"`
+	Failed      int64   `json:"failed"`
+	DeadLetters int     `json:"dead_letters"`
+	Finished    bool    `json:"finished"`
+	Duration    float64 `json:"duration"` // seconds
+}
+
+func NewBeatmapset(beatmapset BeatmapsetMetadata) *Beatmapset {
+	b := &Beatmapset{Id: beatmapset.BeatmapsetId, Links: beatmapset.Link}
+	for _, beatmap := range beatmapset.Beatmaps {
+		b.Artist = beatmap.Artist
+		b.Title = beatmap.Title
+		b.Creator = beatmap.Creator
+		b.Status = beatmap.Status.String()
+		if mode := beatmap.GameMode.String(); !slices.Contains(b.Modes, mode) {
+			b.Modes = append(b.Modes, mode)
+		}
+	}
+	slices.Sort(b.Modes)
+	return b
+}
+
+func (b *Beatmapset) String() string {
+	return fmt.Sprintf("%d %s - %s (%s)", b.Id, b.Artist, b.Title, b.Creator)
+}
+
+// Text is the human-readable message of the event for chat webhooks
+func (e Event) Text() string {
+	var text strings.Builder
+	switch e.Type {
+	case RunStarted:
+		fmt.Fprintf(&text, "[%s] Started, %d beatmapset(s) to sync", e.Run, e.Summary.Total)
+	case SetSynced:
+		fmt.Fprintf(&text, "[%s] Synced %s [%s, %s]", e.Run, e.Beatmapset.String(), e.Beatmapset.Status, strings.Join(e.Beatmapset.Modes, ", "))
+		types := make([]string, 0, len(e.Beatmapset.Links))
+		for typ := range e.Beatmapset.Links {
+			types = append(types, typ)
+		}
+		slices.Sort(types)
+		for _, typ := range types {
+			fmt.Fprintf(&text, "\n%s: %s", typ, e.Beatmapset.Links[typ])
+		}
+	case SetFailed:
+		fmt.Fprintf(&text, "[%s] Gave up %s after %d attempt(s): %s", e.Run, e.Beatmapset.String(), e.Attempts, e.Error)
+	case RunFinished:
+		state := "Finished"
+		if !e.Summary.Finished {
+			state = "Stopped"
+		}
+		fmt.Fprintf(&text, "[%s] %s in %s: %d done, %d failed, %d dead letter(s) of %d",
+			e.Run, state, (time.Duration(e.Summary.Duration) * time.Second).String(),
+			e.Summary.Done, e.Summary.Failed, e.Summary.DeadLetters, e.Summary.Total)
+		if e.Error != "" {
+			fmt.Fprintf(&text, "\n%s", e.Error)
+		}
+	}
+	return text.String()
+}
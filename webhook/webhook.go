@@ -0,0 +1,184 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "github.com/MingxuanGame/OsuBeatmapSync/model"
+	"github.com/MingxuanGame/OsuBeatmapSync/utils"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var logger = log.With().Str("module", "webhook").Logger()
+
+const (
+	maxAttempts  = 5
+	baseDelay    = 2 * time.Second
+	maxDelay     = time.Minute
+	queueSize    = 256
+	closeTimeout = 30 * time.Second
+	// discordMaxLength is the limit of a Discord message, Telegram allows more
+	discordMaxLength = 2000
+)
+
+// Notifier delivers events to the configured webhooks in the background.
+// A nil Notifier is valid and drops every event.
+type Notifier struct {
+	hooks  []Webhook
+	client *http.Client
+	queue  chan Event
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewNotifier returns nil when no webhook is configured
+func NewNotifier(hooks []Webhook) *Notifier {
+	if len(hooks) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &Notifier{
+		hooks:  hooks,
+		client: &http.Client{Timeout: 30 * time.Second},
+		queue:  make(chan Event, queueSize),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	n.wg.Add(1)
+	go n.run()
+	return n
+}
+
+// Emit queues the event without blocking, it is dropped when the queue is full
+func (n *Notifier) Emit(event Event) {
+	if n == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	select {
+	case n.queue <- event:
+	default:
+		logger.Warn().Msgf("Webhook queue is full, drop %s event", event.Type)
+	}
+}
+
+// Close delivers the queued events, giving up on the ones left after a timeout
+func (n *Notifier) Close() {
+	if n == nil {
+		return
+	}
+	close(n.queue)
+	done := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(closeTimeout):
+		logger.Warn().Msg("Timed out delivering webhooks")
+		n.cancel()
+		<-done
+	}
+	n.cancel()
+}
+
+func (n *Notifier) run() {
+	defer n.wg.Done()
+	for event := range n.queue {
+		for _, hook := range n.hooks {
+			if !subscribed(hook, event.Type) {
+				continue
+			}
+			err := n.deliver(hook, event)
+			if err != nil {
+				logger.Error().Err(err).Str("format", hook.Format).Msgf("Failed to deliver %s event", event.Type)
+			}
+		}
+	}
+}
+
+func subscribed(hook Webhook, typ EventType) bool {
+	if len(hook.Events) == 0 {
+		return true
+	}
+	return utils.In(hook.Events, string(typ))
+}
+
+func payload(hook Webhook, event Event) ([]byte, error) {
+	switch hook.Format {
+	case "", "json":
+		return json.Marshal(event)
+	case "discord":
+		text := []rune(event.Text())
+		if len(text) > discordMaxLength {
+			text = append(text[:discordMaxLength-1], '…')
+		}
+		return json.Marshal(map[string]any{"content": string(text)})
+	case "telegram":
+		return json.Marshal(map[string]any{
+			"chat_id":                  hook.ChatId,
+			"text":                     event.Text(),
+			"disable_web_page_preview": true,
+		})
+	default:
+		return nil, fmt.Errorf("unknown webhook format %q", hook.Format)
+	}
+}
+
+// deliver posts the event, retrying on network errors, 429 and 5xx
+func (n *Notifier) deliver(hook Webhook, event Event) error {
+	body, err := payload(hook, event)
+	if err != nil {
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		var retryable bool
+		retryable, err = n.post(hook.Url, body)
+		if err == nil || !retryable || attempt >= maxAttempts {
+			return err
+		}
+		delay := utils.Backoff(attempt, baseDelay, maxDelay)
+		logger.Debug().Err(err).Msgf("Retry webhook in %s", delay.Round(time.Second))
+		select {
+		case <-n.ctx.Done():
+			return n.ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (n *Notifier) post(target string, body []byte) (retryable bool, err error) {
+	req, err := http.NewRequestWithContext(n.ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		// the URL may contain a token, like the Telegram bot API
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return n.ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return false, nil
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = fmt.Errorf("webhook returned %s: %s", resp.Status, data)
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}